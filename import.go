@@ -0,0 +1,82 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
+)
+
+// runImport prints Instance manifests adopting the devices of a project which
+// carry a tag, so hardware created outside the operator can be brought under
+// management. The credentials are read from PACKET_AUTH_TOKEN, PROJECT_ID and
+// the optional PACKET_API_URL environment variables.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	tag := fs.String("tag", "", "only import devices carrying this tag")
+	namespace := fs.String("namespace", "default", "namespace of the generated instances")
+	secret := fs.String("credential-secret", "", "credential secret set in the generated instances")
+	credential := fs.String("credential", "", "MetalCredential set in the generated instances")
+	deletionPolicy := fs.String("deletion-policy", string(equinixv1alpha1.DeletionPolicyRetain),
+		"deletion policy of the generated instances, Retain keeps the hardware if a manifest is deleted by mistake")
+	_ = fs.Parse(args)
+
+	token := os.Getenv("PACKET_AUTH_TOKEN")
+	projectID := os.Getenv("PROJECT_ID")
+	if token == "" || projectID == "" {
+		fmt.Fprintln(os.Stderr, "PACKET_AUTH_TOKEN and PROJECT_ID need to be set")
+		return 1
+	}
+
+	m, err := metal.NewClientWithBaseURL(token, projectID, os.Getenv("PACKET_API_URL"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating metal client: %v\n", err)
+		return 1
+	}
+
+	devices, err := m.DevicesWithTag(*tag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error listing devices: %v\n", err)
+		return 1
+	}
+
+	for i := range devices {
+		instance := metal.InstanceForDevice(&devices[i])
+		instance.Namespace = *namespace
+		instance.Spec.Secret = *secret
+		instance.Spec.Credential = *credential
+		instance.Spec.DeletionPolicy = equinixv1alpha1.DeletionPolicy(*deletionPolicy)
+
+		// status is left out, it is filled in by the operator on adoption
+		out, err := yaml.Marshal(struct {
+			equinixv1alpha1.Instance `json:",inline"`
+			Status                   *struct{} `json:"status,omitempty"`
+		}{Instance: *instance})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error generating manifest for device %s: %v\n", devices[i].ID, err)
+			return 1
+		}
+		fmt.Printf("---\n%s", out)
+	}
+	return 0
+}
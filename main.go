@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -33,6 +34,7 @@ import (
 
 	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
 	"github.com/hobbyfarm/metal-operator/pkg/controllers"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -40,6 +42,16 @@ var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
 	threads  int
+	apiQPS   float64
+	apiBurst int
+
+	credentialNamespace string
+
+	gcInterval      time.Duration
+	gcGracePeriod   time.Duration
+	gcDeleteOrphans bool
+
+	enableWebhooks bool
 )
 
 func init() {
@@ -50,10 +62,23 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
 	flag.IntVar(&threads, "threads", 10, "concurrent reconciles to run")
+	flag.StringVar(&credentialNamespace, "credential-namespace", os.Getenv("POD_NAMESPACE"),
+		"namespace holding the secrets referenced by MetalCredentials, defaults to the namespace of the operator")
+	flag.Float64Var(&apiQPS, "metal-api-qps", metal.DefaultRateLimit, "equinix metal api calls per second allowed per credential")
+	flag.IntVar(&apiBurst, "metal-api-burst", metal.DefaultRateBurst, "equinix metal api calls a credential may burst to")
+	flag.DurationVar(&gcInterval, "gc-interval", 10*time.Minute, "how often to look for orphaned equinix metal resources, 0 disables the sweep")
+	flag.DurationVar(&gcGracePeriod, "gc-grace-period", 24*time.Hour, "how long a resource stays orphaned before it is removed")
+	flag.BoolVar(&gcDeleteOrphans, "gc-delete-orphans", false, "remove orphaned equinix metal resources instead of only reporting them")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"serve the defaulting and validating webhooks, requires a serving certificate in the webhook cert dir")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -66,6 +91,7 @@ func main() {
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	metal.SetRateLimit(apiQPS, apiBurst)
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
@@ -80,26 +106,90 @@ func main() {
 		os.Exit(1)
 	}
 
+	// the controllers share the clients built from credential secrets
+	clients := metal.NewClientCache()
 	if err = (&controllers.InstanceReconciler{
-		Client:  mgr.GetClient(),
-		Scheme:  mgr.GetScheme(),
-		Threads: threads,
-		Log:     ctrl.Log.WithName("controllers").WithName("Instance"),
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Threads:   threads,
+		Log:       ctrl.Log.WithName("controllers").WithName("Instance"),
+		NewClient: clients.NewClient,
+		Recorder:  mgr.GetEventRecorderFor("metal-operator-instance"),
+
+		CredentialNamespace: credentialNamespace,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Instance")
 		os.Exit(1)
 	}
 	if err = (&controllers.ImportKeyPairReconciler{
-		Client:  mgr.GetClient(),
-		Scheme:  mgr.GetScheme(),
-		Threads: threads,
-		Log:     ctrl.Log.WithName("controllers").WithName("ImportKeyPair"),
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Threads:   threads,
+		Log:       ctrl.Log.WithName("controllers").WithName("ImportKeyPair"),
+		NewClient: clients.NewClient,
+
+		CredentialNamespace: credentialNamespace,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ImportKeyPair")
 		os.Exit(1)
 	}
+	if err = (&controllers.ElasticIPReconciler{
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Threads:   threads,
+		Log:       ctrl.Log.WithName("controllers").WithName("ElasticIP"),
+		NewClient: clients.NewClient,
+
+		CredentialNamespace: credentialNamespace,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ElasticIP")
+		os.Exit(1)
+	}
+	if err = (&controllers.VirtualNetworkReconciler{
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Threads:   threads,
+		Log:       ctrl.Log.WithName("controllers").WithName("VirtualNetwork"),
+		NewClient: clients.NewClient,
+
+		CredentialNamespace: credentialNamespace,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "VirtualNetwork")
+		os.Exit(1)
+	}
+	if enableWebhooks {
+		if err = (&equinixv1alpha1.InstanceWebhook{
+			Client:              mgr.GetClient(),
+			CredentialNamespace: credentialNamespace,
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Instance")
+			os.Exit(1)
+		}
+		if err = (&equinixv1alpha1.ImportKeyPairWebhook{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ImportKeyPair")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
+	if gcInterval > 0 {
+		if err = mgr.Add(&controllers.GarbageCollector{
+			Client:    mgr.GetClient(),
+			Reader:    mgr.GetAPIReader(),
+			Log:       ctrl.Log.WithName("controllers").WithName("GarbageCollector"),
+			Recorder:  mgr.GetEventRecorderFor("metal-operator-gc"),
+			NewClient: clients.NewClient,
+
+			CredentialNamespace: credentialNamespace,
+			Interval:            gcInterval,
+			GracePeriod:         gcGracePeriod,
+			DeleteOrphans:       gcDeleteOrphans,
+		}); err != nil {
+			setupLog.Error(err, "unable to add garbage collector")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
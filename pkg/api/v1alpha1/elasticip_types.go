@@ -0,0 +1,115 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ElasticIPType is the kind of address block reserved
+// +kubebuilder:validation:Enum=public_ipv4;global_ipv4;public_ipv6
+type ElasticIPType string
+
+const (
+	ElasticIPPublicIPv4 ElasticIPType = "public_ipv4"
+	ElasticIPGlobalIPv4 ElasticIPType = "global_ipv4"
+	ElasticIPPublicIPv6 ElasticIPType = "public_ipv6"
+)
+
+const (
+	// ElasticIPReserved is the phase of an ElasticIP once the addresses are reserved
+	ElasticIPReserved = "reserved"
+	// ElasticIPFailed is the phase of an ElasticIP which can not be reserved as specified
+	ElasticIPFailed = "failed"
+)
+
+// ElasticIPSpec defines the desired state of ElasticIP
+type ElasticIPSpec struct {
+	// Type of the reservation, public_ipv4 by default
+	Type ElasticIPType `json:"type,omitempty"`
+	// Quantity is the number of addresses to reserve, 1 by default
+	// +kubebuilder:validation:Minimum=1
+	Quantity int `json:"quantity,omitempty"`
+	// CIDR is the prefix length of an ipv4 block to reserve in place of quantity,
+	// for example 30 for four addresses
+	// +kubebuilder:validation:Minimum=8
+	// +kubebuilder:validation:Maximum=32
+	CIDR int `json:"cidr,omitempty"`
+	// Metro the addresses are reserved in, required unless the type is global_ipv4
+	Metro string   `json:"metro,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	// DeletionPolicy Retain keeps the reservation tagged as released when the
+	// ElasticIP is deleted, Orphan leaves it untouched
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	ProjectID      string         `json:"projectID,omitempty"`
+	Secret         string         `json:"credentialSecret,omitempty"`
+	// Credential names a cluster scoped MetalCredential to use instead of credentialSecret
+	Credential string `json:"credential,omitempty"`
+}
+
+// ElasticIPStatus defines the observed state of ElasticIP
+type ElasticIPStatus struct {
+	Status         string `json:"status,omitempty"`
+	ReservationID  string `json:"reservationID,omitempty"`
+	Address        string `json:"address,omitempty"`
+	CIDR           int    `json:"cidr,omitempty"`
+	FailureReason  string `json:"failureReason,omitempty"`
+	FailureMessage string `json:"failureMessage,omitempty"`
+	// Metro is empty for global addresses
+	Metro      string             `json:"metro,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Type",type="string",JSONPath=`.spec.type`
+//+kubebuilder:printcolumn:name="Address",type="string",JSONPath=`.status.address`
+//+kubebuilder:printcolumn:name="CIDR",type="integer",JSONPath=`.status.cidr`
+//+kubebuilder:printcolumn:name="Status",type="string",JSONPath=`.status.status`
+
+// ElasticIP is an Equinix Metal ip reservation which can be attached to
+// instances and outlives them
+type ElasticIP struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ElasticIPSpec   `json:"spec,omitempty"`
+	Status ElasticIPStatus `json:"status,omitempty"`
+}
+
+// GetConditions returns the status conditions
+func (in *ElasticIP) GetConditions() []metav1.Condition {
+	return in.Status.Conditions
+}
+
+// SetConditions replaces the status conditions
+func (in *ElasticIP) SetConditions(conditions []metav1.Condition) {
+	in.Status.Conditions = conditions
+}
+
+//+kubebuilder:object:root=true
+
+// ElasticIPList contains a list of ElasticIP
+type ElasticIPList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ElasticIP `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ElasticIP{}, &ElasticIPList{})
+}
@@ -26,16 +26,23 @@ import (
 // ImportKeyPairSpec defines the desired state of ImportKeyPair
 type ImportKeyPairSpec struct {
 	Key    string `json:"key"`
-	Secret string `json:"secret"`
+	Secret string `json:"secret,omitempty"`
+	// Credential names a cluster scoped MetalCredential to use instead of secret
+	Credential string `json:"credential,omitempty"`
+	// DeletionPolicy Retain or Orphan keeps the key in the project when the
+	// ImportKeyPair is deleted. Keys have no tags so both behave the same.
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
 }
 
 // ImportKeyPairStatus defines the observed state of ImportKeyPair
 type ImportKeyPairStatus struct {
-	Status    string `json:"status"`
-	KeyPairID string `json:"keyPairID"`
+	Status     string             `json:"status"`
+	KeyPairID  string             `json:"keyPairID"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:name="KeyPairID",type="string",JSONPath=`.status.keyPairID`
 
 type ImportKeyPair struct {
@@ -46,6 +53,16 @@ type ImportKeyPair struct {
 	Status ImportKeyPairStatus `json:"status,omitempty"`
 }
 
+// GetConditions returns the status conditions
+func (in *ImportKeyPair) GetConditions() []metav1.Condition {
+	return in.Status.Conditions
+}
+
+// SetConditions replaces the status conditions
+func (in *ImportKeyPair) SetConditions(conditions []metav1.Condition) {
+	in.Status.Conditions = conditions
+}
+
 //+kubebuilder:object:root=true
 
 // ImportKeyPairList contains a list of ImportKeyPair
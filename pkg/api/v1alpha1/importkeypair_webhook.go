@@ -0,0 +1,73 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+//+kubebuilder:object:generate=false
+
+// ImportKeyPairWebhook validates ImportKeyPairs
+type ImportKeyPairWebhook struct{}
+
+var _ admission.CustomValidator = &ImportKeyPairWebhook{}
+
+func (w *ImportKeyPairWebhook) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&ImportKeyPair{}).
+		WithValidator(w).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-equinix-cattle-io-v1alpha1-importkeypair,mutating=false,failurePolicy=fail,sideEffects=None,groups=equinix.cattle.io,resources=importkeypairs,verbs=create;update,versions=v1alpha1,name=vimportkeypair.kb.io,admissionReviewVersions=v1
+
+func (w *ImportKeyPairWebhook) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	keyPair := obj.(*ImportKeyPair)
+	return invalid(keyPair.Name, "ImportKeyPair", validateImportKeyPairSpec(keyPair))
+}
+
+// ValidateUpdate checks changed specs, objects being deleted are let through
+func (w *ImportKeyPairWebhook) ValidateUpdate(ctx context.Context, oldObj runtime.Object, newObj runtime.Object) error {
+	keyPair := newObj.(*ImportKeyPair)
+	if !keyPair.DeletionTimestamp.IsZero() || equality.Semantic.DeepEqual(oldObj.(*ImportKeyPair).Spec, keyPair.Spec) {
+		return nil
+	}
+	return invalid(keyPair.Name, "ImportKeyPair", validateImportKeyPairSpec(keyPair))
+}
+
+func (w *ImportKeyPairWebhook) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+func validateImportKeyPairSpec(keyPair *ImportKeyPair) (errs field.ErrorList) {
+	spec := field.NewPath("spec")
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyPair.Spec.Key)); err != nil {
+		errs = append(errs, field.Invalid(spec.Child("key"), keyPair.Spec.Key, "must be a public key in authorized_keys format"))
+	}
+	if keyPair.Spec.Credential == "" && keyPair.Spec.Secret == "" {
+		errs = append(errs, field.Required(spec.Child("secret"), "either credential or secret is required"))
+	}
+	return errs
+}
@@ -0,0 +1,39 @@
+package v1alpha1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestImportKeyPairValidate(t *testing.T) {
+	w := &ImportKeyPairWebhook{}
+	keyPair := &ImportKeyPair{
+		ObjectMeta: metav1.ObjectMeta{Name: "key", Namespace: "default"},
+		Spec: ImportKeyPairSpec{
+			Key:    "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGJlh0EdRPzRcyfNJ1ndnrGlOnEUjPkhXGYoVZd6GkAS user@example.com",
+			Secret: "equinix-metal",
+		},
+	}
+	if err := w.ValidateCreate(context.Background(), keyPair); err != nil {
+		t.Errorf("expected valid key pair, got %v", err)
+	}
+
+	old := keyPair.DeepCopy()
+	keyPair.Spec.Key = "ssh-rsa not-a-key"
+	if err := w.ValidateCreate(context.Background(), keyPair); err == nil || !strings.Contains(err.Error(), "spec.key") {
+		t.Errorf("expected malformed key to be rejected, got %v", err)
+	}
+	if err := w.ValidateUpdate(context.Background(), old, keyPair); err == nil || !strings.Contains(err.Error(), "spec.key") {
+		t.Errorf("expected malformed key to be rejected on update, got %v", err)
+	}
+
+	// objects admitted before the webhook existed can still have their finalizer removed
+	old = keyPair.DeepCopy()
+	keyPair.Finalizers = nil
+	if err := w.ValidateUpdate(context.Background(), old, keyPair); err != nil {
+		t.Errorf("expected metadata only update to be allowed, got %v", err)
+	}
+}
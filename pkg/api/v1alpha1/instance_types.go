@@ -46,26 +46,178 @@ type InstanceSpec struct {
 	ProjectSSHKeys        []string            `json:"projectsshKeys,omitempty"`
 	Features              map[string]string   `json:"features,omitempty"`
 	NoSSHKeys             bool                `json:"nosshKeys,omitempty"`
-	Secret                string              `json:"credentialSecret"`
+	Secret                string              `json:"credentialSecret,omitempty"`
 	NetworkType           string              `json:"networkType,omitempty"`
 	VLANAttachments       map[string][]string `json:"vlanAttachments,omitempty"`
+	// Credential names a cluster scoped MetalCredential to use instead of credentialSecret
+	Credential string `json:"credential,omitempty"`
+	// DeviceFailurePolicy decides what happens when the device ends up failed
+	// or disappears while provisioning. Fail (default) marks the instance failed,
+	// Reprovision deletes the device and tries again, avoiding facilities which
+	// already failed when more than one is listed.
+	// +kubebuilder:validation:Enum=Fail;Reprovision
+	DeviceFailurePolicy string `json:"deviceFailurePolicy,omitempty"`
+	// MaxProvisioningAttempts caps the number of devices created for this
+	// instance when reprovisioning, defaults to 3
+	MaxProvisioningAttempts int `json:"maxProvisioningAttempts,omitempty"`
+	// ProvisioningTimeout is how long a device may stay queued or provisioning
+	// before it is removed and created again in the next fallback location.
+	// Without a timeout the operator waits for the device indefinitely.
+	ProvisioningTimeout *metav1.Duration `json:"provisioningTimeout,omitempty"`
+	// FallbackLocations is an ordered list of metros (da) or facilities (da11)
+	// to move to when provisioning times out or the current location has no
+	// capacity for the plan. The elastic ip is reserved again when the metro
+	// changes.
+	FallbackLocations []string `json:"fallbackLocations,omitempty"`
+	// ProvisioningGates lists condition types which must be True before the
+	// device is created. Other controllers set them, for example once the user
+	// data has been patched with the address from status.elasticIP.
+	ProvisioningGates []string `json:"provisioningGates,omitempty"`
+	// ProvisioningGateTimeout fails the instance when the gates are not all
+	// satisfied in time. Without a timeout the instance waits indefinitely.
+	ProvisioningGateTimeout *metav1.Duration `json:"provisioningGateTimeout,omitempty"`
+	// ElasticIP names an ElasticIP in the same namespace to attach instead of
+	// reserving an address for the instance. The reservation is kept when the
+	// instance is deleted so it can be attached to a replacement.
+	ElasticIP string `json:"elasticIP,omitempty"`
+	// DeletionPolicy decides if the device and elastic ip are removed with the
+	// instance. Retain keeps them tagged as released, Orphan leaves them untouched.
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// AdoptDeviceID brings an existing device of the project under management
+	// instead of creating one. The adoptDeviceID annotation does the same.
+	AdoptDeviceID string `json:"adoptDeviceID,omitempty"`
+	// SpotRecovery replaces a reclaimed spot device instead of failing the
+	// instance. The replacement keeps the elastic ip of the instance.
+	SpotRecovery SpotRecoveryPolicy `json:"spotRecovery,omitempty"`
+	// NativeVLAN maps interfaces to the vlan sent untagged on them. The vlan
+	// is given like the entries of vlanAttachments and assigned to the
+	// interface if it is not listed there.
+	NativeVLAN map[string]string `json:"nativeVLAN,omitempty"`
 }
 
 // InstanceStatus defines the observed state of Instance
 type InstanceStatus struct {
-	Status     string `json:"status"`
-	InstanceID string `json:"instanceID"`
-	PublicIP   string `json:"publicIP"`
-	PrivateIP  string `json:"privateIP"`
-	Facility   string `json:"facility"`
+	Status             string             `json:"status"`
+	InstanceID         string             `json:"instanceID"`
+	PublicIP           string             `json:"publicIP"`
+	PrivateIP          string             `json:"privateIP"`
+	Facility           string             `json:"facility"`
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	FailureReason      string             `json:"failureReason,omitempty"`
+	FailureMessage     string             `json:"failureMessage,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+	// ProvisioningAttempts lists the devices which failed to provision
+	ProvisioningAttempts []ProvisioningAttempt `json:"provisioningAttempts,omitempty"`
+	// Location is the fallback location currently in use, empty while the
+	// metro and facilities from the spec are used
+	Location string `json:"location,omitempty"`
+	// ProvisioningStartTime is when the current device was created
+	ProvisioningStartTime *metav1.Time `json:"provisioningStartTime,omitempty"`
+	// ElasticIP is the elastic ip reserved for the instance
+	ElasticIP *InstanceElasticIP `json:"elasticIP,omitempty"`
+	// SpotReclaims counts the spot devices of the instance reclaimed by Equinix Metal
+	SpotReclaims int `json:"spotReclaims,omitempty"`
+	// OnDemand is set once a reclaimed spot device was replaced by an on demand one
+	OnDemand bool `json:"onDemand,omitempty"`
+	// VirtualNetworks lists the VirtualNetworks named in vlanAttachments along
+	// with the vlan they resolved to
+	VirtualNetworks []InstanceVirtualNetwork `json:"virtualNetworks,omitempty"`
+	// Network is the network configuration read back from the device
+	Network *InstanceNetwork `json:"network,omitempty"`
 }
 
+// InstanceNetwork describes the network configuration of the device
+type InstanceNetwork struct {
+	// Type is the network type the ports of the device are in. Hybrid bonded
+	// devices have their ports in layer3.
+	Type  string         `json:"type,omitempty"`
+	Ports []InstancePort `json:"ports,omitempty"`
+}
+
+// InstancePort describes a network port of the device
+type InstancePort struct {
+	Name string `json:"name"`
+	// Bonded is true for ports which are part of their bond
+	Bonded bool `json:"bonded,omitempty"`
+	// Mode is layer3, layer2-bonded or layer2-individual
+	Mode string `json:"mode,omitempty"`
+	// VLANs lists the vxlan numbers of the vlans assigned to the port
+	VLANs []int `json:"vlans,omitempty"`
+	// NativeVLAN is the vxlan number of the vlan sent untagged on the port
+	NativeVLAN int `json:"nativeVLAN,omitempty"`
+	// PendingBatch is the id of the vlan assignment batch still being applied
+	// to the port, it is checked again by the next reconcile
+	PendingBatch string `json:"pendingBatch,omitempty"`
+}
+
+// InstanceVirtualNetwork is a VirtualNetwork attached to the instance
+type InstanceVirtualNetwork struct {
+	Name   string `json:"name"`
+	VLANID string `json:"vlanID"`
+	VXLAN  int    `json:"vxlan,omitempty"`
+}
+
+// InstanceElasticIP describes the elastic ip reservation of an instance
+type InstanceElasticIP struct {
+	ReservationID string `json:"reservationID"`
+	Address       string `json:"address"`
+	// CIDR is the prefix length of the block assigned to the device
+	CIDR int `json:"cidr,omitempty"`
+	// Name is the ElasticIP resource the reservation belongs to
+	Name string `json:"name,omitempty"`
+}
+
+// ProvisioningAttempt records a device which did not make it to active
+type ProvisioningAttempt struct {
+	DeviceID string      `json:"deviceID"`
+	Facility string      `json:"facility,omitempty"`
+	State    string      `json:"state"`
+	Time     metav1.Time `json:"time"`
+}
+
+const (
+	// InstanceFailed is the terminal phase of an instance which hit a non retryable error
+	InstanceFailed = "failed"
+	// InstanceWaitingForCapacity holds an instance until its plan can be provisioned
+	InstanceWaitingForCapacity = "waitingforcapacity"
+
+	DeviceFailurePolicyFail        = "Fail"
+	DeviceFailurePolicyReprovision = "Reprovision"
+	DefaultMaxProvisioningAttempts = 3
+	// ProvisioningAttemptReclaimed is the state recorded for reclaimed spot
+	// devices, they do not count towards MaxProvisioningAttempts
+	ProvisioningAttemptReclaimed = "reclaimed"
+
+	// ConditionElasticIPReady tracks reservation and attachment of the elastic ip
+	ConditionElasticIPReady = "ElasticIPReady"
+	// ConditionCapacityAvailable reports the result of the pre-flight capacity check
+	ConditionCapacityAvailable = "CapacityAvailable"
+	// ConditionDeviceCreated tracks the device creation request
+	ConditionDeviceCreated = "DeviceCreated"
+	// ConditionNetworkConfigured tracks network type conversion and vlan attachment
+	ConditionNetworkConfigured = "NetworkConfigured"
+	// ConditionReady is true once the device is active and fully configured
+	ConditionReady = "Ready"
+	// ConditionProvisioningGatesReady is true once every provisioning gate is satisfied
+	ConditionProvisioningGatesReady = "ProvisioningGatesReady"
+	// ConditionSpotReclaimed is true once Equinix Metal scheduled or carried out
+	// the termination of the spot device
+	ConditionSpotReclaimed = "SpotReclaimed"
+	// ConditionSpecDrift is true while the device does not match the spec,
+	// because an immutable field changed or the update was rejected
+	ConditionSpecDrift = "SpecDrift"
+	// ConditionCredentialsValid reports if the api accepted the credential secret
+	ConditionCredentialsValid = "CredentialsValid"
+)
+
 //+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:name="InstanceId",type="string",JSONPath=`.status.instanceID`
 //+kubebuilder:printcolumn:name="PublicIP",type="string",JSONPath=`.status.publicIP`
 //+kubebuilder:printcolumn:name="PrivateIP",type="string",JSONPath=`.status.privateIP`
 //+kubebuilder:printcolumn:name="Facility",type="string",JSONPath=`.status.facility`
 //+kubebuilder:printcolumn:name="Status",type="string",JSONPath=`.status.status`
+//+kubebuilder:printcolumn:name="Reason",type="string",JSONPath=`.status.failureReason`,priority=1
 
 type Instance struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -75,6 +227,16 @@ type Instance struct {
 	Status InstanceStatus `json:"status,omitempty"`
 }
 
+// GetConditions returns the status conditions
+func (in *Instance) GetConditions() []metav1.Condition {
+	return in.Status.Conditions
+}
+
+// SetConditions replaces the status conditions
+func (in *Instance) SetConditions(conditions []metav1.Condition) {
+	in.Status.Conditions = conditions
+}
+
 //+kubebuilder:object:root=true
 
 // InstanceList contains a list of Instance
@@ -0,0 +1,208 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// DefaultBillingCycle is used for instances which do not set one
+const DefaultBillingCycle = "hourly"
+
+// NetworkTypes lists the values accepted for spec.networkType
+var NetworkTypes = []string{"layer3", "hybrid", "hybrid-bonded", "layer2-individual", "layer2-bonded"}
+
+var instancelog = logf.Log.WithName("instance-resource")
+
+//+kubebuilder:object:generate=false
+
+// InstanceWebhook defaults and validates Instances. Defaulting the project
+// reads the credential of the instance, so it needs a client.
+type InstanceWebhook struct {
+	Client client.Client
+	// CredentialNamespace holds the secrets referenced by MetalCredentials
+	CredentialNamespace string
+}
+
+var _ admission.CustomDefaulter = &InstanceWebhook{}
+var _ admission.CustomValidator = &InstanceWebhook{}
+
+func (w *InstanceWebhook) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&Instance{}).
+		WithDefaulter(w).
+		WithValidator(w).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-equinix-cattle-io-v1alpha1-instance,mutating=true,failurePolicy=fail,sideEffects=None,groups=equinix.cattle.io,resources=instances,verbs=create;update,versions=v1alpha1,name=minstance.kb.io,admissionReviewVersions=v1
+
+// Default sets the billing cycle and the project of the credential. A
+// credential which can not be read yet leaves the project to the controller.
+func (w *InstanceWebhook) Default(ctx context.Context, obj runtime.Object) error {
+	instance := obj.(*Instance)
+	if instance.Spec.BillingCycle == "" {
+		instance.Spec.BillingCycle = DefaultBillingCycle
+	}
+
+	if instance.Spec.ProjectID == "" {
+		projectID, err := w.credentialProject(ctx, instance)
+		if err != nil {
+			instancelog.Info("unable to default project from credential", "name", instance.Name,
+				"namespace", instance.Namespace, "error", err.Error())
+		}
+		instance.Spec.ProjectID = projectID
+	}
+	return nil
+}
+
+// credentialProject returns the project the controller would use for the
+// instance, resolving the credential the same way
+func (w *InstanceWebhook) credentialProject(ctx context.Context, instance *Instance) (string, error) {
+	secret := types.NamespacedName{Name: instance.Spec.Secret, Namespace: instance.Namespace}
+	if instance.Spec.Credential != "" {
+		credential := &MetalCredential{}
+		if err := w.Client.Get(ctx, types.NamespacedName{Name: instance.Spec.Credential}, credential); err != nil {
+			return "", err
+		}
+		if credential.Spec.ProjectID != "" || !credential.AllowsNamespace(instance.Namespace) {
+			return credential.Spec.ProjectID, nil
+		}
+		secret = types.NamespacedName{Name: credential.Spec.Secret, Namespace: w.CredentialNamespace}
+	}
+	if secret.Name == "" {
+		return "", nil
+	}
+
+	credSecret := &corev1.Secret{}
+	if err := w.Client.Get(ctx, secret, credSecret); err != nil {
+		return "", err
+	}
+	return string(credSecret.Data["PROJECT_ID"]), nil
+}
+
+//+kubebuilder:webhook:path=/validate-equinix-cattle-io-v1alpha1-instance,mutating=false,failurePolicy=fail,sideEffects=None,groups=equinix.cattle.io,resources=instances,verbs=create;update,versions=v1alpha1,name=vinstance.kb.io,admissionReviewVersions=v1
+
+func (w *InstanceWebhook) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	instance := obj.(*Instance)
+	return invalid(instance.Name, "Instance", validateInstanceSpec(instance))
+}
+
+// ValidateUpdate checks changed specs. Plan, operating system and metro are
+// immutable once a device was created. Objects being deleted and updates
+// leaving the spec alone, like the finalizer changes of the controller, are
+// always let through.
+func (w *InstanceWebhook) ValidateUpdate(ctx context.Context, oldObj runtime.Object, newObj runtime.Object) error {
+	old := oldObj.(*Instance)
+	instance := newObj.(*Instance)
+	if !instance.DeletionTimestamp.IsZero() || equality.Semantic.DeepEqual(old.Spec, instance.Spec) {
+		return nil
+	}
+
+	errs := validateInstanceSpec(instance)
+	if old.Status.InstanceID != "" {
+		spec := field.NewPath("spec")
+		immutable := func(path *field.Path, old string, value string) {
+			if old != value {
+				errs = append(errs, field.Invalid(path, value, "can not be changed once the device is created"))
+			}
+		}
+		immutable(spec.Child("plan"), old.Spec.Plan, instance.Spec.Plan)
+		immutable(spec.Child("operatingSystem"), old.Spec.OperatingSystem, instance.Spec.OperatingSystem)
+		immutable(spec.Child("metro"), old.Spec.Metro, instance.Spec.Metro)
+	}
+	return invalid(instance.Name, "Instance", errs)
+}
+
+func (w *InstanceWebhook) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+func validateInstanceSpec(instance *Instance) (errs field.ErrorList) {
+	spec := field.NewPath("spec")
+	s := instance.Spec
+
+	adopted := s.AdoptDeviceID != "" || instance.Annotations["adoptDeviceID"] != ""
+	if s.Metro == "" && len(s.Facility) == 0 && !adopted {
+		errs = append(errs, field.Required(spec.Child("metro"), "either metro or facility is required"))
+	}
+	if s.Plan == "" && !adopted {
+		errs = append(errs, field.Required(spec.Child("plan"), ""))
+	}
+	if s.Credential == "" && s.Secret == "" {
+		errs = append(errs, field.Required(spec.Child("credentialSecret"), "either credential or credentialSecret is required"))
+	}
+
+	if s.NetworkType != "" && !contains(NetworkTypes, s.NetworkType) {
+		errs = append(errs, field.NotSupported(spec.Child("networkType"), s.NetworkType, NetworkTypes))
+	}
+	if len(s.VLANAttachments) > 0 && (s.NetworkType == "" || s.NetworkType == "layer3") {
+		errs = append(errs, field.Invalid(spec.Child("vlanAttachments"), s.VLANAttachments,
+			"requires a networkType other than layer3"))
+	}
+	if len(s.NativeVLAN) > 0 && (s.NetworkType == "" || s.NetworkType == "layer3") {
+		errs = append(errs, field.Invalid(spec.Child("nativeVLAN"), s.NativeVLAN,
+			"requires a networkType other than layer3"))
+	}
+
+	if !s.SpotInstance {
+		if !s.SpotPriceMax.IsZero() {
+			errs = append(errs, field.Invalid(spec.Child("spotPriceMax"), s.SpotPriceMax.String(), "requires spotInstance"))
+		}
+		if s.SpotRecovery != "" && s.SpotRecovery != SpotRecoveryNone {
+			errs = append(errs, field.Invalid(spec.Child("spotRecovery"), s.SpotRecovery, "requires spotInstance"))
+		}
+	}
+
+	if s.CustomData != "" {
+		customData := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(s.CustomData), &customData); err != nil {
+			errs = append(errs, field.Invalid(spec.Child("customData"), s.CustomData, fmt.Sprintf("must be a json object: %v", err)))
+		}
+	}
+	return errs
+}
+
+// invalid turns field errors into the error returned to the api server
+func invalid(name string, kind string, errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind(kind).GroupKind(), name, errs)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package v1alpha1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newWebhookInstance() *Instance {
+	return &Instance{
+		ObjectMeta: metav1.ObjectMeta{Name: "instance-sample", Namespace: "default"},
+		Spec: InstanceSpec{
+			Plan:            "c3.small.x86",
+			Metro:           "sg",
+			OperatingSystem: "ubuntu_20_04",
+			Secret:          "equinix-metal",
+		},
+	}
+}
+
+func newInstanceWebhook(t *testing.T, objs ...runtime.Object) *InstanceWebhook {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return &InstanceWebhook{
+		Client:              fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objs...).Build(),
+		CredentialNamespace: "metal-operator",
+	}
+}
+
+func TestInstanceDefault(t *testing.T) {
+	w := newInstanceWebhook(t,
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "equinix-metal", Namespace: "default"},
+			Data:       map[string][]byte{"PROJECT_ID": []byte("project-secret")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: "metal-operator"},
+			Data:       map[string][]byte{"PROJECT_ID": []byte("project-shared")},
+		},
+		&MetalCredential{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared"},
+			Spec:       MetalCredentialSpec{Secret: "shared", AllowedNamespaces: []string{"*"}},
+		},
+		&MetalCredential{
+			ObjectMeta: metav1.ObjectMeta{Name: "labs"},
+			Spec:       MetalCredentialSpec{Secret: "shared", ProjectID: "project-labs", AllowedNamespaces: []string{"*"}},
+		},
+	)
+
+	for credential, projectID := range map[string]string{"": "project-secret", "shared": "project-shared", "labs": "project-labs"} {
+		instance := newWebhookInstance()
+		instance.Spec.Credential = credential
+		if err := w.Default(context.Background(), instance); err != nil {
+			t.Fatalf("error defaulting instance: %v", err)
+		}
+		if instance.Spec.BillingCycle != DefaultBillingCycle {
+			t.Errorf("expected billing cycle %s, got %s", DefaultBillingCycle, instance.Spec.BillingCycle)
+		}
+		if instance.Spec.ProjectID != projectID {
+			t.Errorf("credential %q: expected project %s, got %s", credential, projectID, instance.Spec.ProjectID)
+		}
+	}
+
+	// a missing secret leaves the project to the controller
+	instance := newWebhookInstance()
+	instance.Spec.Secret = "missing"
+	instance.Spec.BillingCycle = "monthly"
+	if err := w.Default(context.Background(), instance); err != nil {
+		t.Fatalf("error defaulting instance: %v", err)
+	}
+	if instance.Spec.ProjectID != "" || instance.Spec.BillingCycle != "monthly" {
+		t.Errorf("expected project to stay empty and billing cycle to be kept, got %s %s",
+			instance.Spec.ProjectID, instance.Spec.BillingCycle)
+	}
+}
+
+func TestInstanceValidateCreate(t *testing.T) {
+	w := newInstanceWebhook(t)
+	if err := w.ValidateCreate(context.Background(), newWebhookInstance()); err != nil {
+		t.Errorf("expected valid instance, got %v", err)
+	}
+
+	for name, test := range map[string]struct {
+		mutate func(*Instance)
+		field  string
+	}{
+		"no location":          {func(i *Instance) { i.Spec.Metro = "" }, "spec.metro"},
+		"no credentials":       {func(i *Instance) { i.Spec.Secret = "" }, "spec.credentialSecret"},
+		"unknown network type": {func(i *Instance) { i.Spec.NetworkType = "layer4" }, "spec.networkType"},
+		"vlans without network type": {func(i *Instance) {
+			i.Spec.VLANAttachments = map[string][]string{"bond0": {"1000"}}
+		}, "spec.vlanAttachments"},
+		"native vlan on layer3": {func(i *Instance) {
+			i.Spec.NetworkType = "layer3"
+			i.Spec.NativeVLAN = map[string]string{"eth1": "1000"}
+		}, "spec.nativeVLAN"},
+		"spot price without spot instance": {func(i *Instance) {
+			i.Spec.SpotPriceMax = resource.MustParse("0.5")
+		}, "spec.spotPriceMax"},
+		"invalid custom data": {func(i *Instance) { i.Spec.CustomData = "{" }, "spec.customData"},
+	} {
+		instance := newWebhookInstance()
+		test.mutate(instance)
+		err := w.ValidateCreate(context.Background(), instance)
+		if err == nil || !strings.Contains(err.Error(), test.field) {
+			t.Errorf("%s: expected error on %s, got %v", name, test.field, err)
+		}
+	}
+}
+
+func TestInstanceValidateUpdate(t *testing.T) {
+	w := newInstanceWebhook(t)
+	old := newWebhookInstance()
+
+	instance := old.DeepCopy()
+	instance.Spec.Plan = "m3.large.x86"
+	if err := w.ValidateUpdate(context.Background(), old, instance); err != nil {
+		t.Errorf("expected plan change to be allowed before the device is created, got %v", err)
+	}
+
+	old.Status.InstanceID = "device-1"
+	for _, field := range []string{"plan", "operatingSystem", "metro"} {
+		instance := old.DeepCopy()
+		switch field {
+		case "plan":
+			instance.Spec.Plan = "m3.large.x86"
+		case "operatingSystem":
+			instance.Spec.OperatingSystem = "ubuntu_22_04"
+		case "metro":
+			instance.Spec.Metro = "da"
+		}
+		err := w.ValidateUpdate(context.Background(), old, instance)
+		if err == nil || !strings.Contains(err.Error(), "spec."+field) {
+			t.Errorf("expected %s to be immutable, got %v", field, err)
+		}
+	}
+
+	instance = old.DeepCopy()
+	instance.Spec.Tags = []string{"lab"}
+	if err := w.ValidateUpdate(context.Background(), old, instance); err != nil {
+		t.Errorf("expected tag change to be allowed, got %v", err)
+	}
+
+	// specs admitted before the webhook existed do not block the controller
+	old.Spec.Metro = ""
+	instance = old.DeepCopy()
+	instance.Finalizers = []string{"instance.cattle.io"}
+	if err := w.ValidateUpdate(context.Background(), old, instance); err != nil {
+		t.Errorf("expected metadata only update to be allowed, got %v", err)
+	}
+}
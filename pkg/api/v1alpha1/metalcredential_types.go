@@ -0,0 +1,71 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MetalCredentialSpec defines the credentials shared by objects in several namespaces
+type MetalCredentialSpec struct {
+	// Secret names a secret in the operator namespace holding PACKET_AUTH_TOKEN
+	// and optionally PROJECT_ID and PACKET_API_URL
+	Secret string `json:"secret"`
+	// ProjectID is the project used by objects which do not set their own,
+	// it takes precedence over PROJECT_ID in the secret
+	ProjectID string `json:"projectID,omitempty"`
+	// AllowedNamespaces lists the namespaces which may use this credential,
+	// "*" allows every namespace
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Secret",type="string",JSONPath=`.spec.secret`
+//+kubebuilder:printcolumn:name="ProjectID",type="string",JSONPath=`.spec.projectID`
+
+// MetalCredential lets objects in the allowed namespaces use a secret from the
+// operator namespace without copying it around
+type MetalCredential struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MetalCredentialSpec `json:"spec,omitempty"`
+}
+
+// AllowsNamespace reports if objects in namespace may use the credential
+func (c *MetalCredential) AllowsNamespace(namespace string) bool {
+	for _, allowed := range c.Spec.AllowedNamespaces {
+		if allowed == "*" || allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+//+kubebuilder:object:root=true
+
+// MetalCredentialList contains a list of MetalCredential
+type MetalCredentialList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MetalCredential `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MetalCredential{}, &MetalCredentialList{})
+}
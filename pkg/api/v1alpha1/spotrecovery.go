@@ -0,0 +1,31 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// SpotRecoveryPolicy decides what happens when Equinix Metal reclaims the
+// spot device of an instance
+// +kubebuilder:validation:Enum=None;Spot;OnDemand
+type SpotRecoveryPolicy string
+
+const (
+	// SpotRecoveryNone marks the instance failed once the device is gone, this is the default
+	SpotRecoveryNone SpotRecoveryPolicy = "None"
+	// SpotRecoverySpot replaces the device with another spot device
+	SpotRecoverySpot SpotRecoveryPolicy = "Spot"
+	// SpotRecoveryOnDemand replaces the device with an on demand device
+	SpotRecoveryOnDemand SpotRecoveryPolicy = "OnDemand"
+)
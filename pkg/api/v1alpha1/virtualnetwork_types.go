@@ -0,0 +1,101 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// VirtualNetworkCreated is the phase of a VirtualNetwork once the vlan exists
+	VirtualNetworkCreated = "created"
+	// VirtualNetworkFailed is the phase of a VirtualNetwork which can not be created as specified
+	VirtualNetworkFailed = "failed"
+)
+
+// VirtualNetworkSpec defines the desired state of VirtualNetwork
+type VirtualNetworkSpec struct {
+	// Metro the vlan is created in, devices can only attach vlans of their metro
+	Metro string `json:"metro"`
+	// Description of the vlan, defaults to <namespace>/<name>. Together with
+	// the metro and vxlan it identifies a vlan created by an earlier attempt.
+	Description string `json:"description,omitempty"`
+	// VXLAN is the vlan number to use, one is assigned when empty
+	// +kubebuilder:validation:Minimum=2
+	// +kubebuilder:validation:Maximum=3999
+	VXLAN int `json:"vxlan,omitempty"`
+	// DeletionPolicy Retain or Orphan keeps the vlan in the project when the
+	// VirtualNetwork is deleted. Vlans have no tags so both behave the same.
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	ProjectID      string         `json:"projectID,omitempty"`
+	Secret         string         `json:"credentialSecret,omitempty"`
+	// Credential names a cluster scoped MetalCredential to use instead of credentialSecret
+	Credential string `json:"credential,omitempty"`
+}
+
+// VirtualNetworkStatus defines the observed state of VirtualNetwork
+type VirtualNetworkStatus struct {
+	Status string `json:"status,omitempty"`
+	// VLANID is the uuid of the vlan, used to attach it to device ports
+	VLANID         string             `json:"vlanID,omitempty"`
+	VXLAN          int                `json:"vxlan,omitempty"`
+	Metro          string             `json:"metro,omitempty"`
+	FailureReason  string             `json:"failureReason,omitempty"`
+	FailureMessage string             `json:"failureMessage,omitempty"`
+	Conditions     []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=vnet
+//+kubebuilder:printcolumn:name="Metro",type="string",JSONPath=`.status.metro`
+//+kubebuilder:printcolumn:name="VXLAN",type="integer",JSONPath=`.status.vxlan`
+//+kubebuilder:printcolumn:name="VLANID",type="string",JSONPath=`.status.vlanID`
+//+kubebuilder:printcolumn:name="Status",type="string",JSONPath=`.status.status`
+
+// VirtualNetwork is an Equinix Metal project vlan which instances in the same
+// namespace attach by name through their vlanAttachments
+type VirtualNetwork struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VirtualNetworkSpec   `json:"spec,omitempty"`
+	Status VirtualNetworkStatus `json:"status,omitempty"`
+}
+
+// GetConditions returns the status conditions
+func (in *VirtualNetwork) GetConditions() []metav1.Condition {
+	return in.Status.Conditions
+}
+
+// SetConditions replaces the status conditions
+func (in *VirtualNetwork) SetConditions(conditions []metav1.Condition) {
+	in.Status.Conditions = conditions
+}
+
+//+kubebuilder:object:root=true
+
+// VirtualNetworkList contains a list of VirtualNetwork
+type VirtualNetworkList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VirtualNetwork `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VirtualNetwork{}, &VirtualNetworkList{})
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
+)
+
+const (
+	// credentialSecretIndex indexes objects by the name of their credential secret
+	// so a change to the secret can requeue everything using it
+	credentialSecretIndex = "credentialSecret"
+	// credentialIndex indexes objects by the name of their MetalCredential
+	credentialIndex = "credential"
+)
+
+// newClient resolves the credentials of an object in namespace and builds a client using them
+func newClient(ctx context.Context, c client.Client, factory metal.ClientFactory, namespace string, credential string, secret string,
+	credentialNamespace string) (metal.Provider, error) {
+	creds, err := metal.ResolveCredentials(ctx, c, namespace, credential, secret, credentialNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return factory(ctx, c, creds)
+}
+
+// indexCredentials indexes obj by the names of its credential secret and MetalCredential
+func indexCredentials(mgr ctrl.Manager, obj client.Object, refs func(obj client.Object) (credential string, secret string)) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), obj, credentialSecretIndex, func(obj client.Object) []string {
+		_, secret := refs(obj)
+		return []string{secret}
+	})
+	if err != nil {
+		return err
+	}
+	return mgr.GetFieldIndexer().IndexField(context.Background(), obj, credentialIndex, func(obj client.Object) []string {
+		credential, _ := refs(obj)
+		return []string{credential}
+	})
+}
+
+// requestsForSecret returns the objects using a secret, either directly or
+// through a MetalCredential pointing at it
+func requestsForSecret(c client.Client, log logr.Logger, credentialNamespace string, newList func() client.ObjectList,
+	secret client.Object) []reconcile.Request {
+	requests := listRequests(c, log, newList(), client.InNamespace(secret.GetNamespace()),
+		client.MatchingFields{credentialSecretIndex: secret.GetName()})
+	if secret.GetNamespace() != credentialNamespace {
+		return requests
+	}
+
+	credentials := &equinixv1alpha1.MetalCredentialList{}
+	if err := c.List(context.Background(), credentials); err != nil {
+		log.Error(err, "unable to list metal credentials")
+		return requests
+	}
+	for _, credential := range credentials.Items {
+		if credential.Spec.Secret == secret.GetName() {
+			requests = append(requests, listRequests(c, log, newList(), client.MatchingFields{credentialIndex: credential.Name})...)
+		}
+	}
+	return requests
+}
+
+// requestsForCredential returns the objects using a MetalCredential
+func requestsForCredential(c client.Client, log logr.Logger, newList func() client.ObjectList, credential client.Object) []reconcile.Request {
+	return listRequests(c, log, newList(), client.MatchingFields{credentialIndex: credential.GetName()})
+}
+
+func listRequests(c client.Client, log logr.Logger, list client.ObjectList, opts ...client.ListOption) []reconcile.Request {
+	if err := c.List(context.Background(), list, opts...); err != nil {
+		log.Error(err, "unable to list objects using changed credentials")
+		return nil
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		log.Error(err, "unable to list objects using changed credentials")
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(items))
+	for _, item := range items {
+		if obj, ok := item.(client.Object); ok {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(obj)})
+		}
+	}
+	return requests
+}
+
+// setCredentialsCondition records if the api accepted the credential secret.
+// Errors which say nothing about the credentials, like a missing secret or an
+// unreachable api, leave the condition alone. Returns true if the conditions changed.
+func setCredentialsCondition(conditions *[]metav1.Condition, generation int64, err error) bool {
+	condition := metav1.Condition{
+		Type:               equinixv1alpha1.ConditionCredentialsValid,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "Validated",
+		Message:            "credentials accepted by equinix metal api",
+	}
+	switch {
+	case err == nil:
+	case metal.IsInvalidCredentials(err):
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = metal.ErrorReason(err)
+		condition.Message = err.Error()
+	default:
+		return false
+	}
+
+	existing := meta.FindStatusCondition(*conditions, condition.Type)
+	if existing != nil && existing.Status == condition.Status && existing.Reason == condition.Reason &&
+		existing.Message == condition.Message && existing.ObservedGeneration == condition.ObservedGeneration {
+		return false
+	}
+	meta.SetStatusCondition(conditions, condition)
+	return true
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ElasticIPReconciler reconciles a ElasticIP object
+type ElasticIPReconciler struct {
+	client.Client
+	Scheme    *runtime.Scheme
+	Threads   int
+	Log       logr.Logger
+	NewClient metal.ClientFactory
+	// CredentialNamespace holds the secrets referenced by MetalCredentials
+	CredentialNamespace string
+}
+
+//+kubebuilder:rbac:groups=equinix.cattle.io,resources=elasticips,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=equinix.cattle.io,resources=elasticips/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=equinix.cattle.io,resources=elasticips/finalizers,verbs=update
+
+func (r *ElasticIPReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("elasticip", req.NamespacedName)
+
+	eip := &equinixv1alpha1.ElasticIP{}
+	if err := r.Get(ctx, req.NamespacedName, eip); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "unable to fetch elastic ip")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	original := eip.DeepCopy()
+
+	if !eip.ObjectMeta.DeletionTimestamp.IsZero() && eip.Spec.DeletionPolicy == equinixv1alpha1.DeletionPolicyOrphan {
+		// orphaned objects are let go without calling the api, so missing or
+		// rejected credentials do not block the deletion
+		log.Info("orphaning elastic ip, leaving equinix metal resources in place")
+		controllerutil.RemoveFinalizer(eip, instanceFinalizer)
+		return ctrl.Result{}, patchObject(ctx, r.Client, original, eip)
+	}
+
+	// mClient contains the new metal client
+	mClient, err := newClient(ctx, r.Client, r.NewClient, eip.Namespace, eip.Spec.Credential, eip.Spec.Secret, r.CredentialNamespace)
+	if setCredentialsCondition(&eip.Status.Conditions, eip.Generation, err) {
+		if updateErr := patchObject(ctx, r.Client, original, eip); updateErr != nil {
+			return ctrl.Result{}, updateErr
+		}
+		original = eip.DeepCopy()
+	}
+	if err != nil {
+		if metal.IsInvalidCredentials(err) {
+			// nothing can be done until the secret is fixed, which requeues the elastic ip
+			log.Error(err, "credential secret rejected by equinix metal api", "secret", eip.Spec.Secret)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	if eip.ObjectMeta.DeletionTimestamp.IsZero() && !controllerutil.ContainsFinalizer(eip, instanceFinalizer) {
+		// the finalizer is in place before the reservation is made, the update
+		// triggers the next reconcile
+		controllerutil.AddFinalizer(eip, instanceFinalizer)
+		return ctrl.Result{}, patchObject(ctx, r.Client, original, eip)
+	}
+
+	if eip.ObjectMeta.DeletionTimestamp.IsZero() {
+		newStatus := &equinixv1alpha1.ElasticIPStatus{}
+		switch eip.Status.Status {
+		case "":
+			log.Info("reserving elastic ip")
+			newStatus, err = mClient.CreateElasticIP(eip)
+		case equinixv1alpha1.ElasticIPReserved:
+			return ctrl.Result{}, nil
+		case equinixv1alpha1.ElasticIPFailed:
+			log.Info("elastic ip reservation failed", "reason", eip.Status.FailureReason, "message", eip.Status.FailureMessage)
+			return ctrl.Result{}, nil
+		}
+
+		if err != nil {
+			if newStatus != nil {
+				eip.Status = *newStatus
+				if updateErr := patchObject(ctx, r.Client, original, eip); updateErr != nil {
+					log.Error(updateErr, "unable to record elastic ip conditions")
+				}
+			}
+			return handleMetalError(log, err)
+		}
+
+		eip.Status = *newStatus
+	} else {
+		// release the reservation unless it is retained, devices still using
+		// it have to be removed first
+		log.Info("cleaning up elastic ip")
+		err = mClient.DeleteElasticIP(eip)
+		if err != nil {
+			return handleMetalError(log, err)
+		}
+		controllerutil.RemoveFinalizer(eip, instanceFinalizer)
+	}
+
+	return ctrl.Result{}, patchObject(ctx, r.Client, original, eip)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ElasticIPReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.NewClient == nil {
+		r.NewClient = metal.NewProvider
+	}
+	err := indexCredentials(mgr, &equinixv1alpha1.ElasticIP{}, func(obj client.Object) (string, string) {
+		eip := obj.(*equinixv1alpha1.ElasticIP)
+		return eip.Spec.Credential, eip.Spec.Secret
+	})
+	if err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: r.Threads,
+		}).
+		For(&equinixv1alpha1.ElasticIP{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.elasticIPsForSecret)).
+		Watches(&source.Kind{Type: &equinixv1alpha1.MetalCredential{}}, handler.EnqueueRequestsFromMapFunc(r.elasticIPsForCredential)).
+		Complete(r)
+}
+
+// elasticIPsForSecret requeues the elastic ips using a credential secret when it changes
+func (r *ElasticIPReconciler) elasticIPsForSecret(secret client.Object) []reconcile.Request {
+	return requestsForSecret(r.Client, r.Log, r.CredentialNamespace, func() client.ObjectList {
+		return &equinixv1alpha1.ElasticIPList{}
+	}, secret)
+}
+
+// elasticIPsForCredential requeues the elastic ips using a MetalCredential when it changes
+func (r *ElasticIPReconciler) elasticIPsForCredential(credential client.Object) []reconcile.Request {
+	return requestsForCredential(r.Client, r.Log, func() client.ObjectList {
+		return &equinixv1alpha1.ElasticIPList{}
+	}, credential)
+}
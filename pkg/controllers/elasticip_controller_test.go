@@ -0,0 +1,103 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+)
+
+var _ = Describe("ElasticIP controller", func() {
+	It("reserves an elastic ip which outlives the instance using it", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-elasticip",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+				ElasticIP:       "lab-url",
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		instanceKey := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetchedInstance := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, instanceKey, fetchedInstance); err != nil {
+				return ""
+			}
+			for _, condition := range fetchedInstance.Status.Conditions {
+				if condition.Type == equinixv1alpha1.ConditionElasticIPReady {
+					return condition.Reason
+				}
+			}
+			return ""
+		}, timeout, interval).Should(Equal("ElasticIPNotFound"))
+
+		eip := &equinixv1alpha1.ElasticIP{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "lab-url",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.ElasticIPSpec{
+				Type:   equinixv1alpha1.ElasticIPPublicIPv4,
+				Metro:  "sg",
+				Secret: "equinix-metal",
+			},
+		}
+		Expect(k8sClient.Create(ctx, eip)).Should(Succeed())
+
+		eipKey := types.NamespacedName{Name: eip.Name, Namespace: eip.Namespace}
+		fetchedEIP := &equinixv1alpha1.ElasticIP{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, eipKey, fetchedEIP); err != nil {
+				return ""
+			}
+			return fetchedEIP.Status.Status
+		}, timeout, interval).Should(Equal(equinixv1alpha1.ElasticIPReserved))
+
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, instanceKey, fetchedInstance); err != nil {
+				return ""
+			}
+			return fetchedInstance.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+		Expect(fetchedInstance.Status.PublicIP).Should(Equal(fetchedEIP.Status.Address))
+		Expect(fetchedInstance.Status.ElasticIP.Name).Should(Equal(eip.Name))
+
+		Expect(k8sClient.Delete(ctx, fetchedInstance)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, instanceKey, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeProvider.ElasticIPExists(fetchedEIP.Status.ReservationID)).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, fetchedEIP)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, eipKey, &equinixv1alpha1.ElasticIP{}) != nil
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeProvider.ElasticIPExists(fetchedEIP.Status.ReservationID)).Should(BeFalse())
+	})
+})
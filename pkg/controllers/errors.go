@@ -0,0 +1,53 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/go-logr/logr"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// handleMetalError decides how a failed Equinix Metal call is retried.
+// Terminal errors are logged and dropped since retrying the same request would
+// fail the same way, the object is reconciled again once it changes.
+// Rate limited calls are retried once the Retry-After returned by the api
+// has passed, vlan assignment batches still running are checked again after
+// a poll interval. Everything else is handed back to the controller's rate limited
+// queue.
+func handleMetalError(log logr.Logger, err error) (ctrl.Result, error) {
+	if metal.IsVLANBatchPending(err) {
+		log.Info("waiting for vlan assignment batch", "message", err.Error())
+		return ctrl.Result{RequeueAfter: metal.VLANBatchPollInterval}, nil
+	}
+
+	if metal.IsTerminal(err) {
+		log.Error(err, "non retryable error from equinix metal api", "status", metal.StatusCode(err))
+		return ctrl.Result{}, nil
+	}
+
+	if metal.IsRateLimited(err) {
+		retryAfter := metal.RetryAfter(err)
+		log.Info("equinix metal api rate limit hit, backing off", "retryAfter", retryAfter)
+		return ctrl.Result{RequeueAfter: retryAfter}, nil
+	}
+
+	if metal.IsCapacityUnavailable(err) {
+		log.Info("equinix metal api asked us to back off", "error", err.Error())
+	}
+	return ctrl.Result{}, err
+}
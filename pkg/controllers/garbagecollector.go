@@ -0,0 +1,274 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
+)
+
+var (
+	orphanedResources = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metal_operator_orphaned_resources",
+		Help: "Equinix Metal resources tagged by the operator which no object references",
+	}, []string{"kind"})
+	orphansDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metal_operator_orphaned_resources_deleted_total",
+		Help: "Orphaned Equinix Metal resources removed by the garbage collector",
+	}, []string{"kind"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(orphanedResources, orphansDeleted)
+}
+
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// GarbageCollector periodically looks for devices, ip reservations and ssh
+// keys carrying an owner tag whose object no longer exists or no longer
+// references them, as happens when the operator stops between creating a
+// resource and recording it, or when objects are removed without their
+// finalizer running. Orphans are reported as metrics and as events on the
+// credential secret, and removed once DeleteOrphans is set and they have been
+// orphaned for longer than GracePeriod.
+type GarbageCollector struct {
+	// Client reads credentials and builds metal clients
+	Client client.Client
+	// Reader lists objects straight from the api server, so objects removed
+	// along with their CRD are not mistaken for a stale cache
+	Reader    client.Reader
+	Log       logr.Logger
+	Recorder  record.EventRecorder
+	NewClient metal.ClientFactory
+	// CredentialNamespace holds the secrets referenced by MetalCredentials
+	CredentialNamespace string
+
+	Interval      time.Duration
+	GracePeriod   time.Duration
+	DeleteOrphans bool
+
+	// projects are the projects used with each set of credentials by the
+	// objects and MetalCredentials found in the current sweep
+	projects map[metal.Credentials]map[string]bool
+	// orphanedSince is when each orphan was first seen
+	orphanedSince map[string]time.Time
+}
+
+var _ manager.Runnable = &GarbageCollector{}
+var _ manager.LeaderElectionRunnable = &GarbageCollector{}
+
+// Start sweeps every Interval until ctx is done
+func (g *GarbageCollector) Start(ctx context.Context) error {
+	ticker := time.NewTicker(g.Interval)
+	defer ticker.Stop()
+	for {
+		if err := g.Sweep(ctx); err != nil {
+			g.Log.Error(err, "orphaned resource sweep failed")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection keeps replicas from removing the same orphans
+func (g *GarbageCollector) NeedLeaderElection() bool {
+	return true
+}
+
+// Sweep lists the resources owned by the operator in every known project and
+// handles the ones no object references
+func (g *GarbageCollector) Sweep(ctx context.Context) error {
+	if g.orphanedSince == nil {
+		g.orphanedSince = make(map[string]time.Time)
+	}
+	// projects and credentials no longer used by any object are dropped
+	g.projects = make(map[metal.Credentials]map[string]bool)
+
+	references, err := g.liveReferences(ctx)
+	if err != nil {
+		// without every object there is no telling orphans apart
+		return err
+	}
+
+	now := time.Now()
+	swept := make(map[string]bool)
+	orphans := make(map[string]time.Time)
+	counts := map[string]float64{metal.ResourceDevice: 0, metal.ResourceIPReservation: 0, metal.ResourceSSHKey: 0}
+	for creds, projectIDs := range g.projects {
+		log := g.Log.WithValues("secret", creds.Namespace+"/"+creds.Secret)
+		provider, err := g.NewClient(ctx, g.Client, creds)
+		if err != nil {
+			log.Error(err, "unable to build client for orphaned resource sweep")
+			continue
+		}
+
+		for projectID := range projectIDs {
+			resources, err := provider.OwnedResources(projectID)
+			if err != nil {
+				log.Error(err, "unable to list owned resources", "project", projectID)
+				continue
+			}
+			for _, resource := range resources {
+				key := resource.Kind + "/" + resource.ID
+				// the same project can be reached through several secrets
+				if swept[key] || references[resource.Owner][resource.ID] {
+					swept[key] = true
+					continue
+				}
+				swept[key] = true
+				counts[resource.Kind]++
+
+				since, ok := g.orphanedSince[key]
+				if !ok {
+					since = now
+					g.event(creds, corev1.EventTypeWarning, "OrphanedResource", "%s %s (%s) created for %s is not referenced by any object",
+						resource.Kind, resource.ID, resource.Description, resource.Owner)
+					log.Info("found orphaned resource", "kind", resource.Kind, "id", resource.ID, "owner", resource.Owner.String())
+				}
+				orphans[key] = since
+
+				if !g.DeleteOrphans || now.Sub(since) < g.GracePeriod {
+					continue
+				}
+				if err := provider.DeleteOwnedResource(resource); err != nil {
+					g.event(creds, corev1.EventTypeWarning, "OrphanDeleteFailed", "unable to remove orphaned %s %s (%s): %v",
+						resource.Kind, resource.ID, resource.Description, err)
+					continue
+				}
+				orphansDeleted.WithLabelValues(resource.Kind).Inc()
+				g.event(creds, corev1.EventTypeNormal, "OrphanDeleted", "removed orphaned %s %s (%s) created for %s",
+					resource.Kind, resource.ID, resource.Description, resource.Owner)
+				log.Info("removed orphaned resource", "kind", resource.Kind, "id", resource.ID, "owner", resource.Owner.String())
+			}
+		}
+	}
+
+	// resources no longer orphaned, or gone, start over if they show up again
+	g.orphanedSince = orphans
+	for kind, count := range counts {
+		orphanedResources.WithLabelValues(kind).Set(count)
+	}
+	return nil
+}
+
+// liveReferences returns the resource ids each object references and adds the
+// projects of their credentials to the ones swept
+func (g *GarbageCollector) liveReferences(ctx context.Context) (map[metal.Owner]map[string]bool, error) {
+	references := make(map[metal.Owner]map[string]bool)
+	reference := func(kind string, obj metav1.Object, ids ...string) {
+		owner := metal.Owner{Kind: kind, Namespace: obj.GetNamespace(), Name: obj.GetName()}
+		if references[owner] == nil {
+			references[owner] = make(map[string]bool)
+		}
+		for _, id := range ids {
+			if id != "" {
+				references[owner][id] = true
+			}
+		}
+	}
+
+	credentials := &equinixv1alpha1.MetalCredentialList{}
+	if err := g.list(ctx, credentials); err != nil {
+		return nil, err
+	}
+	for _, credential := range credentials.Items {
+		g.addProject(metal.Credentials{Secret: credential.Spec.Secret, Namespace: g.CredentialNamespace,
+			ProjectID: credential.Spec.ProjectID}, "")
+	}
+
+	instances := &equinixv1alpha1.InstanceList{}
+	if err := g.list(ctx, instances); err != nil {
+		return nil, err
+	}
+	for i := range instances.Items {
+		instance := &instances.Items[i]
+		reference("instance", instance, instance.Status.InstanceID, instance.Annotations[metal.ReservationAnnotation])
+		g.addObjectProject(ctx, instance.Namespace, instance.Spec.Credential, instance.Spec.Secret, instance.Spec.ProjectID)
+	}
+
+	elasticIPs := &equinixv1alpha1.ElasticIPList{}
+	if err := g.list(ctx, elasticIPs); err != nil {
+		return nil, err
+	}
+	for i := range elasticIPs.Items {
+		eip := &elasticIPs.Items[i]
+		reference("elasticip", eip, eip.Status.ReservationID)
+		g.addObjectProject(ctx, eip.Namespace, eip.Spec.Credential, eip.Spec.Secret, eip.Spec.ProjectID)
+	}
+
+	keyPairs := &equinixv1alpha1.ImportKeyPairList{}
+	if err := g.list(ctx, keyPairs); err != nil {
+		return nil, err
+	}
+	for i := range keyPairs.Items {
+		keyPair := &keyPairs.Items[i]
+		reference("importkeypair", keyPair, keyPair.Status.KeyPairID)
+		g.addObjectProject(ctx, keyPair.Namespace, keyPair.Spec.Credential, keyPair.Spec.Secret, "")
+	}
+	return references, nil
+}
+
+// list treats a removed CRD as no objects of that kind
+func (g *GarbageCollector) list(ctx context.Context, list client.ObjectList) error {
+	err := g.Reader.List(ctx, list)
+	if meta.IsNoMatchError(err) || apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (g *GarbageCollector) addObjectProject(ctx context.Context, namespace string, credential string, secret string, projectID string) {
+	creds, err := metal.ResolveCredentials(ctx, g.Client, namespace, credential, secret, g.CredentialNamespace)
+	if err != nil {
+		return
+	}
+	g.addProject(creds, "")
+	g.addProject(creds, projectID)
+}
+
+func (g *GarbageCollector) addProject(creds metal.Credentials, projectID string) {
+	if g.projects[creds] == nil {
+		g.projects[creds] = make(map[string]bool)
+	}
+	g.projects[creds][projectID] = true
+}
+
+// event reports on the credential secret, the orphan owner may be long gone
+func (g *GarbageCollector) event(creds metal.Credentials, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if g.Recorder == nil {
+		return
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: creds.Secret, Namespace: creds.Namespace}}
+	g.Recorder.Eventf(secret, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
+)
+
+var _ = Describe("Garbage collector", func() {
+	It("removes resources no object references once deletion is enabled", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-gc",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		instanceKey := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetchedInstance := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, instanceKey, fetchedInstance); err != nil {
+				return ""
+			}
+			return fetchedInstance.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+
+		// a device created before the operator stopped and one whose instance is gone
+		fakeProvider.AddOwnedResource(metal.OwnedResource{Kind: metal.ResourceDevice, ID: "device-leaked",
+			Owner: metal.Owner{Kind: "instance", Namespace: "default", Name: "instance-gc"}})
+		fakeProvider.AddOwnedResource(metal.OwnedResource{Kind: metal.ResourceDevice, ID: "device-gone",
+			Owner: metal.Owner{Kind: "instance", Namespace: "default", Name: "instance-gone"}})
+
+		gc := &GarbageCollector{
+			Client:    k8sClient,
+			Reader:    k8sClient,
+			Log:       ctrl.Log.WithName("controllers").WithName("GarbageCollector"),
+			NewClient: fakeProvider.NewClient,
+		}
+		Expect(gc.Sweep(ctx)).Should(Succeed())
+		Expect(fakeProvider.OwnedResourceExists("device-leaked")).Should(BeTrue())
+		Expect(fakeProvider.OwnedResourceExists("device-gone")).Should(BeTrue())
+
+		gc.DeleteOrphans = true
+		Expect(gc.Sweep(ctx)).Should(Succeed())
+		Expect(fakeProvider.OwnedResourceExists("device-leaked")).Should(BeFalse())
+		Expect(fakeProvider.OwnedResourceExists("device-gone")).Should(BeFalse())
+		Expect(fakeProvider.OwnedResourceExists(fetchedInstance.Status.InstanceID)).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, fetchedInstance)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, instanceKey, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+	})
+})
@@ -23,8 +23,12 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -33,9 +37,12 @@ import (
 // ImportKeyPairReconciler reconciles a ImportKeyPair object
 type ImportKeyPairReconciler struct {
 	client.Client
-	Scheme  *runtime.Scheme
-	Threads int
-	Log     logr.Logger
+	Scheme    *runtime.Scheme
+	Threads   int
+	Log       logr.Logger
+	NewClient metal.ClientFactory
+	// CredentialNamespace holds the secrets referenced by MetalCredentials
+	CredentialNamespace string
 }
 
 //+kubebuilder:rbac:groups=equinix.cattle.io,resources=importkeypairs,verbs=get;list;watch;create;update;patch;delete
@@ -48,7 +55,6 @@ func (r *ImportKeyPairReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	// your logic here
 	importKeyPair := &equinixv1alpha1.ImportKeyPair{}
 
-	var requeue bool
 	if err := r.Get(ctx, req.NamespacedName, importKeyPair); err != nil {
 		if errors.IsNotFound(err) {
 			return ctrl.Result{}, nil
@@ -56,10 +62,30 @@ func (r *ImportKeyPairReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		log.Error(err, "unable to fetch instance")
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	original := importKeyPair.DeepCopy()
+
+	if !importKeyPair.ObjectMeta.DeletionTimestamp.IsZero() && importKeyPair.Spec.DeletionPolicy == equinixv1alpha1.DeletionPolicyOrphan {
+		// orphaned objects are let go without calling the api, so missing or
+		// rejected credentials do not block the deletion
+		log.Info("orphaning key pair, leaving equinix metal resources in place")
+		controllerutil.RemoveFinalizer(importKeyPair, instanceFinalizer)
+		return ctrl.Result{}, patchObject(ctx, r.Client, original, importKeyPair)
+	}
 
 	// mClient contains the new metal client
-	mClient, err := metal.NewClient(ctx, r.Client, importKeyPair.Spec.Secret, importKeyPair.Namespace)
+	mClient, err := newClient(ctx, r.Client, r.NewClient, importKeyPair.Namespace, importKeyPair.Spec.Credential, importKeyPair.Spec.Secret, r.CredentialNamespace)
+	if setCredentialsCondition(&importKeyPair.Status.Conditions, importKeyPair.Generation, err) {
+		if updateErr := patchObject(ctx, r.Client, original, importKeyPair); updateErr != nil {
+			return ctrl.Result{}, updateErr
+		}
+		original = importKeyPair.DeepCopy()
+	}
 	if err != nil {
+		if metal.IsInvalidCredentials(err) {
+			// nothing can be done until the secret is fixed, which requeues the key pair
+			log.Error(err, "credential secret rejected by equinix metal api", "secret", importKeyPair.Spec.Secret)
+			return ctrl.Result{}, nil
+		}
 		return ctrl.Result{}, err
 	}
 
@@ -76,31 +102,55 @@ func (r *ImportKeyPairReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		}
 
 		if err != nil {
-			return ctrl.Result{}, err
+			return handleMetalError(log, err)
 		}
 
 		importKeyPair.Status = *newStatus
-		// requeue  always since the processing ends in the switch block
-		requeue = true
 		controllerutil.AddFinalizer(importKeyPair, instanceFinalizer)
 	} else {
 		// handle termination of importKeyPair
 		err = mClient.DeleteKeyPair(importKeyPair)
 		if err != nil {
-			return ctrl.Result{}, err
+			return handleMetalError(log, err)
 		}
 		controllerutil.RemoveFinalizer(importKeyPair, instanceFinalizer)
 	}
 
-	return ctrl.Result{Requeue: requeue}, r.Update(ctx, importKeyPair)
+	return ctrl.Result{}, patchObject(ctx, r.Client, original, importKeyPair)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ImportKeyPairReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.NewClient == nil {
+		r.NewClient = metal.NewProvider
+	}
+	err := indexCredentials(mgr, &equinixv1alpha1.ImportKeyPair{}, func(obj client.Object) (string, string) {
+		importKeyPair := obj.(*equinixv1alpha1.ImportKeyPair)
+		return importKeyPair.Spec.Credential, importKeyPair.Spec.Secret
+	})
+	if err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		WithOptions(controller.Options{
 			MaxConcurrentReconciles: r.Threads,
 		}).
 		For(&equinixv1alpha1.ImportKeyPair{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.keyPairsForSecret)).
+		Watches(&source.Kind{Type: &equinixv1alpha1.MetalCredential{}}, handler.EnqueueRequestsFromMapFunc(r.keyPairsForCredential)).
 		Complete(r)
 }
+
+// keyPairsForSecret requeues the key pairs using a credential secret when it changes
+func (r *ImportKeyPairReconciler) keyPairsForSecret(secret client.Object) []reconcile.Request {
+	return requestsForSecret(r.Client, r.Log, r.CredentialNamespace, func() client.ObjectList {
+		return &equinixv1alpha1.ImportKeyPairList{}
+	}, secret)
+}
+
+// keyPairsForCredential requeues the key pairs using a MetalCredential when it changes
+func (r *ImportKeyPairReconciler) keyPairsForCredential(credential client.Object) []reconcile.Request {
+	return requestsForCredential(r.Client, r.Log, func() client.ObjectList {
+		return &equinixv1alpha1.ImportKeyPairList{}
+	}, credential)
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+)
+
+var _ = Describe("ImportKeyPair controller", func() {
+	It("creates and deletes the key pair", func() {
+		keyPair := &equinixv1alpha1.ImportKeyPair{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "importkeypair-sample",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.ImportKeyPairSpec{
+				Key:    "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDF6c8PcOyIUSELn2RtiRx",
+				Secret: "equinix-metal",
+			},
+		}
+		Expect(k8sClient.Create(ctx, keyPair)).Should(Succeed())
+
+		key := types.NamespacedName{Name: keyPair.Name, Namespace: keyPair.Namespace}
+		fetched := &equinixv1alpha1.ImportKeyPair{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("created"))
+		Expect(fakeProvider.KeyPairExists(fetched.Status.KeyPairID)).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, key, &equinixv1alpha1.ImportKeyPair{}) != nil
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeProvider.KeyPairExists(fetched.Status.KeyPairID)).Should(BeFalse())
+	})
+
+	It("waits for rejected credentials to be fixed", func() {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "equinix-metal-revoked",
+				Namespace: "default",
+			},
+			StringData: map[string]string{"PACKET_AUTH_TOKEN": "revoked", "PROJECT_ID": "project"},
+		}
+		Expect(k8sClient.Create(ctx, secret)).Should(Succeed())
+		fakeProvider.RejectSecret(secret.Name, true)
+
+		keyPair := &equinixv1alpha1.ImportKeyPair{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "importkeypair-revoked",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.ImportKeyPairSpec{
+				Key:    "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDF6c8PcOyIUSELn2RtiRx",
+				Secret: secret.Name,
+			},
+		}
+		Expect(k8sClient.Create(ctx, keyPair)).Should(Succeed())
+
+		key := types.NamespacedName{Name: keyPair.Name, Namespace: keyPair.Namespace}
+		fetched := &equinixv1alpha1.ImportKeyPair{}
+		Eventually(func() bool {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return false
+			}
+			return meta.IsStatusConditionFalse(fetched.Status.Conditions, equinixv1alpha1.ConditionCredentialsValid)
+		}, timeout, interval).Should(BeTrue())
+		Expect(fetched.Status.Status).Should(BeEmpty())
+
+		// rotating the secret requeues the key pair
+		fakeProvider.RejectSecret(secret.Name, false)
+		secret.StringData = map[string]string{"PACKET_AUTH_TOKEN": "rotated"}
+		Expect(k8sClient.Update(ctx, secret)).Should(Succeed())
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("created"))
+		Expect(meta.IsStatusConditionTrue(fetched.Status.Conditions, equinixv1alpha1.ConditionCredentialsValid)).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+		Expect(k8sClient.Delete(ctx, secret)).Should(Succeed())
+	})
+})
@@ -18,39 +18,62 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/go-logr/logr"
 	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
 	"github.com/hobbyfarm/metal-operator/pkg/metal"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 )
 
 // InstanceReconciler reconciles a Instance object
 type InstanceReconciler struct {
 	client.Client
-	Scheme  *runtime.Scheme
-	Threads int
-	Log     logr.Logger
+	Scheme    *runtime.Scheme
+	Threads   int
+	Log       logr.Logger
+	NewClient metal.ClientFactory
+	Recorder  record.EventRecorder
+	// CredentialNamespace holds the secrets referenced by MetalCredentials
+	CredentialNamespace string
 }
 
-const instanceFinalizer = "instance.cattle.io"
+const (
+	instanceFinalizer = "instance.cattle.io"
+	// elasticIPIndex indexes instances by the name of the ElasticIP they use
+	elasticIPIndex = "elasticIP"
+	// virtualNetworkIndex indexes instances by the vlanAttachments entries they use
+	virtualNetworkIndex = "virtualNetwork"
+)
 
 //+kubebuilder:rbac:groups=equinix.cattle.io,resources=instances,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=equinix.cattle.io,resources=instances/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=equinix.cattle.io,resources=instances/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=equinix.cattle.io,resources=metalcredentials,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 func (r *InstanceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues("instance", req.NamespacedName)
 
 	instance := &equinixv1alpha1.Instance{}
 
-	var requeue bool
+	var result ctrl.Result
 	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
 		if errors.IsNotFound(err) {
 			return ctrl.Result{}, nil
@@ -58,13 +81,40 @@ func (r *InstanceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		log.Error(err, "unable to fetch instance")
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	original := instance.DeepCopy()
+
+	if !instance.ObjectMeta.DeletionTimestamp.IsZero() && instance.Spec.DeletionPolicy == equinixv1alpha1.DeletionPolicyOrphan {
+		// orphaned objects are let go without calling the api, so missing or
+		// rejected credentials do not block the deletion
+		log.Info("orphaning instance, leaving equinix metal resources in place")
+		controllerutil.RemoveFinalizer(instance, instanceFinalizer)
+		return ctrl.Result{}, patchObject(ctx, r.Client, original, instance)
+	}
 
 	// mClient contains the new metal client
-	mClient, err := metal.NewClient(ctx, r.Client, instance.Spec.Secret, instance.Namespace)
+	mClient, err := newClient(ctx, r.Client, r.NewClient, instance.Namespace, instance.Spec.Credential, instance.Spec.Secret, r.CredentialNamespace)
+	if setCredentialsCondition(&instance.Status.Conditions, instance.Generation, err) {
+		if updateErr := patchObject(ctx, r.Client, original, instance); updateErr != nil {
+			return ctrl.Result{}, updateErr
+		}
+		original = instance.DeepCopy()
+	}
 	if err != nil {
+		if metal.IsInvalidCredentials(err) {
+			// nothing can be done until the secret is fixed, which requeues the instance
+			log.Error(err, "credential secret rejected by equinix metal api", "secret", instance.Spec.Secret)
+			return ctrl.Result{}, nil
+		}
 		return ctrl.Result{}, err
 	}
 
+	if instance.ObjectMeta.DeletionTimestamp.IsZero() && !controllerutil.ContainsFinalizer(instance, instanceFinalizer) {
+		// the finalizer is in place before anything is created, the update
+		// triggers the next reconcile
+		controllerutil.AddFinalizer(instance, instanceFinalizer)
+		return ctrl.Result{}, patchObject(ctx, r.Client, original, instance)
+	}
+
 	if instance.ObjectMeta.DeletionTimestamp.IsZero() {
 		// instance provisioning //
 		status := instance.Status.DeepCopy()
@@ -72,51 +122,304 @@ func (r *InstanceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		switch status.Status {
 		case "":
 			// need to provision
+			if deviceID := metal.AdoptDeviceID(instance); deviceID != "" {
+				log.Info("adopting device", "deviceID", deviceID)
+				newStatus, err = mClient.AdoptDevice(instance)
+				break
+			}
+			if instance.Spec.ElasticIP != "" {
+				log.Info("using elastic ip", "elasticIP", instance.Spec.ElasticIP)
+				newStatus, err = r.useElasticIP(ctx, instance, mClient)
+				break
+			}
 			log.Info("provisioning elastic ip")
 			newStatus, err = mClient.CreateElasticInterface(instance)
 		case "elasticipcreated":
-			// after elastic ip is provisioned we wait until the VM controller updates the status
-			// this will ensure that the cloudInit is patched with correct VIP arguments
+			// after elastic ip is provisioned we wait until the provisioning gates are
+			// satisfied, so the cloudInit is patched with correct VIP arguments
 			// before the node is actually provisioned.
-			log.Info("elastic ip provisioned.. waiting for vm controller to patch object")
-			return ctrl.Result{}, nil
+			if len(instance.Spec.ProvisioningGates) == 0 {
+				// legacy waitforpatching annotation, the VM controller moves the instance to patched
+				log.Info("elastic ip provisioned.. waiting for vm controller to patch object")
+				return ctrl.Result{}, nil
+			}
+			log.Info("checking provisioning gates")
+			newStatus, result.RequeueAfter = metal.CheckProvisioningGates(instance)
 		case "patched":
 			log.Info("provisioning metal device")
 			newStatus, err = mClient.CreateNewDevice(instance)
-		case "queued":
+		case equinixv1alpha1.InstanceWaitingForCapacity:
+			log.Info("checking capacity")
+			newStatus, err = mClient.CreateNewDevice(instance)
+		case "queued", "provisioning":
+			// vlans named by VirtualNetwork have to exist before the network is configured
+			var ready bool
+			newStatus, ready, err = r.resolveVirtualNetworks(ctx, instance)
+			if err != nil || !ready {
+				break
+			}
+			instance.Status = *newStatus
 			// need to check if device is active
 			log.Info("checking device status")
 			newStatus, err = mClient.CheckDeviceStatus(instance)
 		case "active":
-			log.Info("device provisioning completed")
-			// provisioning complete, update status and ignore
+			if instance.Generation != status.ObservedGeneration {
+				log.Info("applying spec changes to device")
+				return r.applySpecChanges(ctx, log, original, instance, mClient)
+			}
+			if !metal.IsSpot(instance) {
+				log.Info("device provisioning completed")
+				// provisioning complete, update status and ignore
+				return ctrl.Result{}, nil
+			}
+			// spot devices can be reclaimed at any time
+			newStatus, err = mClient.CheckSpotDevice(instance)
+			result.RequeueAfter = metal.SpotPollInterval
+		case equinixv1alpha1.InstanceFailed:
+			// failed instances are not retried, deleting the object releases the hardware
+			log.Info("instance provisioning failed", "reason", status.FailureReason, "message", status.FailureMessage)
 			return ctrl.Result{}, nil
 		}
 
 		if err != nil {
-			return ctrl.Result{}, err
+			return r.handleProvisioningError(ctx, log, original, instance, newStatus, err)
 		}
+		r.recordSpotReclaim(instance, status, newStatus)
 		instance.Status = *newStatus
-		requeue = true
-		controllerutil.AddFinalizer(instance, instanceFinalizer)
-	} else {
-		// handle termination of hardware //
-		log.Info("cleaning up instance")
-		err = mClient.DeleteDevice(instance)
-		if err != nil {
+		instance.Status.ObservedGeneration = instance.Generation
+		if newStatus.Status == "active" && status.Status != "active" {
+			// spec changes made while the device was provisioning are applied next
+			instance.Status.ObservedGeneration = metal.DeviceGeneration(newStatus, instance.Generation)
+		}
+		// moving to the next step updates the instance which triggers the next
+		// reconcile, only steps waiting on equinix metal need to be requeued
+		switch newStatus.Status {
+		case "queued", "provisioning":
+			result.RequeueAfter = metal.PollInterval(newStatus)
+		case equinixv1alpha1.InstanceWaitingForCapacity:
+			result.RequeueAfter = metal.CapacityRetryInterval(newStatus)
+			log.Info("waiting for capacity", "retryAfter", result.RequeueAfter)
+		}
+		return result, patchObject(ctx, r.Client, original, instance)
+	}
+
+	// handle termination of hardware //
+	log.Info("cleaning up instance")
+	err = mClient.DeleteDevice(instance)
+	if err != nil {
+		return handleMetalError(log, err)
+	}
+	controllerutil.RemoveFinalizer(instance, instanceFinalizer)
+	return result, patchObject(ctx, r.Client, original, instance)
+}
+
+// handleProvisioningError persists the conditions recorded by the failed step.
+// Non retryable errors move the instance into the failed phase.
+func (r *InstanceReconciler) handleProvisioningError(ctx context.Context, log logr.Logger, original *equinixv1alpha1.Instance,
+	instance *equinixv1alpha1.Instance, newStatus *equinixv1alpha1.InstanceStatus, err error) (ctrl.Result, error) {
+	result, retErr := handleMetalError(log, err)
+	if newStatus == nil {
+		return result, retErr
+	}
+
+	if metal.IsTerminal(err) {
+		newStatus.Status = equinixv1alpha1.InstanceFailed
+		newStatus.FailureReason = metal.ErrorReason(err)
+		newStatus.FailureMessage = err.Error()
+		metal.SetCondition(newStatus, instance.Generation, equinixv1alpha1.ConditionReady, false, newStatus.FailureReason, err.Error())
+	}
+	newStatus.ObservedGeneration = instance.Generation
+
+	// retries usually fail with the same error. skipping identical writes keeps
+	// the update from triggering a new reconcile ahead of the queue backoff
+	if equality.Semantic.DeepEqual(instance.Status, *newStatus) {
+		return result, retErr
+	}
+
+	instance.Status = *newStatus
+	if updateErr := patchObject(ctx, r.Client, original, instance); updateErr != nil {
+		return ctrl.Result{}, updateErr
+	}
+	return result, retErr
+}
+
+// applySpecChanges updates the device of an active instance after the spec
+// changed. Failed updates leave the observed generation behind so they are
+// retried, the device keeps running and the instance is never marked failed.
+func (r *InstanceReconciler) applySpecChanges(ctx context.Context, log logr.Logger, original *equinixv1alpha1.Instance,
+	instance *equinixv1alpha1.Instance, mClient metal.Provider) (ctrl.Result, error) {
+	newStatus, ready, err := r.resolveVirtualNetworks(ctx, instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !ready {
+		// the VirtualNetwork watch requeues the instance once it is created
+		instance.Status = *newStatus
+		return ctrl.Result{}, patchObject(ctx, r.Client, original, instance)
+	}
+	if metal.StartNetworkChange(instance, newStatus) {
+		// the conversion is recorded first, it only completes after several calls
+		instance.Status = *newStatus
+		if err := patchObject(ctx, r.Client, original, instance); err != nil {
 			return ctrl.Result{}, err
 		}
-		controllerutil.RemoveFinalizer(instance, instanceFinalizer)
+		original = instance.DeepCopy()
 	}
-	return ctrl.Result{Requeue: requeue}, r.Update(ctx, instance)
+	instance.Status = *newStatus
+	newStatus, err = mClient.UpdateDevice(instance)
+	if err == nil {
+		newStatus.ObservedGeneration = instance.Generation
+	}
+	instance.Status = *newStatus
+	if updateErr := patchObject(ctx, r.Client, original, instance); updateErr != nil {
+		return ctrl.Result{}, updateErr
+	}
+	if err != nil {
+		return handleMetalError(log, err)
+	}
+	if meta.IsStatusConditionTrue(newStatus.Conditions, equinixv1alpha1.ConditionSpecDrift) {
+		log.Info("spec changes can not be applied to the device", "message",
+			meta.FindStatusCondition(newStatus.Conditions, equinixv1alpha1.ConditionSpecDrift).Message)
+	}
+	return ctrl.Result{}, nil
+}
+
+// recordSpotReclaim emits an event when the termination of the spot device is
+// scheduled, or when the device is gone and the instance failed or is replacing it
+func (r *InstanceReconciler) recordSpotReclaim(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus,
+	newStatus *equinixv1alpha1.InstanceStatus) {
+	condition := meta.FindStatusCondition(newStatus.Conditions, equinixv1alpha1.ConditionSpotReclaimed)
+	if r.Recorder == nil || condition == nil || condition.Status != metav1.ConditionTrue {
+		return
+	}
+	previous := meta.FindStatusCondition(status.Conditions, equinixv1alpha1.ConditionSpotReclaimed)
+	if previous != nil && previous.Status == condition.Status && previous.Reason == condition.Reason && previous.Message == condition.Message {
+		return
+	}
+	r.Recorder.Event(instance, corev1.EventTypeWarning, equinixv1alpha1.ConditionSpotReclaimed, condition.Message)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *InstanceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.NewClient == nil {
+		r.NewClient = metal.NewProvider
+	}
+	err := indexCredentials(mgr, &equinixv1alpha1.Instance{}, func(obj client.Object) (string, string) {
+		instance := obj.(*equinixv1alpha1.Instance)
+		return instance.Spec.Credential, instance.Spec.Secret
+	})
+	if err != nil {
+		return err
+	}
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &equinixv1alpha1.Instance{}, elasticIPIndex, func(obj client.Object) []string {
+		return []string{obj.(*equinixv1alpha1.Instance).Spec.ElasticIP}
+	})
+	if err != nil {
+		return err
+	}
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &equinixv1alpha1.Instance{}, virtualNetworkIndex, func(obj client.Object) []string {
+		return metal.VirtualNetworkNames(obj.(*equinixv1alpha1.Instance))
+	})
+	if err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		WithOptions(controller.Options{
 			MaxConcurrentReconciles: r.Threads,
 		}).
 		For(&equinixv1alpha1.Instance{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.instancesForSecret)).
+		Watches(&source.Kind{Type: &equinixv1alpha1.MetalCredential{}}, handler.EnqueueRequestsFromMapFunc(r.instancesForCredential)).
+		Watches(&source.Kind{Type: &equinixv1alpha1.ElasticIP{}}, handler.EnqueueRequestsFromMapFunc(r.instancesForElasticIP)).
+		Watches(&source.Kind{Type: &equinixv1alpha1.VirtualNetwork{}}, handler.EnqueueRequestsFromMapFunc(r.instancesForVirtualNetwork)).
 		Complete(r)
 }
+
+// instancesForSecret requeues the instances using a credential secret when it changes
+func (r *InstanceReconciler) instancesForSecret(secret client.Object) []reconcile.Request {
+	return requestsForSecret(r.Client, r.Log, r.CredentialNamespace, func() client.ObjectList {
+		return &equinixv1alpha1.InstanceList{}
+	}, secret)
+}
+
+// instancesForCredential requeues the instances using a MetalCredential when it changes
+func (r *InstanceReconciler) instancesForCredential(credential client.Object) []reconcile.Request {
+	return requestsForCredential(r.Client, r.Log, func() client.ObjectList {
+		return &equinixv1alpha1.InstanceList{}
+	}, credential)
+}
+
+// instancesForElasticIP requeues the instances waiting for an ElasticIP to be reserved
+func (r *InstanceReconciler) instancesForElasticIP(eip client.Object) []reconcile.Request {
+	return listRequests(r.Client, r.Log, &equinixv1alpha1.InstanceList{}, client.InNamespace(eip.GetNamespace()),
+		client.MatchingFields{elasticIPIndex: eip.GetName()})
+}
+
+// instancesForVirtualNetwork requeues the instances attaching a VirtualNetwork
+func (r *InstanceReconciler) instancesForVirtualNetwork(vn client.Object) []reconcile.Request {
+	return listRequests(r.Client, r.Log, &equinixv1alpha1.InstanceList{}, client.InNamespace(vn.GetNamespace()),
+		client.MatchingFields{virtualNetworkIndex: vn.GetName()})
+}
+
+// useElasticIP attaches the ElasticIP named in the instance spec once its
+// addresses are reserved. Until then the instance waits, the ElasticIP watch
+// requeues it when the reservation is made.
+func (r *InstanceReconciler) useElasticIP(ctx context.Context, instance *equinixv1alpha1.Instance,
+	mClient metal.Provider) (*equinixv1alpha1.InstanceStatus, error) {
+	eip := &equinixv1alpha1.ElasticIP{}
+	err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.ElasticIP, Namespace: instance.Namespace}, eip)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	status := instance.Status.DeepCopy()
+	switch {
+	case errors.IsNotFound(err):
+		metal.SetCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, false, "ElasticIPNotFound",
+			fmt.Sprintf("elastic ip %s not found", instance.Spec.ElasticIP))
+	case eip.Status.Status != equinixv1alpha1.ElasticIPReserved:
+		metal.SetCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, false, "WaitingForElasticIP",
+			fmt.Sprintf("waiting for elastic ip %s to be reserved", instance.Spec.ElasticIP))
+	default:
+		return mClient.UseElasticIP(instance, eip)
+	}
+	return status, nil
+}
+
+// resolveVirtualNetworks records the vlans of the VirtualNetworks named in the
+// vlanAttachments and nativeVLAN of the instance. Entries holding a vxlan
+// number or a vlan uuid without a VirtualNetwork of that name are used as is.
+// Until every other entry names a created VirtualNetwork the instance waits,
+// the VirtualNetwork watch requeues it.
+func (r *InstanceReconciler) resolveVirtualNetworks(ctx context.Context, instance *equinixv1alpha1.Instance) (*equinixv1alpha1.InstanceStatus, bool, error) {
+	status := instance.Status.DeepCopy()
+	status.VirtualNetworks = nil
+
+	for _, name := range metal.VirtualNetworkNames(instance) {
+		vn := &equinixv1alpha1.VirtualNetwork{}
+		err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, vn)
+		if errors.IsNotFound(err) && metal.IsVLANID(name) {
+			continue
+		}
+		if errors.IsNotFound(err) {
+			// applied along with the instance, the VirtualNetwork may not be there yet
+			metal.SetCondition(status, instance.Generation, equinixv1alpha1.ConditionNetworkConfigured, false, "WaitingForVirtualNetwork",
+				fmt.Sprintf("waiting for virtual network %s to be created", name))
+			return status, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if vn.Status.Status != equinixv1alpha1.VirtualNetworkCreated {
+			metal.SetCondition(status, instance.Generation, equinixv1alpha1.ConditionNetworkConfigured, false, "WaitingForVirtualNetwork",
+				fmt.Sprintf("waiting for virtual network %s to be created", name))
+			return status, false, nil
+		}
+		status.VirtualNetworks = append(status.VirtualNetworks, equinixv1alpha1.InstanceVirtualNetwork{
+			Name:   name,
+			VLANID: vn.Status.VLANID,
+			VXLAN:  vn.Status.VXLAN,
+		})
+	}
+	return status, true, nil
+}
@@ -0,0 +1,461 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
+	"github.com/hobbyfarm/metal-operator/pkg/metal/fake"
+)
+
+const (
+	timeout  = time.Second * 20
+	interval = time.Millisecond * 250
+)
+
+var _ = Describe("Instance controller", func() {
+	It("provisions and cleans up a device", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-sample",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetched := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+
+		Expect(fetched.Status.InstanceID).ShouldNot(BeEmpty())
+		Expect(fetched.Status.PublicIP).Should(Equal(fetched.Annotations[metal.AddressAnnotation]))
+		Expect(controllerutil.ContainsFinalizer(fetched, instanceFinalizer)).Should(BeTrue())
+		Expect(fakeProvider.DeviceExists(fetched.Status.InstanceID)).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, key, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeProvider.DeviceExists(fetched.Status.InstanceID)).Should(BeFalse())
+	})
+
+	It("leaves the device behind when orphaned", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-orphan",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+				DeletionPolicy:  equinixv1alpha1.DeletionPolicyOrphan,
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetched := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+
+		// the credentials are not needed to let go of the instance
+		fetched.Spec.Secret = "missing-secret"
+		Expect(k8sClient.Update(ctx, fetched)).Should(Succeed())
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, key, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeProvider.DeviceExists(fetched.Status.InstanceID)).Should(BeTrue())
+	})
+
+	It("adopts an existing device", func() {
+		fakeProvider.AddDevice("device-existing")
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "instance-adopted",
+				Namespace:   "default",
+				Annotations: map[string]string{metal.AdoptAnnotation: "device-existing"},
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+				DeletionPolicy:  equinixv1alpha1.DeletionPolicyRetain,
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetched := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+		Expect(fetched.Status.InstanceID).Should(Equal("device-existing"))
+		Expect(fetched.Annotations).ShouldNot(HaveKey(metal.ReservationAnnotation))
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, key, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeProvider.DeviceExists("device-existing")).Should(BeTrue())
+	})
+
+	It("finds the device again when its id was not recorded", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-lost-status",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetched := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+		deviceID := fetched.Status.InstanceID
+
+		// the state left behind when the status write after creating the device is lost
+		fetched.Status.Status = "patched"
+		fetched.Status.InstanceID = ""
+		Expect(k8sClient.Status().Update(ctx, fetched)).Should(Succeed())
+
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+		Expect(fetched.Status.InstanceID).Should(Equal(deviceID))
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, key, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeProvider.DeviceExists(deviceID)).Should(BeFalse())
+	})
+
+	It("marks the instance failed on non retryable errors", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-invalid-plan",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "not-a-plan",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+			},
+		}
+		fakeProvider.FailDevice(instance.Name, fake.APIError(http.StatusUnprocessableEntity, "Plan is not valid"))
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetched := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal(equinixv1alpha1.InstanceFailed))
+
+		Expect(fetched.Status.FailureReason).Should(Equal("InvalidRequest"))
+		Expect(fetched.Status.FailureMessage).Should(ContainSubstring("Plan is not valid"))
+		Expect(meta.IsStatusConditionFalse(fetched.Status.Conditions, equinixv1alpha1.ConditionDeviceCreated)).Should(BeTrue())
+		Expect(meta.IsStatusConditionFalse(fetched.Status.Conditions, equinixv1alpha1.ConditionReady)).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, key, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+	})
+
+	It("holds the instance while there is no capacity", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-no-capacity",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+			},
+		}
+		fakeProvider.SetCapacity(instance.Name, false)
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetched := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal(equinixv1alpha1.InstanceWaitingForCapacity))
+
+		Expect(fetched.Status.InstanceID).Should(BeEmpty())
+		Expect(meta.IsStatusConditionFalse(fetched.Status.Conditions, equinixv1alpha1.ConditionCapacityAvailable)).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, key, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+	})
+
+	It("waits for patching when requested", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "instance-patching",
+				Namespace:   "default",
+				Annotations: map[string]string{"waitforpatching": "true"},
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetched := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("elasticipcreated"))
+
+		Consistently(func() string {
+			_ = k8sClient.Get(ctx, key, fetched)
+			return fetched.Status.InstanceID
+		}, time.Second, interval).Should(BeEmpty())
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+	})
+	It("creates the device once the provisioning gates are satisfied", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-gated",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:              "c3.small.x86",
+				Metro:             "sg",
+				OperatingSystem:   "custom_ipxe",
+				BillingCycle:      "hourly",
+				Secret:            "equinix-metal",
+				ProvisioningGates: []string{"UserDataPatched"},
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetched := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("elasticipcreated"))
+		Expect(fetched.Status.ElasticIP).ShouldNot(BeNil())
+		Expect(fetched.Status.ElasticIP.Address).ShouldNot(BeEmpty())
+
+		Eventually(func() error {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return err
+			}
+			meta.SetStatusCondition(&fetched.Status.Conditions, metav1.Condition{
+				Type:   "UserDataPatched",
+				Status: metav1.ConditionTrue,
+				Reason: "Patched",
+			})
+			return k8sClient.Status().Update(ctx, fetched)
+		}, timeout, interval).Should(Succeed())
+
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.InstanceID
+		}, timeout, interval).ShouldNot(BeEmpty())
+		Expect(meta.IsStatusConditionTrue(fetched.Status.Conditions, equinixv1alpha1.ConditionProvisioningGatesReady)).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+	})
+
+	It("replaces a reclaimed spot device", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-spot",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+				SpotInstance:    true,
+				SpotRecovery:    equinixv1alpha1.SpotRecoveryOnDemand,
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetched := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+		reclaimed := fetched.Status.InstanceID
+		address := fetched.Status.PublicIP
+
+		fakeProvider.ReclaimDevice(reclaimed)
+		// touching the instance reconciles it ahead of the spot poll interval
+		Eventually(func() error {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return err
+			}
+			fetched.Labels = map[string]string{"reclaimed": "true"}
+			return k8sClient.Update(ctx, fetched)
+		}, timeout, interval).Should(Succeed())
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return false
+			}
+			return fetched.Status.Status == "active" && fetched.Status.InstanceID != reclaimed
+		}, timeout, interval).Should(BeTrue())
+		Expect(fetched.Status.SpotReclaims).Should(Equal(1))
+		Expect(fetched.Status.OnDemand).Should(BeTrue())
+		Expect(fetched.Status.PublicIP).Should(Equal(address))
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+	})
+
+	It("applies spec changes to an active device", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-drift",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetched := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return ""
+			}
+			return fetched.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+
+		Eventually(func() error {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return err
+			}
+			fetched.Spec.Tags = []string{"course-1"}
+			fetched.Spec.Description = "lab machine"
+			return k8sClient.Update(ctx, fetched)
+		}, timeout, interval).Should(Succeed())
+		Eventually(func() string {
+			spec, _ := fakeProvider.DeviceSpec(fetched.Status.InstanceID)
+			return spec.Description
+		}, timeout, interval).Should(Equal("lab machine"))
+
+		Eventually(func() error {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return err
+			}
+			fetched.Spec.Plan = "m3.large.x86"
+			return k8sClient.Update(ctx, fetched)
+		}, timeout, interval).Should(Succeed())
+		Eventually(func() bool {
+			if err := k8sClient.Get(ctx, key, fetched); err != nil {
+				return false
+			}
+			return fetched.Status.ObservedGeneration == fetched.Generation &&
+				meta.IsStatusConditionTrue(fetched.Status.Conditions, equinixv1alpha1.ConditionSpecDrift)
+		}, timeout, interval).Should(BeTrue())
+		Expect(fetched.Status.Status).Should(Equal("active"))
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+	})
+})
@@ -0,0 +1,290 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// objectWithConditions is an object with status conditions which other
+// writers may add to, like the provisioning gates of an Instance
+type objectWithConditions interface {
+	client.Object
+	GetConditions() []metav1.Condition
+	SetConditions(conditions []metav1.Condition)
+}
+
+// patchObject writes the changes made to obj since it was read as original.
+// Metadata goes first as a merge patch, so annotations naming a reservation
+// are stored before the status moves past reserving it, then the status
+// through the status subresource. Only changed fields are sent, finalizers
+// and conditions are merged with the stored ones and conflicting writes are
+// retried on top of the latest object, so changes made meanwhile by other
+// writers such as hf-shim-operator are kept. obj is left with the resource
+// version written, so it can serve as original of a following patch.
+func patchObject(ctx context.Context, c client.Client, original objectWithConditions, obj objectWithConditions) error {
+	latest, err := patchMetadata(ctx, c, original, obj)
+	if err != nil || latest == nil {
+		return err
+	}
+	resourceVersion, err := patchStatus(ctx, c, original, latest.(objectWithConditions), obj)
+	if err != nil {
+		return err
+	}
+	obj.SetResourceVersion(resourceVersion)
+	return nil
+}
+
+// patchMetadata patches the annotations, labels and finalizers changed
+// between original and obj. It returns the stored object, nil once removing
+// the last finalizer let it go.
+func patchMetadata(ctx context.Context, c client.Client, original client.Object, obj client.Object) (client.Object, error) {
+	latest := original
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		target := latest.DeepCopyObject().(client.Object)
+		target.SetAnnotations(mergeMap(original.GetAnnotations(), obj.GetAnnotations(), latest.GetAnnotations()))
+		target.SetLabels(mergeMap(original.GetLabels(), obj.GetLabels(), latest.GetLabels()))
+		target.SetFinalizers(mergeList(original.GetFinalizers(), obj.GetFinalizers(), latest.GetFinalizers()))
+
+		patch := client.MergeFrom(latest)
+		if !equality.Semantic.DeepEqual(latest.GetFinalizers(), target.GetFinalizers()) {
+			// finalizers are replaced as a whole, the lock keeps the ones added meanwhile
+			patch = client.MergeFromWithOptions(latest, client.MergeFromWithOptimisticLock{})
+		}
+		data, err := patch.Data(target)
+		if err != nil || string(data) == "{}" {
+			return err
+		}
+
+		err = c.Patch(ctx, target, patch)
+		if err == nil {
+			latest = target
+		} else if apierrors.IsConflict(err) {
+			fresh, getErr := refetch(ctx, c, original)
+			if getErr != nil {
+				return getErr
+			}
+			latest = fresh
+		}
+		return err
+	})
+	if apierrors.IsNotFound(err) && !obj.GetDeletionTimestamp().IsZero() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !latest.GetDeletionTimestamp().IsZero() && len(latest.GetFinalizers()) == 0 {
+		return nil, nil
+	}
+	return latest, nil
+}
+
+// patchStatus patches the status changed between original and obj onto
+// latest. Fields and conditions obj left as they were read keep the stored
+// values, so a status.status moved meanwhile by hf-shim-operator survives.
+// Returns the resource version written.
+func patchStatus(ctx context.Context, c client.Client, original objectWithConditions, latest objectWithConditions,
+	obj objectWithConditions) (string, error) {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		target := latest.DeepCopyObject().(objectWithConditions)
+		if err := mergeStatus(original, obj, target); err != nil {
+			return err
+		}
+		target.SetConditions(mergeConditions(original.GetConditions(), obj.GetConditions(), latest.GetConditions()))
+
+		patch := client.MergeFrom(latest)
+		if !equality.Semantic.DeepEqual(latest.GetConditions(), target.GetConditions()) {
+			// conditions are replaced as a whole, the lock keeps the ones set meanwhile
+			patch = client.MergeFromWithOptions(latest, client.MergeFromWithOptimisticLock{})
+		}
+		data, err := patch.Data(target)
+		if err != nil || !hasStatus(data) {
+			return err
+		}
+
+		err = c.Status().Patch(ctx, target, patch)
+		if err == nil {
+			latest = target
+		} else if apierrors.IsConflict(err) {
+			fresh, getErr := refetch(ctx, c, original)
+			if getErr != nil {
+				return getErr
+			}
+			latest = fresh.(objectWithConditions)
+		}
+		return err
+	})
+	return latest.GetResourceVersion(), err
+}
+
+func refetch(ctx context.Context, c client.Client, obj client.Object) (client.Object, error) {
+	latest := obj.DeepCopyObject().(client.Object)
+	err := c.Get(ctx, client.ObjectKeyFromObject(obj), latest)
+	return latest, err
+}
+
+// hasStatus reports if a merge patch changes the status, the status
+// subresource ignores everything else
+func hasStatus(data []byte) bool {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return true
+	}
+	_, ok := fields["status"]
+	return ok
+}
+
+// mergeMap applies the keys added, changed or removed between original and
+// desired to latest
+func mergeMap(original map[string]string, desired map[string]string, latest map[string]string) map[string]string {
+	merged := make(map[string]string, len(latest))
+	for k, v := range latest {
+		merged[k] = v
+	}
+	for k, v := range desired {
+		if old, ok := original[k]; !ok || old != v {
+			merged[k] = v
+		}
+	}
+	for k := range original {
+		if _, ok := desired[k]; !ok {
+			delete(merged, k)
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// mergeList applies the entries added or removed between original and desired to latest
+func mergeList(original []string, desired []string, latest []string) []string {
+	contains := func(list []string, s string) bool {
+		for _, item := range list {
+			if item == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	var merged []string
+	for _, item := range latest {
+		if contains(desired, item) || !contains(original, item) {
+			merged = append(merged, item)
+		}
+	}
+	for _, item := range desired {
+		if !contains(merged, item) && !contains(original, item) {
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+// mergeStatus applies the status fields changed between original and desired
+// to target, which holds the latest stored object
+func mergeStatus(original client.Object, desired client.Object, target client.Object) error {
+	converter := runtime.DefaultUnstructuredConverter
+	originalFields, err := converter.ToUnstructured(original)
+	if err != nil {
+		return err
+	}
+	desiredFields, err := converter.ToUnstructured(desired)
+	if err != nil {
+		return err
+	}
+	targetFields, err := converter.ToUnstructured(target)
+	if err != nil {
+		return err
+	}
+
+	status := mergeFields(nestedFields(originalFields, "status"), nestedFields(desiredFields, "status"), nestedFields(targetFields, "status"))
+	if len(status) == 0 {
+		delete(targetFields, "status")
+	} else {
+		targetFields["status"] = status
+	}
+	return converter.FromUnstructured(targetFields, target)
+}
+
+// mergeFields applies the fields added, changed or removed between original
+// and desired to latest. Nested objects are merged field by field, lists are
+// replaced as a whole.
+func mergeFields(original map[string]interface{}, desired map[string]interface{}, latest map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(latest))
+	for k, v := range latest {
+		merged[k] = v
+	}
+	for k, v := range desired {
+		old, ok := original[k]
+		if ok && equality.Semantic.DeepEqual(old, v) {
+			continue
+		}
+		desiredNested, isMap := v.(map[string]interface{})
+		latestNested, latestIsMap := merged[k].(map[string]interface{})
+		if isMap && latestIsMap {
+			merged[k] = mergeFields(nestedFields(original, k), desiredNested, latestNested)
+			continue
+		}
+		merged[k] = v
+	}
+	for k := range original {
+		if _, ok := desired[k]; !ok {
+			delete(merged, k)
+		}
+	}
+	return merged
+}
+
+func nestedFields(fields map[string]interface{}, key string) map[string]interface{} {
+	nested, _ := fields[key].(map[string]interface{})
+	return nested
+}
+
+// mergeConditions applies the conditions set or removed between original and
+// desired to latest
+func mergeConditions(original []metav1.Condition, desired []metav1.Condition, latest []metav1.Condition) []metav1.Condition {
+	merged := make([]metav1.Condition, len(latest))
+	copy(merged, latest)
+	for _, condition := range desired {
+		if old := meta.FindStatusCondition(original, condition.Type); old != nil && equality.Semantic.DeepEqual(*old, condition) {
+			continue
+		}
+		if existing := meta.FindStatusCondition(merged, condition.Type); existing != nil {
+			*existing = condition
+		} else {
+			merged = append(merged, condition)
+		}
+	}
+	for _, condition := range original {
+		if meta.FindStatusCondition(desired, condition.Type) == nil {
+			meta.RemoveStatusCondition(&merged, condition.Type)
+		}
+	}
+	return merged
+}
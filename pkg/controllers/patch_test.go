@@ -0,0 +1,102 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+)
+
+var _ = Describe("Patching objects", func() {
+	It("merges lists with the stored ones", func() {
+		Expect(mergeList([]string{"a", "b"}, []string{"a", "c"}, []string{"a", "b", "d"})).Should(Equal([]string{"a", "d", "c"}))
+		Expect(mergeMap(map[string]string{"a": "1", "b": "2"}, map[string]string{"a": "3"}, map[string]string{"a": "1", "b": "2", "c": "4"})).
+			Should(Equal(map[string]string{"a": "3", "c": "4"}))
+		Expect(mergeFields(
+			map[string]interface{}{"status": "elasticipcreated", "network": map[string]interface{}{"type": "layer3", "ports": []interface{}{"bond0"}}},
+			map[string]interface{}{"status": "elasticipcreated", "network": map[string]interface{}{"type": "hybrid", "ports": []interface{}{"bond0"}}, "publicIP": "203.0.113.1"},
+			map[string]interface{}{"status": "patched", "network": map[string]interface{}{"type": "layer3", "ports": []interface{}{"eth0"}}})).
+			Should(Equal(map[string]interface{}{"status": "patched", "network": map[string]interface{}{"type": "hybrid", "ports": []interface{}{"eth0"}}, "publicIP": "203.0.113.1"}))
+
+		original := []metav1.Condition{{Type: "Ready", Status: metav1.ConditionFalse, Reason: "Provisioning"}}
+		desired := []metav1.Condition{{Type: "Ready", Status: metav1.ConditionTrue, Reason: "DeviceActive"}}
+		latest := append(original, metav1.Condition{Type: "UserDataPatched", Status: metav1.ConditionTrue, Reason: "Patched"})
+		Expect(mergeConditions(original, desired, latest)).Should(Equal([]metav1.Condition{
+			{Type: "Ready", Status: metav1.ConditionTrue, Reason: "DeviceActive"},
+			{Type: "UserDataPatched", Status: metav1.ConditionTrue, Reason: "Patched"},
+		}))
+	})
+
+	It("keeps changes made by other writers since the object was read", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-patch",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				// the reconciler leaves the instance alone without credentials
+				Secret:         "missing-secret",
+				DeletionPolicy: equinixv1alpha1.DeletionPolicyOrphan,
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		original := &equinixv1alpha1.Instance{}
+		Expect(k8sClient.Get(ctx, key, original)).Should(Succeed())
+
+		other := original.DeepCopy()
+		meta.SetStatusCondition(&other.Status.Conditions, metav1.Condition{Type: "UserDataPatched", Status: metav1.ConditionTrue, Reason: "Patched"})
+		other.Status.Status = "patched"
+		Expect(k8sClient.Status().Update(ctx, other)).Should(Succeed())
+		other.Annotations = map[string]string{"patched-by": "hf-shim-operator"}
+		Expect(k8sClient.Update(ctx, other)).Should(Succeed())
+
+		obj := original.DeepCopy()
+		obj.Annotations = map[string]string{"reservationID": "reservation-1"}
+		controllerutil.AddFinalizer(obj, instanceFinalizer)
+		obj.Status.Facility = "sg1"
+		meta.SetStatusCondition(&obj.Status.Conditions, metav1.Condition{Type: "Ready", Status: metav1.ConditionFalse, Reason: "Provisioning"})
+		Expect(patchObject(ctx, k8sClient, original, obj)).Should(Succeed())
+
+		fetched := &equinixv1alpha1.Instance{}
+		Expect(k8sClient.Get(ctx, key, fetched)).Should(Succeed())
+		Expect(fetched.Annotations).Should(HaveKeyWithValue("patched-by", "hf-shim-operator"))
+		Expect(fetched.Annotations).Should(HaveKeyWithValue("reservationID", "reservation-1"))
+		Expect(fetched.Finalizers).Should(ContainElement(instanceFinalizer))
+		Expect(fetched.Status.Status).Should(Equal("patched"))
+		Expect(fetched.Status.Facility).Should(Equal("sg1"))
+		Expect(meta.IsStatusConditionTrue(fetched.Status.Conditions, "UserDataPatched")).Should(BeTrue())
+		Expect(meta.FindStatusCondition(fetched.Status.Conditions, "Ready")).ShouldNot(BeNil())
+		Expect(obj.ResourceVersion).Should(Equal(fetched.ResourceVersion))
+
+		Expect(k8sClient.Delete(ctx, fetched)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, key, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+	})
+})
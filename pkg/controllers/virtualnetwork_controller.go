@@ -0,0 +1,178 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// VirtualNetworkReconciler reconciles a VirtualNetwork object
+type VirtualNetworkReconciler struct {
+	client.Client
+	Scheme    *runtime.Scheme
+	Threads   int
+	Log       logr.Logger
+	NewClient metal.ClientFactory
+	// CredentialNamespace holds the secrets referenced by MetalCredentials
+	CredentialNamespace string
+}
+
+//+kubebuilder:rbac:groups=equinix.cattle.io,resources=virtualnetworks,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=equinix.cattle.io,resources=virtualnetworks/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=equinix.cattle.io,resources=virtualnetworks/finalizers,verbs=update
+
+func (r *VirtualNetworkReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("virtualnetwork", req.NamespacedName)
+
+	vn := &equinixv1alpha1.VirtualNetwork{}
+	if err := r.Get(ctx, req.NamespacedName, vn); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "unable to fetch virtual network")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	original := vn.DeepCopy()
+
+	if !vn.ObjectMeta.DeletionTimestamp.IsZero() && vn.Spec.DeletionPolicy == equinixv1alpha1.DeletionPolicyOrphan {
+		// orphaned objects are let go without calling the api, so missing or
+		// rejected credentials do not block the deletion
+		log.Info("orphaning virtual network, leaving equinix metal resources in place")
+		controllerutil.RemoveFinalizer(vn, instanceFinalizer)
+		return ctrl.Result{}, patchObject(ctx, r.Client, original, vn)
+	}
+
+	// mClient contains the new metal client
+	mClient, err := newClient(ctx, r.Client, r.NewClient, vn.Namespace, vn.Spec.Credential, vn.Spec.Secret, r.CredentialNamespace)
+	if setCredentialsCondition(&vn.Status.Conditions, vn.Generation, err) {
+		if updateErr := patchObject(ctx, r.Client, original, vn); updateErr != nil {
+			return ctrl.Result{}, updateErr
+		}
+		original = vn.DeepCopy()
+	}
+	if err != nil {
+		if metal.IsInvalidCredentials(err) {
+			// nothing can be done until the secret is fixed, which requeues the virtual network
+			log.Error(err, "credential secret rejected by equinix metal api", "secret", vn.Spec.Secret)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	if vn.ObjectMeta.DeletionTimestamp.IsZero() && !controllerutil.ContainsFinalizer(vn, instanceFinalizer) {
+		// the finalizer is in place before the vlan is created, the update
+		// triggers the next reconcile
+		controllerutil.AddFinalizer(vn, instanceFinalizer)
+		return ctrl.Result{}, patchObject(ctx, r.Client, original, vn)
+	}
+
+	if vn.ObjectMeta.DeletionTimestamp.IsZero() {
+		newStatus := &equinixv1alpha1.VirtualNetworkStatus{}
+		switch vn.Status.Status {
+		case "":
+			log.Info("creating virtual network")
+			newStatus, err = mClient.CreateVirtualNetwork(vn)
+		case equinixv1alpha1.VirtualNetworkCreated:
+			return ctrl.Result{}, nil
+		case equinixv1alpha1.VirtualNetworkFailed:
+			// a failure is final for the spec it was reported for, a changed
+			// spec is tried again
+			ready := meta.FindStatusCondition(vn.Status.Conditions, equinixv1alpha1.ConditionReady)
+			if ready == nil || ready.ObservedGeneration >= vn.Generation {
+				log.Info("virtual network creation failed", "reason", vn.Status.FailureReason, "message", vn.Status.FailureMessage)
+				return ctrl.Result{}, nil
+			}
+			log.Info("retrying virtual network creation after a spec change")
+			newStatus, err = mClient.CreateVirtualNetwork(vn)
+		}
+
+		if err != nil {
+			if newStatus != nil {
+				vn.Status = *newStatus
+				if updateErr := patchObject(ctx, r.Client, original, vn); updateErr != nil {
+					log.Error(updateErr, "unable to record virtual network conditions")
+				}
+			}
+			return handleMetalError(log, err)
+		}
+
+		vn.Status = *newStatus
+	} else {
+		// delete the vlan unless it is retained, it stays until no device
+		// port has it assigned
+		log.Info("cleaning up virtual network")
+		err = mClient.DeleteVirtualNetwork(vn)
+		if err != nil {
+			return handleMetalError(log, err)
+		}
+		controllerutil.RemoveFinalizer(vn, instanceFinalizer)
+	}
+
+	return ctrl.Result{}, patchObject(ctx, r.Client, original, vn)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *VirtualNetworkReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.NewClient == nil {
+		r.NewClient = metal.NewProvider
+	}
+	err := indexCredentials(mgr, &equinixv1alpha1.VirtualNetwork{}, func(obj client.Object) (string, string) {
+		vn := obj.(*equinixv1alpha1.VirtualNetwork)
+		return vn.Spec.Credential, vn.Spec.Secret
+	})
+	if err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: r.Threads,
+		}).
+		For(&equinixv1alpha1.VirtualNetwork{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.virtualNetworksForSecret)).
+		Watches(&source.Kind{Type: &equinixv1alpha1.MetalCredential{}}, handler.EnqueueRequestsFromMapFunc(r.virtualNetworksForCredential)).
+		Complete(r)
+}
+
+// virtualNetworksForSecret requeues the virtual networks using a credential secret when it changes
+func (r *VirtualNetworkReconciler) virtualNetworksForSecret(secret client.Object) []reconcile.Request {
+	return requestsForSecret(r.Client, r.Log, r.CredentialNamespace, func() client.ObjectList {
+		return &equinixv1alpha1.VirtualNetworkList{}
+	}, secret)
+}
+
+// virtualNetworksForCredential requeues the virtual networks using a MetalCredential when it changes
+func (r *VirtualNetworkReconciler) virtualNetworksForCredential(credential client.Object) []reconcile.Request {
+	return requestsForCredential(r.Client, r.Log, func() client.ObjectList {
+		return &equinixv1alpha1.VirtualNetworkList{}
+	}, credential)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+)
+
+var _ = Describe("VirtualNetwork controller", func() {
+	It("creates a vlan which instances attach by name", func() {
+		vn := &equinixv1alpha1.VirtualNetwork{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "lab-net",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.VirtualNetworkSpec{
+				Metro:  "sg",
+				Secret: "equinix-metal",
+			},
+		}
+		Expect(k8sClient.Create(ctx, vn)).Should(Succeed())
+
+		vnKey := types.NamespacedName{Name: vn.Name, Namespace: vn.Namespace}
+		fetchedVN := &equinixv1alpha1.VirtualNetwork{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, vnKey, fetchedVN); err != nil {
+				return ""
+			}
+			return fetchedVN.Status.Status
+		}, timeout, interval).Should(Equal(equinixv1alpha1.VirtualNetworkCreated))
+		Expect(fetchedVN.Status.VLANID).ShouldNot(BeEmpty())
+		Expect(fakeProvider.VirtualNetworkExists(fetchedVN.Status.VLANID)).Should(BeTrue())
+
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-virtualnetwork",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+				NetworkType:     "hybrid",
+				VLANAttachments: map[string][]string{"eth1": {vn.Name, "1000"}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		instanceKey := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetchedInstance := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, instanceKey, fetchedInstance); err != nil {
+				return ""
+			}
+			return fetchedInstance.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+		Expect(fetchedInstance.Status.VirtualNetworks).Should(Equal([]equinixv1alpha1.InstanceVirtualNetwork{
+			{Name: vn.Name, VLANID: fetchedVN.Status.VLANID, VXLAN: fetchedVN.Status.VXLAN},
+		}))
+
+		Expect(k8sClient.Delete(ctx, fetchedInstance)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, instanceKey, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, fetchedVN)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, vnKey, &equinixv1alpha1.VirtualNetwork{}) != nil
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeProvider.VirtualNetworkExists(fetchedVN.Status.VLANID)).Should(BeFalse())
+	})
+
+	It("waits for a VirtualNetwork applied after the instance", func() {
+		instance := &equinixv1alpha1.Instance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "instance-virtualnetwork-later",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.InstanceSpec{
+				Plan:            "c3.small.x86",
+				Metro:           "sg",
+				OperatingSystem: "custom_ipxe",
+				BillingCycle:    "hourly",
+				Secret:          "equinix-metal",
+				NetworkType:     "hybrid",
+				VLANAttachments: map[string][]string{"eth1": {"lab-net-later"}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+		instanceKey := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+		fetchedInstance := &equinixv1alpha1.Instance{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, instanceKey, fetchedInstance); err != nil {
+				return ""
+			}
+			condition := meta.FindStatusCondition(fetchedInstance.Status.Conditions, equinixv1alpha1.ConditionNetworkConfigured)
+			if condition == nil {
+				return ""
+			}
+			return condition.Reason
+		}, timeout, interval).Should(Equal("WaitingForVirtualNetwork"))
+		Expect(fetchedInstance.Status.Status).ShouldNot(Equal(equinixv1alpha1.InstanceFailed))
+
+		vn := &equinixv1alpha1.VirtualNetwork{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "lab-net-later",
+				Namespace: "default",
+			},
+			Spec: equinixv1alpha1.VirtualNetworkSpec{
+				Metro:  "sg",
+				Secret: "equinix-metal",
+			},
+		}
+		Expect(k8sClient.Create(ctx, vn)).Should(Succeed())
+
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, instanceKey, fetchedInstance); err != nil {
+				return ""
+			}
+			return fetchedInstance.Status.Status
+		}, timeout, interval).Should(Equal("active"))
+		Expect(fetchedInstance.Status.VirtualNetworks).Should(HaveLen(1))
+
+		Expect(k8sClient.Delete(ctx, fetchedInstance)).Should(Succeed())
+		Eventually(func() bool {
+			return k8sClient.Get(ctx, instanceKey, &equinixv1alpha1.Instance{}) != nil
+		}, timeout, interval).Should(BeTrue())
+		Expect(k8sClient.Delete(ctx, vn)).Should(Succeed())
+	})
+})
@@ -0,0 +1,178 @@
+package metal
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AdoptAnnotation names an existing device for the instance to adopt, the
+// same as setting spec.adoptDeviceID
+const AdoptAnnotation = "adoptDeviceID"
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// AdoptDeviceID returns the device the instance should adopt instead of
+// creating one, spec.adoptDeviceID takes precedence over the annotation
+func AdoptDeviceID(instance *equinixv1alpha1.Instance) string {
+	if instance.Spec.AdoptDeviceID != "" {
+		return instance.Spec.AdoptDeviceID
+	}
+	return instance.Annotations[AdoptAnnotation]
+}
+
+// AdoptDevice brings an existing device of the instance project under
+// management. No elastic ip is reserved, one already attached to the device
+// is reported as the public ip. Active devices are left as they are, devices
+// still provisioning are checked like newly created ones.
+func (m *MetalClient) AdoptDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
+	status = instance.Status.DeepCopy()
+	deviceID := AdoptDeviceID(instance)
+
+	// without the include the project is only a reference lacking the id
+	device, _, err := m.Devices.Get(deviceID, &packngo.GetOptions{Includes: []string{"project"}})
+	if err != nil {
+		if IsNotFound(err) {
+			adoptionFailed(instance, status, "DeviceNotFound", fmt.Sprintf("device %s not found", deviceID))
+			return status, nil
+		}
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionDeviceCreated, err)
+		return status, err
+	}
+
+	project := m.ProjectID
+	if instance.Spec.ProjectID != "" {
+		project = instance.Spec.ProjectID
+	}
+	if device.Project == nil || device.Project.ID != project {
+		adoptionFailed(instance, status, "DeviceNotInProject", fmt.Sprintf("device %s does not belong to project %s", deviceID, project))
+		return status, nil
+	}
+
+	if instance.Annotations == nil {
+		instance.Annotations = make(map[string]string)
+	}
+	for _, network := range device.Network {
+		if network.Public && !network.Management && network.AddressFamily == 4 {
+			instance.Annotations[AddressAnnotation] = network.Address
+		}
+	}
+
+	status.InstanceID = device.ID
+	if device.Facility != nil {
+		status.Facility = device.Facility.Code
+	}
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionDeviceCreated, true, "Adopted",
+		fmt.Sprintf("adopted device %s", device.ID))
+
+	switch device.State {
+	case "active":
+		status.Status = "active"
+		deviceAddresses(instance, status, device)
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, true, "DeviceActive", "adopted device is active")
+	case "queued", "provisioning":
+		now := metav1.Now()
+		status.Status = device.State
+		status.ProvisioningStartTime = &now
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, "Provisioning",
+			fmt.Sprintf("adopted device is %s", device.State))
+	default:
+		adoptionFailed(instance, status, "AdoptionFailed", fmt.Sprintf("device %s is %s", device.ID, device.State))
+	}
+	return status, nil
+}
+
+func adoptionFailed(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, reason string, message string) {
+	status.Status = equinixv1alpha1.InstanceFailed
+	status.FailureReason = reason
+	status.FailureMessage = message
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionDeviceCreated, false, reason, message)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, reason, message)
+}
+
+// DevicesWithTag lists the devices of the project carrying tag, all of them
+// when tag is empty
+func (m *MetalClient) DevicesWithTag(tag string) ([]packngo.Device, error) {
+	opts := &packngo.ListOptions{}
+	if tag != "" {
+		opts.QueryParams = map[string]string{"tag": tag}
+	}
+	devices, _, err := m.Devices.List(m.ProjectID, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var tagged []packngo.Device
+	for _, device := range devices {
+		if tag == "" || hasTag(device.Tags, tag) {
+			tagged = append(tagged, device)
+		}
+	}
+	return tagged, nil
+}
+
+// userTags drops the tags the operator adds to resources it created
+func userTags(tags []string) (user []string) {
+	for _, tag := range tags {
+		if !IsOwnerTag(tag) && !strings.HasPrefix(tag, uidTagPrefix) && tag != ReleasedTag {
+			user = append(user, tag)
+		}
+	}
+	return user
+}
+
+// InstanceForDevice returns an Instance adopting device, with the spec filled
+// in from the device so the manifest documents what is running
+func InstanceForDevice(device *packngo.Device) *equinixv1alpha1.Instance {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(device.Hostname), "-"), "-")
+	if name == "" {
+		name = device.ID
+	}
+
+	instance := &equinixv1alpha1.Instance{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: equinixv1alpha1.GroupVersion.String(),
+			Kind:       "Instance",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: equinixv1alpha1.InstanceSpec{
+			AdoptDeviceID: device.ID,
+			BillingCycle:  device.BillingCycle,
+			Tags:          userTags(device.Tags),
+			UserData:      device.UserData,
+			IPXEScriptURL: device.IPXEScriptURL,
+			AlwaysPXE:     device.AlwaysPXE,
+			SpotInstance:  device.SpotInstance,
+			NetworkType:   device.GetNetworkType(),
+		},
+	}
+	if device.Plan != nil {
+		instance.Spec.Plan = device.Plan.Slug
+	}
+	if device.OS != nil {
+		instance.Spec.OperatingSystem = device.OS.Slug
+	}
+	switch {
+	case device.Metro != nil && device.Metro.Code != "":
+		instance.Spec.Metro = device.Metro.Code
+	case device.Facility != nil:
+		instance.Spec.Facility = []string{device.Facility.Code}
+	}
+	if device.Description != nil {
+		instance.Spec.Description = *device.Description
+	}
+	if device.HardwareReservation != nil {
+		instance.Spec.HardwareReservationID = device.HardwareReservation.ID
+	}
+	if len(device.CustomData) > 0 {
+		if customData, err := json.Marshal(device.CustomData); err == nil {
+			instance.Spec.CustomData = string(customData)
+		}
+	}
+	return instance
+}
@@ -0,0 +1,117 @@
+package metal
+
+import (
+	"testing"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+)
+
+// createDevice creates a device outside of any instance, like hardware
+// launched from the console
+func createDevice(t *testing.T, m *MetalClient, projectID string, hostname string, tags ...string) *packngo.Device {
+	t.Helper()
+	device, _, err := m.Devices.Create(&packngo.DeviceCreateRequest{
+		Hostname:     hostname,
+		Plan:         "c3.small.x86",
+		OS:           "ubuntu_20_04",
+		Metro:        "sg",
+		BillingCycle: "hourly",
+		ProjectID:    projectID,
+		Tags:         tags,
+	})
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	return device
+}
+
+func TestAdoptDevice(t *testing.T) {
+	m, server := newTestClient(t)
+	device := createDevice(t, m, testProject, "lab-1")
+	server.SetDeviceState(device.ID, "active")
+
+	instance := newTestInstance()
+	instance.Annotations = map[string]string{AdoptAnnotation: device.ID}
+	status, err := m.AdoptDevice(instance)
+	if err != nil {
+		t.Fatalf("error adopting device: %v", err)
+	}
+	if status.Status != "active" || status.InstanceID != device.ID || status.PublicIP == "" {
+		t.Fatalf("expected device %s to be adopted as active, got %+v", device.ID, status)
+	}
+	if _, ok := instance.Annotations[ReservationAnnotation]; ok {
+		t.Errorf("adopting should not reserve an elastic ip")
+	}
+}
+
+func TestAdoptDeviceProvisioning(t *testing.T) {
+	m, _ := newTestClient(t)
+	device := createDevice(t, m, testProject, "lab-1")
+
+	instance := newTestInstance()
+	instance.Spec.AdoptDeviceID = device.ID
+	status, err := m.AdoptDevice(instance)
+	if err != nil {
+		t.Fatalf("error adopting device: %v", err)
+	}
+	instance.Status = *status
+	if status.Status != "provisioning" || status.ProvisioningStartTime == nil {
+		t.Fatalf("expected the adopted device to be provisioning, got %q", status.Status)
+	}
+
+	// the device has no elastic ip, checking it should not try to attach one
+	for i := 0; i < 5 && instance.Status.Status != "active"; i++ {
+		status, err = m.CheckDeviceStatus(instance)
+		if err != nil {
+			t.Fatalf("error checking device status: %v", err)
+		}
+		instance.Status = *status
+	}
+	if instance.Status.Status != "active" {
+		t.Fatalf("expected adopted device to become active, got %q", instance.Status.Status)
+	}
+}
+
+func TestAdoptDeviceFailures(t *testing.T) {
+	m, _ := newTestClient(t)
+	other := createDevice(t, m, "project-other", "elsewhere")
+
+	tests := map[string]string{
+		"device-missing": "DeviceNotFound",
+		other.ID:         "DeviceNotInProject",
+	}
+	for deviceID, reason := range tests {
+		instance := newTestInstance()
+		instance.Spec.AdoptDeviceID = deviceID
+		status, err := m.AdoptDevice(instance)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if status.Status != equinixv1alpha1.InstanceFailed || status.FailureReason != reason {
+			t.Errorf("adopting %s: expected failure %s, got status %q reason %q", deviceID, reason, status.Status, status.FailureReason)
+		}
+	}
+}
+
+func TestDevicesWithTag(t *testing.T) {
+	m, _ := newTestClient(t)
+	createDevice(t, m, testProject, "Lab_1.example", "lab")
+	createDevice(t, m, testProject, "untagged")
+
+	devices, err := m.DevicesWithTag("lab")
+	if err != nil {
+		t.Fatalf("error listing devices: %v", err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("expected one tagged device, got %d", len(devices))
+	}
+
+	instance := InstanceForDevice(&devices[0])
+	if instance.Name != "lab-1-example" {
+		t.Errorf("expected a valid object name, got %q", instance.Name)
+	}
+	if instance.Spec.AdoptDeviceID != devices[0].ID || instance.Spec.Plan != "c3.small.x86" || instance.Spec.Metro != "sg" {
+		t.Errorf("unexpected spec %+v", instance.Spec)
+	}
+}
@@ -0,0 +1,73 @@
+package metal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ClientCache hands out one MetalClient per credential secret instead of
+// building a new one on every reconcile. Clients are keyed by the secret
+// resourceVersion, so rotating the secret replaces the client and validates
+// the new token once.
+type ClientCache struct {
+	mu      sync.Mutex
+	clients map[Credentials]*cachedClient
+}
+
+type cachedClient struct {
+	resourceVersion string
+	client          *MetalClient
+	// err is the result of validating the credentials
+	err error
+}
+
+// NewClientCache returns an empty ClientCache
+func NewClientCache() *ClientCache {
+	return &ClientCache{
+		clients: make(map[Credentials]*cachedClient),
+	}
+}
+
+// NewClient satisfies ClientFactory. Secrets rejected by the api return a
+// CredentialsError until they are updated.
+func (c *ClientCache) NewClient(ctx context.Context, kubeClient client.Client, creds Credentials) (Provider, error) {
+	credSecret := &corev1.Secret{}
+	if err := kubeClient.Get(ctx, types.NamespacedName{Name: creds.Secret, Namespace: creds.Namespace}, credSecret); err != nil {
+		return nil, errors.Wrap(err, "error during credential secret lookup")
+	}
+
+	c.mu.Lock()
+	cached, ok := c.clients[creds]
+	c.mu.Unlock()
+	if ok && cached.resourceVersion == credSecret.ResourceVersion {
+		if cached.err != nil {
+			return nil, cached.err
+		}
+		return cached.client, nil
+	}
+
+	m, err := clientFromSecret(credSecret, creds.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.ValidateCredentials()
+	if err != nil && !IsInvalidCredentials(err) {
+		// the api could not be reached, validate again on the next call
+		return nil, errors.Wrap(err, "error validating credentials")
+	}
+
+	c.mu.Lock()
+	c.clients[creds] = &cachedClient{resourceVersion: credSecret.ResourceVersion, client: m, err: err}
+	c.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
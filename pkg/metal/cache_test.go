@@ -0,0 +1,84 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hobbyfarm/metal-operator/pkg/metal/fakeapi"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestClientCache(t *testing.T) {
+	server := fakeapi.NewServer()
+	server.Token = "token"
+	defer server.Close()
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "equinix-metal", Namespace: "default"},
+		Data: map[string][]byte{
+			"PACKET_AUTH_TOKEN": []byte("token"),
+			"PROJECT_ID":        []byte(testProject),
+			"PACKET_API_URL":    []byte(server.BaseURL()),
+		},
+	}
+	ctx := context.Background()
+	kubeClient := fake.NewClientBuilder().WithObjects(secret).Build()
+	cache := NewClientCache()
+	creds := Credentials{Secret: secret.Name, Namespace: secret.Namespace}
+
+	first, err := cache.NewClient(ctx, kubeClient, creds)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	second, err := cache.NewClient(ctx, kubeClient, creds)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	if first != second {
+		t.Errorf("expected the cached client to be reused")
+	}
+
+	// rotating to a token the api rejects replaces the client and fails validation
+	secret.Data["PACKET_AUTH_TOKEN"] = []byte("revoked")
+	if err := kubeClient.Update(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.NewClient(ctx, kubeClient, creds)
+	if !IsInvalidCredentials(err) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+
+	// the result is kept until the secret changes again
+	server.Token = "revoked"
+	_, err = cache.NewClient(ctx, kubeClient, creds)
+	if !IsInvalidCredentials(err) {
+		t.Errorf("expected cached validation result, got %v", err)
+	}
+
+	secret.Data["PACKET_AUTH_TOKEN"] = []byte("revoked")
+	secret.Labels = map[string]string{"rotated": "true"}
+	if err := kubeClient.Update(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	third, err := cache.NewClient(ctx, kubeClient, creds)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	if third == first {
+		t.Errorf("expected a new client after the secret changed")
+	}
+
+	// the rotated tokens share the limiter of the secret
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	if _, ok := limiters["default/equinix-metal"]; !ok {
+		t.Errorf("expected a limiter for the secret")
+	}
+	for _, token := range []string{"token", "revoked"} {
+		if _, ok := limiters[token]; ok {
+			t.Errorf("expected no limiter keyed by token %s", token)
+		}
+	}
+}
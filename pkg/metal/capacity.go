@@ -0,0 +1,81 @@
+package metal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+const (
+	minCapacityRetryInterval = 30 * time.Second
+	maxCapacityRetryInterval = 10 * time.Minute
+)
+
+// capacityAvailable asks the capacity api if the plan can be provisioned in the
+// location the next device is created in. Hardware reservations and instances
+// without a location are not checked. Failing checks are not treated as
+// unavailable, the create call reports the actual problem.
+func (m *MetalClient) capacityAvailable(instance *equinixv1alpha1.Instance) (available bool, location string) {
+	if instance.Spec.HardwareReservationID != "" {
+		return true, ""
+	}
+
+	metro, facilities := deviceLocation(instance)
+	input := &packngo.CapacityInput{}
+	var err error
+	switch {
+	case len(facilities) > 0:
+		location = strings.Join(facilities, ", ")
+		for _, facility := range facilities {
+			input.Servers = append(input.Servers, packngo.ServerInfo{Facility: facility, Plan: instance.Spec.Plan, Quantity: 1})
+		}
+		input, _, err = m.CapacityService.Check(input)
+	case metro != "":
+		location = metro
+		input.Servers = []packngo.ServerInfo{{Metro: metro, Plan: instance.Spec.Plan, Quantity: 1}}
+		input, _, err = m.CapacityService.CheckMetros(input)
+	default:
+		return true, ""
+	}
+
+	if err != nil || input == nil || len(input.Servers) == 0 {
+		return true, location
+	}
+	for _, server := range input.Servers {
+		if server.Available {
+			return true, location
+		}
+	}
+	return false, location
+}
+
+// CapacityRetryInterval returns how long to wait before checking capacity
+// again. The interval doubles with the time spent waiting, between 30s and 10m.
+func CapacityRetryInterval(status *equinixv1alpha1.InstanceStatus) time.Duration {
+	condition := meta.FindStatusCondition(status.Conditions, equinixv1alpha1.ConditionCapacityAvailable)
+	if condition == nil {
+		return minCapacityRetryInterval
+	}
+
+	return growingInterval(condition.LastTransitionTime.Time, minCapacityRetryInterval, maxCapacityRetryInterval)
+}
+
+// waitForCapacity moves the instance to the next fallback location or holds
+// it in waitingforcapacity until the plan becomes available
+func waitForCapacity(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, location string) {
+	message := fmt.Sprintf("no capacity for %s in %s", instance.Spec.Plan, location)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionCapacityAvailable, false, "CapacityUnavailable", message)
+
+	if next, ok := nextLocation(instance); ok {
+		moveToLocation(instance, status, next, "CapacityUnavailable", message)
+		return
+	}
+
+	status.Status = equinixv1alpha1.InstanceWaitingForCapacity
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionDeviceCreated, false, "WaitingForCapacity", message)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, "WaitingForCapacity", message)
+}
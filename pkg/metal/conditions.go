@@ -0,0 +1,33 @@
+package metal
+
+import (
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SetCondition records a condition on the instance status. The transition
+// time only changes when the condition status flips.
+func SetCondition(status *equinixv1alpha1.InstanceStatus, generation int64, conditionType string, ok bool, reason string, message string) {
+	setCondition(&status.Conditions, generation, conditionType, ok, reason, message)
+}
+
+// setErrorCondition marks conditionType as false using the api error as reason and message
+func setErrorCondition(status *equinixv1alpha1.InstanceStatus, generation int64, conditionType string, err error) {
+	SetCondition(status, generation, conditionType, false, ErrorReason(err), err.Error())
+}
+
+func setCondition(conditions *[]metav1.Condition, generation int64, conditionType string, ok bool, reason string, message string) {
+	conditionStatus := metav1.ConditionFalse
+	if ok {
+		conditionStatus = metav1.ConditionTrue
+	}
+
+	meta.SetStatusCondition(conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
@@ -0,0 +1,55 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Credentials identifies the secret a client is built from
+type Credentials struct {
+	Secret    string
+	Namespace string
+	// ProjectID replaces PROJECT_ID from the secret when set
+	ProjectID string
+}
+
+// ResolveCredentials returns the credentials for an object in namespace. A
+// MetalCredential takes precedence and points at a secret in
+// credentialNamespace, otherwise the secret is looked up in the object namespace.
+func ResolveCredentials(ctx context.Context, kubeClient client.Client, namespace string, credential string, secret string,
+	credentialNamespace string) (Credentials, error) {
+	if credential == "" {
+		if secret == "" {
+			return Credentials{}, &CredentialsError{Reason: "NoCredentials",
+				Err: fmt.Errorf("neither a credential nor a credential secret is set")}
+		}
+		return Credentials{Secret: secret, Namespace: namespace}, nil
+	}
+
+	metalCredential := &equinixv1alpha1.MetalCredential{}
+	err := kubeClient.Get(ctx, types.NamespacedName{Name: credential}, metalCredential)
+	if apierrors.IsNotFound(err) {
+		return Credentials{}, &CredentialsError{Reason: "CredentialNotFound",
+			Err: fmt.Errorf("metal credential %s not found", credential)}
+	}
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "error during metal credential lookup")
+	}
+
+	if !metalCredential.AllowsNamespace(namespace) {
+		return Credentials{}, &CredentialsError{Reason: "NamespaceNotAllowed",
+			Err: fmt.Errorf("namespace %s may not use metal credential %s", namespace, credential)}
+	}
+
+	return Credentials{
+		Secret:    metalCredential.Spec.Secret,
+		Namespace: credentialNamespace,
+		ProjectID: metalCredential.Spec.ProjectID,
+	}, nil
+}
@@ -0,0 +1,68 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestResolveCredentials(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := equinixv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&equinixv1alpha1.MetalCredential{
+			ObjectMeta: metav1.ObjectMeta{Name: "labs"},
+			Spec: equinixv1alpha1.MetalCredentialSpec{
+				Secret:            "equinix-metal",
+				ProjectID:         "project-labs",
+				AllowedNamespaces: []string{"lab-1"},
+			},
+		},
+		&equinixv1alpha1.MetalCredential{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared"},
+			Spec:       equinixv1alpha1.MetalCredentialSpec{Secret: "equinix-shared", AllowedNamespaces: []string{"*"}},
+		},
+	).Build()
+
+	tests := []struct {
+		name       string
+		namespace  string
+		credential string
+		secret     string
+		expected   Credentials
+		reason     string
+	}{
+		{name: "secret", namespace: "lab-1", secret: "local", expected: Credentials{Secret: "local", Namespace: "lab-1"}},
+		{name: "credential", namespace: "lab-1", credential: "labs", secret: "local",
+			expected: Credentials{Secret: "equinix-metal", Namespace: "metal-operator", ProjectID: "project-labs"}},
+		{name: "wildcard", namespace: "lab-2", credential: "shared",
+			expected: Credentials{Secret: "equinix-shared", Namespace: "metal-operator"}},
+		{name: "namespace not allowed", namespace: "lab-2", credential: "labs", reason: "NamespaceNotAllowed"},
+		{name: "missing credential", namespace: "lab-1", credential: "missing", reason: "CredentialNotFound"},
+		{name: "nothing set", namespace: "lab-1", reason: "NoCredentials"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := ResolveCredentials(context.Background(), kubeClient, tt.namespace, tt.credential, tt.secret, "metal-operator")
+			if tt.reason != "" {
+				if !IsInvalidCredentials(err) || ErrorReason(err) != tt.reason {
+					t.Fatalf("expected invalid credentials with reason %s, got %v", tt.reason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if creds != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, creds)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package metal
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DeviceGeneration returns the generation of the spec the current device was
+// created or adopted from, spec changes made while it was provisioning are
+// applied once it is active
+func DeviceGeneration(status *equinixv1alpha1.InstanceStatus, generation int64) int64 {
+	condition := meta.FindStatusCondition(status.Conditions, equinixv1alpha1.ConditionDeviceCreated)
+	if condition == nil || condition.Status != metav1.ConditionTrue {
+		return generation
+	}
+	return condition.ObservedGeneration
+}
+
+// UpdateDevice applies spec changes to the device of an active instance.
+// Description, tags, userdata, customdata, alwaysPxe, ipxeScriptUrl and the
+// vlan attachments are updated in place. Plan, operating system and metro can not be changed on a
+// running device, the SpecDrift condition reports them until the instance is
+// recreated or the spec is changed back.
+func (m *MetalClient) UpdateDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
+	status = instance.Status.DeepCopy()
+	device, _, err := m.Devices.Get(instance.Status.InstanceID, portIncludes)
+	if err != nil {
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionSpecDrift, err)
+		return status, errors.Wrap(err, "error looking up device")
+	}
+
+	if update, changed := deviceUpdate(instance, device); len(changed) > 0 {
+		_, _, err = m.Devices.Update(device.ID, update)
+		if err != nil {
+			setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionSpecDrift, err)
+			return status, errors.Wrapf(err, "error updating %s of device", strings.Join(changed, ", "))
+		}
+	}
+
+	if instance.Spec.NetworkType != "" {
+		// a changed network type converts the ports of the running device, vlans
+		// no longer listed go first and new ones are assigned once converted
+		converted := device.GetNetworkType() != portsNetworkType(instance.Spec.NetworkType)
+		err = m.recordNetwork(status, device.ID, m.UpdateNetworkConfig(instance, device))
+		// the device holds the state reached, also after a failed step
+		deviceAddresses(instance, status, device)
+		if err != nil {
+			setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionNetworkConfigured, err)
+			return status, err
+		}
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionNetworkConfigured, true, "Configured",
+			fmt.Sprintf("network type is %s", instance.Spec.NetworkType))
+
+		if converted && device.HasManagementIPs() {
+			// back in layer3 the elastic ip is routed to bond0 again
+			err = m.checkAndAttachElasticIP(instance, device)
+			if err != nil {
+				setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, err)
+				return status, err
+			}
+		}
+	}
+
+	if drift := immutableDrift(instance, device); len(drift) > 0 {
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionSpecDrift, true, "ImmutableFieldChanged",
+			fmt.Sprintf("%s; these can not be changed on a running device, recreate the instance to apply them", strings.Join(drift, ", ")))
+		return status, nil
+	}
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionSpecDrift, false, "InSync", "device matches the spec")
+	return status, nil
+}
+
+// deviceUpdate returns the update request for the mutable fields which differ
+// between spec and device along with their names. Adopted devices were not
+// created from the spec, fields left empty there keep the value of the device.
+func deviceUpdate(instance *equinixv1alpha1.Instance, device *packngo.Device) (update *packngo.DeviceUpdateRequest, changed []string) {
+	update = &packngo.DeviceUpdateRequest{}
+	spec := instance.Spec
+	adopted := AdoptDeviceID(instance) != ""
+
+	var description string
+	if device.Description != nil {
+		description = *device.Description
+	}
+	if spec.Description != description && !(adopted && spec.Description == "") {
+		update.Description = &spec.Description
+		changed = append(changed, "description")
+	}
+
+	if tags := deviceTags(instance, device.Tags); !sameTags(tags, device.Tags) && !(adopted && len(spec.Tags) == 0) {
+		update.Tags = &tags
+		changed = append(changed, "tags")
+	}
+	if spec.UserData != device.UserData && !(adopted && spec.UserData == "") {
+		update.UserData = &spec.UserData
+		changed = append(changed, "userdata")
+	}
+	if !sameCustomData(spec.CustomData, device.CustomData) && !(adopted && spec.CustomData == "") {
+		customData := spec.CustomData
+		if customData == "" {
+			customData = "{}"
+		}
+		update.CustomData = &customData
+		changed = append(changed, "customData")
+	}
+	if spec.AlwaysPXE != device.AlwaysPXE {
+		update.AlwaysPXE = &spec.AlwaysPXE
+		changed = append(changed, "alwaysPxe")
+	}
+	if spec.IPXEScriptURL != device.IPXEScriptURL && !(adopted && spec.IPXEScriptURL == "") {
+		update.IPXEScriptURL = &spec.IPXEScriptURL
+		changed = append(changed, "ipxeScriptUrl")
+	}
+	return update, changed
+}
+
+// deviceTags returns the spec tags along with the owner and uid tags the
+// operator keeps on the device
+func deviceTags(instance *equinixv1alpha1.Instance, current []string) []string {
+	var tags []string
+	for _, tag := range current {
+		if IsOwnerTag(tag) || strings.HasPrefix(tag, uidTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
+	for _, tag := range instance.Spec.Tags {
+		if !hasTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func sameTags(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
+
+// sameCustomData compares the json customdata of the spec with the object
+// returned for the device. Invalid json is sent on for the api to reject.
+func sameCustomData(spec string, device map[string]interface{}) bool {
+	if spec == "" {
+		return len(device) == 0
+	}
+	desired := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(spec), &desired); err != nil {
+		return false
+	}
+	if len(desired) == 0 && len(device) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(desired, device)
+}
+
+// immutableDrift describes the plan, operating system and metro changes
+// between the spec and the device
+func immutableDrift(instance *equinixv1alpha1.Instance, device *packngo.Device) (drift []string) {
+	changed := func(field string, current string, desired string) {
+		if desired != "" && current != desired {
+			drift = append(drift, fmt.Sprintf("%s changed from %s to %s", field, current, desired))
+		}
+	}
+
+	if device.Plan != nil {
+		changed("plan", device.Plan.Slug, instance.Spec.Plan)
+	}
+	if device.OS != nil {
+		changed("operatingSystem", device.OS.Slug, instance.Spec.OperatingSystem)
+	}
+	// fallback locations move the device on purpose, only the metro in use counts
+	if metro, _ := deviceLocation(instance); device.Metro != nil {
+		changed("metro", device.Metro.Code, metro)
+	}
+	return drift
+}
@@ -0,0 +1,257 @@
+package metal
+
+import (
+	"strings"
+	"testing"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/metal-operator/pkg/metal/fakeapi"
+	"github.com/packethost/packngo"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+func TestUpdateDevice(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.Tags = []string{"lab"}
+	provision(t, m, instance)
+
+	instance.Spec.Tags = []string{"lab", "course-1"}
+	instance.Spec.Description = "lab machine"
+	instance.Spec.CustomData = `{"course":"1"}`
+	instance.Spec.AlwaysPXE = true
+	instance.Spec.IPXEScriptURL = "http://example.com/boot.ipxe"
+	instance.Spec.UserData = "#cloud-config"
+	status, err := m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("error updating device: %v", err)
+	}
+	condition := meta.FindStatusCondition(status.Conditions, equinixv1alpha1.ConditionSpecDrift)
+	if condition == nil || condition.Status != "False" {
+		t.Errorf("expected SpecDrift to be false, got %v", condition)
+	}
+
+	device, _ := server.Device(instance.Status.InstanceID)
+	if device.Description == nil || *device.Description != "lab machine" {
+		t.Errorf("expected description to be updated, got %v", device.Description)
+	}
+	if !hasTag(device.Tags, "course-1") || !hasTag(device.Tags, uidTag(instance)) ||
+		!hasTag(device.Tags, OwnerTag("Instance", instance.Namespace, instance.Name)) {
+		t.Errorf("expected spec tags next to the operator tags, got %v", device.Tags)
+	}
+	if device.CustomData["course"] != "1" || !device.AlwaysPXE || device.IPXEScriptURL != instance.Spec.IPXEScriptURL ||
+		device.UserData != instance.Spec.UserData {
+		t.Errorf("expected customdata, alwaysPxe, ipxeScriptUrl and userdata to be updated, got %+v", device)
+	}
+
+	if _, changed := deviceUpdate(instance, device); len(changed) != 0 {
+		t.Errorf("expected no changes left, got %v", changed)
+	}
+}
+
+func TestUpdateDeviceImmutable(t *testing.T) {
+	m, _ := newTestClient(t)
+	instance := newTestInstance()
+	provision(t, m, instance)
+
+	instance.Spec.Plan = "m3.large.x86"
+	instance.Spec.Metro = "da"
+	status, err := m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("error updating device: %v", err)
+	}
+	condition := meta.FindStatusCondition(status.Conditions, equinixv1alpha1.ConditionSpecDrift)
+	if condition == nil || condition.Status != "True" || condition.Reason != "ImmutableFieldChanged" {
+		t.Fatalf("expected SpecDrift to be true, got %v", condition)
+	}
+	if !strings.Contains(condition.Message, "plan changed from c3.small.x86 to m3.large.x86") ||
+		!strings.Contains(condition.Message, "metro changed from sg to da") {
+		t.Errorf("expected plan and metro in the message, got %s", condition.Message)
+	}
+
+	instance.Spec.Plan = "c3.small.x86"
+	instance.Spec.Metro = "sg"
+	instance.Status = *status
+	status, err = m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("error updating device: %v", err)
+	}
+	if meta.IsStatusConditionTrue(status.Conditions, equinixv1alpha1.ConditionSpecDrift) {
+		t.Errorf("expected SpecDrift to clear once the spec is changed back")
+	}
+}
+
+func TestUpdateDeviceNetworkType(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.NetworkType = packngo.NetworkTypeL3
+	provision(t, m, instance)
+
+	instance.Spec.NetworkType = packngo.NetworkTypeHybrid
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {"1000"}}
+	if !StartNetworkChange(instance, &instance.Status) {
+		t.Fatal("expected the network change to start")
+	}
+	condition := meta.FindStatusCondition(instance.Status.Conditions, equinixv1alpha1.ConditionNetworkConfigured)
+	if condition == nil || condition.Reason != "Converting" || condition.Message != "converting network from layer3 to hybrid" {
+		t.Fatalf("expected NetworkConfigured to show the conversion, got %v", condition)
+	}
+
+	status, err := m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("error updating device: %v", err)
+	}
+	if !meta.IsStatusConditionTrue(status.Conditions, equinixv1alpha1.ConditionNetworkConfigured) {
+		t.Errorf("expected NetworkConfigured to be true, got %v", status.Conditions)
+	}
+	if status.Network == nil || status.Network.Type != packngo.NetworkTypeHybrid {
+		t.Errorf("expected the hybrid network in the status, got %+v", status.Network)
+	}
+	device, _ := server.Device(instance.Status.InstanceID)
+	if !device.HasManagementIPs() {
+		t.Error("expected the management addresses to be kept in hybrid")
+	}
+	if got := portVLANs(t, server, device.ID, "eth1"); len(got) != 1 || got[0] != "1000" {
+		t.Fatalf("expected vlan 1000 on eth1, got %v", got)
+	}
+
+	instance.Status = *status
+	instance.Spec.NetworkType = packngo.NetworkTypeL3
+	instance.Spec.VLANAttachments = nil
+	status, err = m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("error updating device: %v", err)
+	}
+	if status.Network == nil || status.Network.Type != packngo.NetworkTypeL3 {
+		t.Errorf("expected the layer3 network in the status, got %+v", status.Network)
+	}
+	if got := portVLANs(t, server, device.ID, "eth1"); len(got) != 0 {
+		t.Fatalf("expected no vlans on eth1, got %v", got)
+	}
+
+	instance.Status = *status
+	if StartNetworkChange(instance, &instance.Status) {
+		t.Error("expected no network change once converted")
+	}
+}
+
+func TestUpdateDeviceNetworkTypeAddresses(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.NetworkType = packngo.NetworkTypeL3
+	provision(t, m, instance)
+	layer3Address := instance.Status.PrivateIP
+	if layer3Address == "" {
+		t.Fatal("expected the management address in the status")
+	}
+
+	// layer2 ports have no management addresses
+	instance.Spec.NetworkType = packngo.NetworkTypeL2Bonded
+	status, err := m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("error updating device: %v", err)
+	}
+	if status.PrivateIP != "" {
+		t.Errorf("expected no management address in layer2, got %s", status.PrivateIP)
+	}
+	if status.PublicIP != instance.Annotations[AddressAnnotation] {
+		t.Errorf("expected the elastic ip %s as public ip, got %s", instance.Annotations[AddressAnnotation], status.PublicIP)
+	}
+
+	// back in layer3 the device gets new ones
+	instance.Status = *status
+	instance.Spec.NetworkType = packngo.NetworkTypeL3
+	status, err = m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("error updating device: %v", err)
+	}
+	device, _ := server.Device(instance.Status.InstanceID)
+	if address := device.GetNetworkInfo().PublicIPv4; status.PrivateIP != address || address == layer3Address {
+		t.Errorf("expected the new management address %s, got %s", address, status.PrivateIP)
+	}
+}
+
+func TestUpdateDeviceNetworkTypeFailed(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.NetworkType = packngo.NetworkTypeL3
+	provision(t, m, instance)
+
+	device, _ := server.Device(instance.Status.InstanceID)
+	eth1, _ := device.GetPortByName("eth1")
+	server.AddFault(fakeapi.Fault{Method: "POST", Path: "/ports/" + eth1.ID + "/disbond", Status: 422, Message: "Port is busy", Times: 1})
+
+	instance.Spec.NetworkType = packngo.NetworkTypeHybrid
+	status, err := m.UpdateDevice(instance)
+	if err == nil {
+		t.Fatal("expected the conversion to fail")
+	}
+	condition := meta.FindStatusCondition(status.Conditions, equinixv1alpha1.ConditionNetworkConfigured)
+	if condition == nil || condition.Status != "False" || !strings.Contains(condition.Message, "disbonding eth1") {
+		t.Fatalf("expected NetworkConfigured to name the failed step, got %v", condition)
+	}
+	device, _ = server.Device(instance.Status.InstanceID)
+	if !device.HasManagementIPs() {
+		t.Fatal("expected the management addresses to be kept while converting")
+	}
+
+	instance.Status = *status
+	status, err = m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("error resuming the conversion: %v", err)
+	}
+	if status.Network == nil || status.Network.Type != packngo.NetworkTypeHybrid {
+		t.Errorf("expected the hybrid network in the status, got %+v", status.Network)
+	}
+}
+
+func TestUpdateDeviceAdopted(t *testing.T) {
+	m, server := newTestClient(t)
+	description := "set up by hand"
+	device, _, err := m.Devices.Create(&packngo.DeviceCreateRequest{
+		Hostname:      "lab-1",
+		Plan:          "c3.small.x86",
+		OS:            "ubuntu_20_04",
+		Metro:         "sg",
+		BillingCycle:  "hourly",
+		ProjectID:     testProject,
+		Description:   description,
+		UserData:      "#cloud-config",
+		CustomData:    `{"course":"1"}`,
+		IPXEScriptURL: "http://example.com/boot.ipxe",
+		Tags:          []string{"lab"},
+	})
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	server.SetDeviceState(device.ID, "active")
+
+	// adopted by a hand written manifest leaving the mutable fields out
+	instance := newTestInstance()
+	instance.Spec.AdoptDeviceID = device.ID
+	instance.Spec.Plan = "c3.small.x86"
+	instance.Spec.OperatingSystem = "ubuntu_20_04"
+	status, err := m.AdoptDevice(instance)
+	if err != nil {
+		t.Fatalf("error adopting device: %v", err)
+	}
+	instance.Status = *status
+
+	instance.Spec.AlwaysPXE = true
+	if _, err := m.UpdateDevice(instance); err != nil {
+		t.Fatalf("error updating device: %v", err)
+	}
+	device, _ = server.Device(device.ID)
+	if !device.AlwaysPXE {
+		t.Errorf("expected alwaysPxe to be updated")
+	}
+	if device.Description == nil || *device.Description != description || device.UserData != "#cloud-config" ||
+		device.CustomData["course"] != "1" || device.IPXEScriptURL != "http://example.com/boot.ipxe" || !hasTag(device.Tags, "lab") {
+		t.Errorf("expected the fields left out of the spec to be kept, got %+v", device)
+	}
+
+	imported := InstanceForDevice(device)
+	if imported.Spec.UserData != "#cloud-config" || imported.Spec.CustomData != `{"course":"1"}` {
+		t.Errorf("expected userdata and customData to be imported, got %+v", imported.Spec)
+	}
+}
@@ -0,0 +1,211 @@
+package metal
+
+import (
+	"fmt"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+)
+
+// elasticIPTag marks reservations made for an ElasticIP resource. It differs
+// from the name-namespace tag of instance reservations so the two never clash.
+func elasticIPTag(eip *equinixv1alpha1.ElasticIP) string {
+	return fmt.Sprintf("elasticip-%s-%s", eip.Name, eip.Namespace)
+}
+
+// CreateElasticIP reserves the addresses requested by an ElasticIP. A
+// reservation already tagged for it is reused, so a retried request does not
+// reserve twice.
+func (m *MetalClient) CreateElasticIP(eip *equinixv1alpha1.ElasticIP) (status *equinixv1alpha1.ElasticIPStatus, err error) {
+	status = eip.Status.DeepCopy()
+	ipReq, err := elasticIPRequest(eip)
+	if err != nil {
+		status.Status = equinixv1alpha1.ElasticIPFailed
+		status.FailureReason = "InvalidSpec"
+		status.FailureMessage = err.Error()
+		setCondition(&status.Conditions, eip.Generation, equinixv1alpha1.ConditionReady, false, status.FailureReason, status.FailureMessage)
+		return status, nil
+	}
+
+	reservationList, err := m.taggedElasticIPs(eip)
+	if err != nil {
+		setCondition(&status.Conditions, eip.Generation, equinixv1alpha1.ConditionReady, false, ErrorReason(err), err.Error())
+		return status, err
+	}
+
+	var reservation *packngo.IPAddressReservation
+	switch len(reservationList) {
+	case 0:
+		reservation, _, err = m.ProjectIPs.Request(m.elasticIPProject(eip), ipReq)
+		if err != nil {
+			setCondition(&status.Conditions, eip.Generation, equinixv1alpha1.ConditionReady, false, ErrorReason(err), err.Error())
+			return status, err
+		}
+	case 1:
+		reservation = &reservationList[0]
+	default:
+		err = fmt.Errorf("multiple elastic ip reservations found with tag %s", elasticIPTag(eip))
+		setCondition(&status.Conditions, eip.Generation, equinixv1alpha1.ConditionReady, false, "DuplicateReservation", err.Error())
+		return status, err
+	}
+
+	status.Status = equinixv1alpha1.ElasticIPReserved
+	status.ReservationID = reservation.ID
+	status.Address = reservation.Address
+	status.CIDR = reservation.CIDR
+	status.Metro = ""
+	if reservation.Metro != nil {
+		status.Metro = reservation.Metro.Code
+	}
+	setCondition(&status.Conditions, eip.Generation, equinixv1alpha1.ConditionReady, true, "Reserved",
+		fmt.Sprintf("%s/%d reserved", status.Address, status.CIDR))
+	return status, nil
+}
+
+// DeleteElasticIP releases the reservation unless the deletion policy keeps
+// it. Reservations still attached to a device are not released.
+func (m *MetalClient) DeleteElasticIP(eip *equinixv1alpha1.ElasticIP) (err error) {
+	if eip.Spec.DeletionPolicy == equinixv1alpha1.DeletionPolicyOrphan {
+		return nil
+	}
+
+	reservationID := eip.Status.ReservationID
+	if reservationID == "" {
+		// the reservation may have been made without its status being stored,
+		// it is found by its tag
+		reservationList, err := m.taggedElasticIPs(eip)
+		if err != nil {
+			return err
+		}
+		switch len(reservationList) {
+		case 0:
+			return nil
+		case 1:
+			reservationID = reservationList[0].ID
+		default:
+			return fmt.Errorf("multiple elastic ip reservations found with tag %s", elasticIPTag(eip))
+		}
+	}
+	if eip.Spec.DeletionPolicy == equinixv1alpha1.DeletionPolicyRetain {
+		return m.releaseReservation(reservationID)
+	}
+
+	reservation, _, err := m.ProjectIPs.Get(reservationID, nil)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if len(reservation.Assignments) > 0 {
+		return fmt.Errorf("elastic ip %s is still attached to %d device(s)", reservation.Address, len(reservation.Assignments))
+	}
+
+	_, err = m.ProjectIPs.Remove(reservationID)
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// taggedElasticIPs lists the reservations made for an ElasticIP
+func (m *MetalClient) taggedElasticIPs(eip *equinixv1alpha1.ElasticIP) ([]packngo.IPAddressReservation, error) {
+	reservationList, _, err := m.ProjectIPs.List(m.elasticIPProject(eip), &packngo.ListOptions{
+		QueryParams: map[string]string{"tag": elasticIPTag(eip)},
+	})
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	return reservationList, nil
+}
+
+func (m *MetalClient) elasticIPProject(eip *equinixv1alpha1.ElasticIP) string {
+	if eip.Spec.ProjectID != "" {
+		return eip.Spec.ProjectID
+	}
+	return m.ProjectID
+}
+
+// elasticIPRequest turns the ElasticIP spec into a reservation request
+func elasticIPRequest(eip *equinixv1alpha1.ElasticIP) (*packngo.IPReservationRequest, error) {
+	ipType := eip.Spec.Type
+	if ipType == "" {
+		ipType = equinixv1alpha1.ElasticIPPublicIPv4
+	}
+
+	quantity := eip.Spec.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+	if eip.Spec.CIDR > 0 {
+		if ipType == equinixv1alpha1.ElasticIPPublicIPv6 {
+			return nil, fmt.Errorf("cidr is only supported for ipv4 reservations")
+		}
+		quantity = 1 << (32 - eip.Spec.CIDR)
+	}
+
+	ipReq := &packngo.IPReservationRequest{
+		Type:        string(ipType),
+		Quantity:    quantity,
+		Description: fmt.Sprintf("%s/%s", eip.Namespace, eip.Name),
+		Tags:        append([]string{elasticIPTag(eip), OwnerTag("ElasticIP", eip.Namespace, eip.Name)}, eip.Spec.Tags...),
+	}
+
+	switch ipType {
+	case equinixv1alpha1.ElasticIPGlobalIPv4:
+		if eip.Spec.Metro != "" {
+			return nil, fmt.Errorf("global_ipv4 reservations can not be limited to a metro")
+		}
+	case equinixv1alpha1.ElasticIPPublicIPv4, equinixv1alpha1.ElasticIPPublicIPv6:
+		if eip.Spec.Metro == "" {
+			return nil, fmt.Errorf("a metro is required for %s reservations", ipType)
+		}
+		metro := eip.Spec.Metro
+		ipReq.Metro = &metro
+	default:
+		return nil, fmt.Errorf("unsupported elastic ip type %s", ipType)
+	}
+	return ipReq, nil
+}
+
+// UseElasticIP attaches the reservation of an ElasticIP resource to the
+// instance instead of reserving one for it. A reservation in another metro
+// than the device can not be attached and fails the instance.
+func (m *MetalClient) UseElasticIP(instance *equinixv1alpha1.Instance, eip *equinixv1alpha1.ElasticIP) (status *equinixv1alpha1.InstanceStatus, err error) {
+	// facility locations are resolved to their metro
+	metro, err := m.reservationMetro(instance)
+	if err != nil {
+		status = instance.Status.DeepCopy()
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, err)
+		return status, err
+	}
+	return AttachElasticIP(instance, eip, metro), nil
+}
+
+// AttachElasticIP records the reservation of an ElasticIP resource for an
+// instance whose device is created in metro
+func AttachElasticIP(instance *equinixv1alpha1.Instance, eip *equinixv1alpha1.ElasticIP, metro string) (status *equinixv1alpha1.InstanceStatus) {
+	status = instance.Status.DeepCopy()
+	if eip.Status.Metro != "" && metro != "" && eip.Status.Metro != metro {
+		elasticIPMetroMismatch(instance, status, eip.Status.Metro, metro)
+		return status
+	}
+
+	ElasticIPReserved(instance, status, equinixv1alpha1.InstanceElasticIP{
+		ReservationID: eip.Status.ReservationID,
+		Address:       eip.Status.Address,
+		CIDR:          eip.Status.CIDR,
+		Name:          eip.Name,
+	})
+	return status
+}
+
+// elasticIPMetroMismatch fails an instance whose ElasticIP is reserved in
+// another metro than its device
+func elasticIPMetroMismatch(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, reserved string, metro string) {
+	status.Status = equinixv1alpha1.InstanceFailed
+	status.FailureReason = "ElasticIPMetroMismatch"
+	status.FailureMessage = fmt.Sprintf("elastic ip %s is reserved in metro %s, the device is created in %s", instance.Spec.ElasticIP, reserved, metro)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, false, status.FailureReason, status.FailureMessage)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, status.FailureReason, status.FailureMessage)
+}
@@ -0,0 +1,206 @@
+package metal
+
+import (
+	"testing"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestElasticIP(spec equinixv1alpha1.ElasticIPSpec) *equinixv1alpha1.ElasticIP {
+	return &equinixv1alpha1.ElasticIP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "lab-url",
+			Namespace: "default",
+		},
+		Spec: spec,
+	}
+}
+
+func TestCreateElasticIP(t *testing.T) {
+	m, server := newTestClient(t)
+	eip := newTestElasticIP(equinixv1alpha1.ElasticIPSpec{Metro: "sg", CIDR: 30, Tags: []string{"lab"}})
+
+	status, err := m.CreateElasticIP(eip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Status != equinixv1alpha1.ElasticIPReserved || status.CIDR != 30 || status.Metro != "sg" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	reservation, ok := server.Reservation(status.ReservationID)
+	if !ok {
+		t.Fatalf("reservation %s not found", status.ReservationID)
+	}
+	if len(reservation.Tags) != 3 || reservation.Tags[2] != "lab" {
+		t.Fatalf("expected the elastic ip, owner and spec tags, got %v", reservation.Tags)
+	}
+
+	// a retry after losing the status finds the existing reservation
+	again, err := m.CreateElasticIP(eip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again.ReservationID != status.ReservationID {
+		t.Fatalf("expected reservation %s to be reused, got %s", status.ReservationID, again.ReservationID)
+	}
+
+	eip.Status = *status
+	if err := m.DeleteElasticIP(eip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := server.Reservation(status.ReservationID); ok {
+		t.Fatalf("expected reservation %s to be released", status.ReservationID)
+	}
+}
+
+func TestDeleteElasticIPWithoutStatus(t *testing.T) {
+	m, server := newTestClient(t)
+	eip := newTestElasticIP(equinixv1alpha1.ElasticIPSpec{Metro: "sg"})
+
+	status, err := m.CreateElasticIP(eip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// deleted before the status naming the reservation was stored
+	if err := m.DeleteElasticIP(eip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := server.Reservation(status.ReservationID); ok {
+		t.Fatalf("expected reservation %s to be released", status.ReservationID)
+	}
+}
+
+func TestCreateElasticIPTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   equinixv1alpha1.ElasticIPSpec
+		status string
+		cidr   int
+	}{
+		{name: "global", spec: equinixv1alpha1.ElasticIPSpec{Type: equinixv1alpha1.ElasticIPGlobalIPv4}, status: equinixv1alpha1.ElasticIPReserved, cidr: 32},
+		{name: "ipv6", spec: equinixv1alpha1.ElasticIPSpec{Type: equinixv1alpha1.ElasticIPPublicIPv6, Metro: "sg"}, status: equinixv1alpha1.ElasticIPReserved, cidr: 128},
+		{name: "global with metro", spec: equinixv1alpha1.ElasticIPSpec{Type: equinixv1alpha1.ElasticIPGlobalIPv4, Metro: "sg"}, status: equinixv1alpha1.ElasticIPFailed},
+		{name: "public without metro", spec: equinixv1alpha1.ElasticIPSpec{}, status: equinixv1alpha1.ElasticIPFailed},
+		{name: "ipv6 cidr", spec: equinixv1alpha1.ElasticIPSpec{Type: equinixv1alpha1.ElasticIPPublicIPv6, Metro: "sg", CIDR: 64}, status: equinixv1alpha1.ElasticIPFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestClient(t)
+			status, err := m.CreateElasticIP(newTestElasticIP(tt.spec))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status.Status != tt.status {
+				t.Fatalf("expected status %q, got %q (%s)", tt.status, status.Status, status.FailureMessage)
+			}
+			if status.CIDR != tt.cidr {
+				t.Fatalf("expected cidr %d, got %d", tt.cidr, status.CIDR)
+			}
+		})
+	}
+}
+
+func TestDeleteElasticIPRetain(t *testing.T) {
+	m, server := newTestClient(t)
+	eip := newTestElasticIP(equinixv1alpha1.ElasticIPSpec{Metro: "sg", DeletionPolicy: equinixv1alpha1.DeletionPolicyRetain})
+
+	status, err := m.CreateElasticIP(eip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	eip.Status = *status
+	if err := m.DeleteElasticIP(eip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := server.Reservation(status.ReservationID); !ok {
+		t.Fatalf("expected reservation %s to be retained", status.ReservationID)
+	}
+}
+
+func TestUseElasticIPMetroMismatch(t *testing.T) {
+	m, _ := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.ElasticIP = "lab-url"
+	eip := newTestElasticIP(equinixv1alpha1.ElasticIPSpec{Metro: "da"})
+	eip.Status = equinixv1alpha1.ElasticIPStatus{
+		Status:        equinixv1alpha1.ElasticIPReserved,
+		ReservationID: "reservation-1",
+		Address:       "203.0.113.1",
+		CIDR:          32,
+		Metro:         "da",
+	}
+
+	status, err := m.UseElasticIP(instance, eip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Status != equinixv1alpha1.InstanceFailed || status.FailureReason != "ElasticIPMetroMismatch" {
+		t.Fatalf("expected metro mismatch, got status %q reason %q", status.Status, status.FailureReason)
+	}
+
+	// facility locations are compared by their metro
+	instance.Status.Location = "sg2"
+	status, err = m.UseElasticIP(instance, eip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Status != equinixv1alpha1.InstanceFailed || status.FailureReason != "ElasticIPMetroMismatch" {
+		t.Fatalf("expected metro mismatch for facility sg2, got status %q reason %q", status.Status, status.FailureReason)
+	}
+
+	eip.Status.Metro = "sg"
+	status, err = m.UseElasticIP(instance, eip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Status != "patched" || instance.Annotations[AddressAnnotation] != "203.0.113.1" {
+		t.Fatalf("expected the elastic ip to be used, got status %q", status.Status)
+	}
+}
+
+func TestCreateNewDeviceElasticIPFallback(t *testing.T) {
+	m, server := newTestClient(t)
+	eip := newTestElasticIP(equinixv1alpha1.ElasticIPSpec{Metro: "sg"})
+	eipStatus, err := m.CreateElasticIP(eip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	eip.Status = *eipStatus
+
+	instance := newTestInstance()
+	instance.Spec.ElasticIP = eip.Name
+	instance.Spec.FallbackLocations = []string{"sg2", "da11"}
+	status, err := m.UseElasticIP(instance, eip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	instance.Status = *status
+
+	// a facility in the same metro keeps the reservation
+	instance.Status.Location = "sg2"
+	status, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	if status.Status == equinixv1alpha1.InstanceFailed || status.InstanceID == "" {
+		t.Fatalf("expected a device in sg2, got status %q reason %q", status.Status, status.FailureReason)
+	}
+
+	// one in another metro fails the instance instead of starting over
+	instance.Status.Location = "da11"
+	status, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	if status.Status != equinixv1alpha1.InstanceFailed || status.FailureReason != "ElasticIPMetroMismatch" {
+		t.Fatalf("expected metro mismatch, got status %q reason %q", status.Status, status.FailureReason)
+	}
+	if instance.Annotations[ReservationAnnotation] != eipStatus.ReservationID {
+		t.Errorf("expected reservation %s to be kept, got %q", eipStatus.ReservationID, instance.Annotations[ReservationAnnotation])
+	}
+	if _, ok := server.Reservation(eipStatus.ReservationID); !ok {
+		t.Errorf("expected reservation %s of the elastic ip to be kept", eipStatus.ReservationID)
+	}
+}
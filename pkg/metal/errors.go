@@ -0,0 +1,174 @@
+package metal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/packethost/packngo"
+)
+
+// APIError returns the packngo.ErrorResponse wrapped in err, if any
+func APIError(err error) (*packngo.ErrorResponse, bool) {
+	var errResp *packngo.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		return errResp, true
+	}
+	return nil, false
+}
+
+// StatusCode returns the http status of a failed api call or 0 if err did not
+// come from the Equinix Metal api
+func StatusCode(err error) int {
+	errResp, ok := APIError(err)
+	if !ok {
+		return 0
+	}
+	return errResp.Response.StatusCode
+}
+
+// errorMessage joins all messages returned by the api in lower case
+func errorMessage(err error) string {
+	errResp, ok := APIError(err)
+	if !ok {
+		return ""
+	}
+	messages := append([]string{errResp.SingleError}, errResp.Errors...)
+	return strings.ToLower(strings.Join(messages, " "))
+}
+
+func messageContains(err error, substrings ...string) bool {
+	msg := errorMessage(err)
+	for _, s := range substrings {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// CredentialsError is returned when the credentials of an object can not be
+// used, because the api rejected them or the object may not use them
+type CredentialsError struct {
+	// Reason overrides the reason derived from Err
+	Reason string
+	Err    error
+}
+
+func (e *CredentialsError) Error() string {
+	return "invalid credentials: " + e.Err.Error()
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// IsInvalidCredentials is true when the credential secret was rejected by the api
+func IsInvalidCredentials(err error) bool {
+	var credErr *CredentialsError
+	return errors.As(err, &credErr)
+}
+
+// IsNotFound is true when the api reports the resource does not exist
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// IsRateLimited is true when the api rejected the call due to rate limiting
+func IsRateLimited(err error) bool {
+	return StatusCode(err) == http.StatusTooManyRequests
+}
+
+// IsQuotaExceeded is true when the call would exceed a project or organization limit
+func IsQuotaExceeded(err error) bool {
+	switch StatusCode(err) {
+	case http.StatusPaymentRequired, http.StatusForbidden, http.StatusUnprocessableEntity:
+		return messageContains(err, "quota", "limit")
+	}
+	return false
+}
+
+// IsUnauthorized is true when the token is invalid or lacks access to the project
+func IsUnauthorized(err error) bool {
+	switch StatusCode(err) {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusForbidden:
+		return !IsQuotaExceeded(err)
+	}
+	return false
+}
+
+// IsCapacityUnavailable is true when the requested plan can not be provisioned
+// in the requested location right now
+func IsCapacityUnavailable(err error) bool {
+	switch StatusCode(err) {
+	case http.StatusUnprocessableEntity, http.StatusServiceUnavailable:
+		return messageContains(err, "capacity", "no provisionable", "not available", "out of stock")
+	}
+	return false
+}
+
+// IsTerminal is true for errors that will not go away by retrying the same
+// request, such as invalid input or missing permissions. Rate limits, capacity
+// shortages, server side failures and errors that did not come from the api
+// are all worth retrying.
+func IsTerminal(err error) bool {
+	if IsRateLimited(err) || IsCapacityUnavailable(err) {
+		return false
+	}
+
+	if IsUnauthorized(err) || IsQuotaExceeded(err) {
+		return true
+	}
+
+	switch StatusCode(err) {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// VLANBatchPendingError is returned while a vlan assignment batch of a port is
+// still being applied, the change continues once it completes
+type VLANBatchPendingError struct {
+	Port    string
+	BatchID string
+}
+
+func (e *VLANBatchPendingError) Error() string {
+	return fmt.Sprintf("vlan assignment batch %s on %s is still running", e.BatchID, e.Port)
+}
+
+// IsVLANBatchPending reports if err waits for a vlan assignment batch
+func IsVLANBatchPending(err error) bool {
+	var pending *VLANBatchPendingError
+	return errors.As(err, &pending)
+}
+
+// ErrorReason maps err to a short CamelCase reason for use in status conditions
+func ErrorReason(err error) string {
+	var credErr *CredentialsError
+	if errors.As(err, &credErr) && credErr.Reason != "" {
+		return credErr.Reason
+	}
+
+	switch {
+	case IsVLANBatchPending(err):
+		return "VLANBatchPending"
+	case IsNotFound(err):
+		return "NotFound"
+	case IsRateLimited(err):
+		return "RateLimited"
+	case IsCapacityUnavailable(err):
+		return "CapacityUnavailable"
+	case IsQuotaExceeded(err):
+		return "QuotaExceeded"
+	case IsUnauthorized(err):
+		return "Unauthorized"
+	case IsTerminal(err):
+		return "InvalidRequest"
+	}
+	return "APIError"
+}
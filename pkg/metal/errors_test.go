@@ -0,0 +1,79 @@
+package metal
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/hobbyfarm/metal-operator/pkg/metal/fakeapi"
+	"github.com/pkg/errors"
+)
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		message     string
+		notFound    bool
+		rateLimited bool
+		quota       bool
+		auth        bool
+		capacity    bool
+		terminal    bool
+	}{
+		{name: "not found", status: http.StatusNotFound, message: "Not found", notFound: true},
+		{name: "rate limited", status: http.StatusTooManyRequests, message: "Too many requests", rateLimited: true},
+		{name: "unauthorized", status: http.StatusUnauthorized, message: "Invalid authentication token", auth: true, terminal: true},
+		{name: "forbidden", status: http.StatusForbidden, message: "You are not authorized to view this project", auth: true, terminal: true},
+		{name: "quota", status: http.StatusForbidden, message: "Project has reached its IP reservation limit", quota: true, terminal: true},
+		{name: "capacity", status: http.StatusUnprocessableEntity, message: "The facility sg1 has no provisionable c3.small.x86 servers matching your criteria", capacity: true},
+		{name: "invalid plan", status: http.StatusUnprocessableEntity, message: "Plan is invalid", terminal: true},
+		{name: "server error", status: http.StatusInternalServerError, message: "Oh snap, something went wrong"},
+		{name: "404 in message", status: http.StatusUnprocessableEntity, message: "vlan 404 is not assigned", terminal: true},
+	}
+
+	server := fakeapi.NewServer()
+	defer server.Close()
+	m, err := NewClientWithBaseURL("token", testProject, server.BaseURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.ClearFaults()
+			// Retry-After 0 keeps the 429 case from pausing the other requests
+			server.AddFault(fakeapi.Fault{Status: tt.status, Message: tt.message, Header: http.Header{"Retry-After": []string{"0"}}})
+			_, _, err := m.Devices.Get("device", nil)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			err = errors.Wrap(err, "wrapped")
+
+			checks := []struct {
+				name     string
+				got      bool
+				expected bool
+			}{
+				{"IsNotFound", IsNotFound(err), tt.notFound},
+				{"IsRateLimited", IsRateLimited(err), tt.rateLimited},
+				{"IsQuotaExceeded", IsQuotaExceeded(err), tt.quota},
+				{"IsUnauthorized", IsUnauthorized(err), tt.auth},
+				{"IsCapacityUnavailable", IsCapacityUnavailable(err), tt.capacity},
+				{"IsTerminal", IsTerminal(err), tt.terminal},
+			}
+			for _, c := range checks {
+				if c.got != c.expected {
+					t.Errorf("%s: expected %v, got %v", c.name, c.expected, c.got)
+				}
+			}
+		})
+	}
+}
+
+func TestNonAPIErrors(t *testing.T) {
+	err := fmt.Errorf("dial tcp: connection refused 404")
+	if IsNotFound(err) || IsTerminal(err) {
+		t.Errorf("errors not returned by the api should not be classified")
+	}
+}
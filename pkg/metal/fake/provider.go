@@ -0,0 +1,424 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
+	"github.com/packethost/packngo"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Provider is an in-memory metal.Provider. It walks instances through the same
+// status transitions as MetalClient without talking to Equinix Metal.
+type Provider struct {
+	mu sync.Mutex
+
+	// ChecksUntilActive is the number of CheckDeviceStatus calls a device
+	// stays queued for before becoming active
+	ChecksUntilActive int
+
+	counter      int
+	deviceErrors map[string]error
+	noCapacity   map[string]bool
+	rejected     map[string]bool
+	devices      map[string]int
+	reservations map[string]string
+	keyPairs     map[string]string
+	elasticIPs   map[string]string
+	vlans        map[string]string
+	owned        map[string]metal.OwnedResource
+	// deviceSpecs holds the spec each device was created or last updated with
+	deviceSpecs map[string]equinixv1alpha1.InstanceSpec
+	// instanceDevices maps instance uids to their device, like the uid tag
+	instanceDevices map[types.UID]string
+}
+
+var _ metal.Provider = &Provider{}
+
+// NewProvider returns an empty fake Provider
+func NewProvider() *Provider {
+	return &Provider{
+		deviceErrors: make(map[string]error),
+		noCapacity:   make(map[string]bool),
+		rejected:     make(map[string]bool),
+		devices:      make(map[string]int),
+		reservations: make(map[string]string),
+		keyPairs:     make(map[string]string),
+		elasticIPs:   make(map[string]string),
+		vlans:        make(map[string]string),
+		owned:        make(map[string]metal.OwnedResource),
+		deviceSpecs:  make(map[string]equinixv1alpha1.InstanceSpec),
+
+		instanceDevices: make(map[types.UID]string),
+	}
+}
+
+// NewClient satisfies metal.ClientFactory and always hands out the same fake
+// unless the secret was rejected
+func (p *Provider) NewClient(ctx context.Context, client client.Client, creds metal.Credentials) (metal.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rejected[creds.Secret] {
+		return nil, &metal.CredentialsError{Err: APIError(http.StatusUnauthorized, "Invalid authentication token")}
+	}
+	return p, nil
+}
+
+// RejectSecret makes NewClient fail with invalid credentials for the named secret
+func (p *Provider) RejectSecret(secret string, rejected bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rejected[secret] = rejected
+}
+
+// FailDevice makes CreateNewDevice return err for the instance with the given name
+func (p *Provider) FailDevice(name string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deviceErrors[name] = err
+}
+
+// SetCapacity controls if CreateNewDevice finds capacity for the instance with the given name
+func (p *Provider) SetCapacity(name string, available bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.noCapacity[name] = !available
+}
+
+// APIError builds an error shaped like a failed Equinix Metal api response
+func APIError(statusCode int, message string) error {
+	req, _ := http.NewRequest(http.MethodPost, "https://api.equinix.com/metal/v1/", nil)
+	return &packngo.ErrorResponse{
+		Response: &http.Response{StatusCode: statusCode, Request: req},
+		Errors:   []string{message},
+	}
+}
+
+func (p *Provider) nextID(prefix string) string {
+	p.counter++
+	return fmt.Sprintf("%s-%d", prefix, p.counter)
+}
+
+func (p *Provider) CreateElasticInterface(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status = instance.Status.DeepCopy()
+	tag := fmt.Sprintf("%s-%s", instance.Name, instance.Namespace)
+
+	reservationID, ok := p.reservations[tag]
+	if !ok {
+		reservationID = p.nextID("reservation")
+		p.reservations[tag] = reservationID
+	}
+
+	metal.ElasticIPReserved(instance, status, equinixv1alpha1.InstanceElasticIP{
+		ReservationID: reservationID,
+		Address:       fmt.Sprintf("192.0.2.%d", len(p.reservations)),
+		CIDR:          32,
+	})
+	return status, nil
+}
+
+// UseElasticIP takes the metro of the device from a metro fallback location
+// or the spec, facilities are not resolved
+func (p *Provider) UseElasticIP(instance *equinixv1alpha1.Instance, eip *equinixv1alpha1.ElasticIP) (status *equinixv1alpha1.InstanceStatus, err error) {
+	metro := instance.Spec.Metro
+	if len(instance.Status.Location) == 2 {
+		metro = instance.Status.Location
+	}
+	return metal.AttachElasticIP(instance, eip, metro), nil
+}
+
+func (p *Provider) CreateNewDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status = instance.Status.DeepCopy()
+	if err, ok := p.deviceErrors[instance.Name]; ok {
+		return status, err
+	}
+	if p.noCapacity[instance.Name] {
+		status.Status = equinixv1alpha1.InstanceWaitingForCapacity
+		metal.SetCondition(status, instance.Generation, equinixv1alpha1.ConditionCapacityAvailable, false, "CapacityUnavailable",
+			fmt.Sprintf("no capacity for %s", instance.Spec.Plan))
+		return status, nil
+	}
+	if id, ok := p.instanceDevices[instance.UID]; ok && instance.UID != "" {
+		if _, exists := p.devices[id]; exists {
+			status.InstanceID = id
+			status.Status = "queued"
+			return status, nil
+		}
+	}
+	id := p.nextID("device")
+	p.devices[id] = 0
+	p.instanceDevices[instance.UID] = id
+	p.deviceSpecs[id] = *instance.Spec.DeepCopy()
+	p.owned[id] = metal.OwnedResource{Kind: metal.ResourceDevice, ID: id, Description: instance.Name,
+		Owner: metal.Owner{Kind: "instance", Namespace: instance.Namespace, Name: instance.Name}}
+	status.InstanceID = id
+	status.Status = "queued"
+	if len(instance.Spec.Facility) > 0 {
+		status.Facility = instance.Spec.Facility[0]
+	}
+	return status, nil
+}
+
+func (p *Provider) CheckDeviceStatus(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status = instance.Status.DeepCopy()
+	checks, ok := p.devices[instance.Status.InstanceID]
+	if !ok {
+		return status, fmt.Errorf("device %s not found", instance.Status.InstanceID)
+	}
+
+	if checks < p.ChecksUntilActive {
+		// changing the status triggers the next check right away instead of
+		// waiting for the poll interval
+		p.devices[instance.Status.InstanceID] = checks + 1
+		status.Status = "provisioning"
+		return status, nil
+	}
+
+	status.Status = "active"
+	status.PrivateIP = "198.51.100.1"
+	status.PublicIP = instance.Annotations[metal.AddressAnnotation]
+	return status, nil
+}
+
+// UpdateDevice applies the mutable fields to the recorded device spec and
+// reports plan and operating system changes with the SpecDrift condition
+func (p *Provider) UpdateDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status = instance.Status.DeepCopy()
+	spec, ok := p.deviceSpecs[instance.Status.InstanceID]
+	if !ok {
+		return status, fmt.Errorf("device %s not found", instance.Status.InstanceID)
+	}
+	spec.Tags = instance.Spec.Tags
+	spec.Description = instance.Spec.Description
+	spec.UserData = instance.Spec.UserData
+	spec.CustomData = instance.Spec.CustomData
+	spec.AlwaysPXE = instance.Spec.AlwaysPXE
+	spec.IPXEScriptURL = instance.Spec.IPXEScriptURL
+	p.deviceSpecs[instance.Status.InstanceID] = spec
+
+	if spec.Plan != instance.Spec.Plan || spec.OperatingSystem != instance.Spec.OperatingSystem {
+		metal.SetCondition(status, instance.Generation, equinixv1alpha1.ConditionSpecDrift, true, "ImmutableFieldChanged",
+			fmt.Sprintf("device was created with plan %s and operating system %s", spec.Plan, spec.OperatingSystem))
+		return status, nil
+	}
+	metal.SetCondition(status, instance.Generation, equinixv1alpha1.ConditionSpecDrift, false, "InSync", "device matches the spec")
+	return status, nil
+}
+
+// DeviceSpec returns the spec the device was created or last updated with
+func (p *Provider) DeviceSpec(id string) (equinixv1alpha1.InstanceSpec, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	spec, ok := p.deviceSpecs[id]
+	return spec, ok
+}
+
+func (p *Provider) CheckSpotDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status = instance.Status.DeepCopy()
+	if _, ok := p.devices[instance.Status.InstanceID]; !ok {
+		metal.SpotReclaimed(instance, status, fmt.Sprintf("spot device %s was reclaimed", instance.Status.InstanceID), true)
+	}
+	return status, nil
+}
+
+func (p *Provider) DeleteDevice(instance *equinixv1alpha1.Instance) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if instance.Spec.DeletionPolicy == equinixv1alpha1.DeletionPolicyRetain || instance.Spec.DeletionPolicy == equinixv1alpha1.DeletionPolicyOrphan {
+		return nil
+	}
+	delete(p.devices, instance.Status.InstanceID)
+	delete(p.owned, instance.Status.InstanceID)
+	if instance.Spec.ElasticIP == "" {
+		delete(p.reservations, fmt.Sprintf("%s-%s", instance.Name, instance.Namespace))
+	}
+	return nil
+}
+
+func (p *Provider) AdoptDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status = instance.Status.DeepCopy()
+	deviceID := metal.AdoptDeviceID(instance)
+	if _, ok := p.devices[deviceID]; !ok {
+		status.Status = equinixv1alpha1.InstanceFailed
+		status.FailureReason = "DeviceNotFound"
+		status.FailureMessage = fmt.Sprintf("device %s not found", deviceID)
+		return status, nil
+	}
+	if _, ok := p.deviceSpecs[deviceID]; !ok {
+		p.deviceSpecs[deviceID] = *instance.Spec.DeepCopy()
+	}
+	status.InstanceID = deviceID
+	status.Status = "active"
+	status.PrivateIP = "198.51.100.1"
+	status.PublicIP = "198.51.100.2"
+	return status, nil
+}
+
+func (p *Provider) CreateImportKeyPair(importKeyPair *equinixv1alpha1.ImportKeyPair) (status *equinixv1alpha1.ImportKeyPairStatus, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status = importKeyPair.Status.DeepCopy()
+	id := p.nextID("keypair")
+	p.keyPairs[id] = importKeyPair.Spec.Key
+	status.KeyPairID = id
+	status.Status = "created"
+	return status, nil
+}
+
+func (p *Provider) DeleteKeyPair(importKeyPair *equinixv1alpha1.ImportKeyPair) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if importKeyPair.Spec.DeletionPolicy == equinixv1alpha1.DeletionPolicyRetain || importKeyPair.Spec.DeletionPolicy == equinixv1alpha1.DeletionPolicyOrphan {
+		return nil
+	}
+	delete(p.keyPairs, importKeyPair.Status.KeyPairID)
+	return nil
+}
+
+func (p *Provider) CreateElasticIP(eip *equinixv1alpha1.ElasticIP) (status *equinixv1alpha1.ElasticIPStatus, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status = eip.Status.DeepCopy()
+	id := p.nextID("elasticip")
+	p.elasticIPs[id] = eip.Name
+	status.Status = equinixv1alpha1.ElasticIPReserved
+	status.ReservationID = id
+	status.Address = fmt.Sprintf("203.0.113.%d", p.counter)
+	status.CIDR = 32
+	status.Metro = eip.Spec.Metro
+	return status, nil
+}
+
+func (p *Provider) DeleteElasticIP(eip *equinixv1alpha1.ElasticIP) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if eip.Spec.DeletionPolicy != equinixv1alpha1.DeletionPolicyRetain && eip.Spec.DeletionPolicy != equinixv1alpha1.DeletionPolicyOrphan {
+		delete(p.elasticIPs, eip.Status.ReservationID)
+	}
+	return nil
+}
+
+// ElasticIPExists reports if the fake still tracks an elastic ip reservation with the given id
+func (p *Provider) ElasticIPExists(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.elasticIPs[id]
+	return ok
+}
+
+func (p *Provider) CreateVirtualNetwork(vn *equinixv1alpha1.VirtualNetwork) (status *equinixv1alpha1.VirtualNetworkStatus, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status = vn.Status.DeepCopy()
+	if status.VLANID == "" {
+		status.VLANID = p.nextID("vlan")
+	}
+	p.vlans[status.VLANID] = vn.Name
+	status.Status = equinixv1alpha1.VirtualNetworkCreated
+	status.VXLAN = vn.Spec.VXLAN
+	if status.VXLAN == 0 {
+		status.VXLAN = 1000 + len(p.vlans)
+	}
+	status.Metro = vn.Spec.Metro
+	return status, nil
+}
+
+func (p *Provider) DeleteVirtualNetwork(vn *equinixv1alpha1.VirtualNetwork) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if vn.Spec.DeletionPolicy != equinixv1alpha1.DeletionPolicyRetain && vn.Spec.DeletionPolicy != equinixv1alpha1.DeletionPolicyOrphan {
+		delete(p.vlans, vn.Status.VLANID)
+	}
+	return nil
+}
+
+// VirtualNetworkExists reports if the fake still tracks a vlan with the given id
+func (p *Provider) VirtualNetworkExists(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.vlans[id]
+	return ok
+}
+
+// AddDevice registers a device created outside the operator which can be adopted
+func (p *Provider) AddDevice(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.devices[id] = p.ChecksUntilActive
+}
+
+// ReclaimDevice removes a device the way Equinix Metal reclaims a spot device
+func (p *Provider) ReclaimDevice(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.devices, id)
+	delete(p.owned, id)
+}
+
+// DeviceExists reports if the fake still tracks a device with the given id
+func (p *Provider) DeviceExists(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.devices[id]
+	return ok
+}
+
+// KeyPairExists reports if the fake still tracks a key pair with the given id
+func (p *Provider) KeyPairExists(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.keyPairs[id]
+	return ok
+}
+
+func (p *Provider) OwnedResources(projectID string) (resources []metal.OwnedResource, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, resource := range p.owned {
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+func (p *Provider) DeleteOwnedResource(resource metal.OwnedResource) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.owned, resource.ID)
+	if resource.Kind == metal.ResourceDevice {
+		delete(p.devices, resource.ID)
+	}
+	return nil
+}
+
+// AddOwnedResource registers a resource tagged for an owner, like one leaked
+// when the operator stopped before recording it
+func (p *Provider) AddOwnedResource(resource metal.OwnedResource) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.owned[resource.ID] = resource
+}
+
+// OwnedResourceExists reports if the fake still tracks an owned resource with the given id
+func (p *Provider) OwnedResourceExists(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.owned[id]
+	return ok
+}
@@ -0,0 +1,1154 @@
+// Package fakeapi provides an in-process stand-in for the Equinix Metal REST
+// api. It implements the subset of endpoints used by the metal package, keeps
+// state between calls and walks devices from queued through provisioning to
+// active, so MetalClient can be exercised without network access.
+package fakeapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/packethost/packngo"
+)
+
+const (
+	StateQueued       = "queued"
+	StateProvisioning = "provisioning"
+	StateActive       = "active"
+)
+
+// facilities maps the facility codes known to the server to their metro
+var facilities = map[string]string{
+	"am6":  "am",
+	"da11": "da",
+	"ny5":  "ny",
+	"sg1":  "sg",
+	"sg2":  "sg",
+	"sv15": "sv",
+}
+
+// Fault makes the server answer matching requests with an error response.
+// Method and Path are matched exactly and by prefix respectively, an empty
+// value matches everything. Times is the number of requests to fail, zero
+// fails every matching request until the fault is cleared.
+type Fault struct {
+	Method  string
+	Path    string
+	Status  int
+	Message string
+	Header  http.Header
+	Times   int
+}
+
+// Server is a stateful fake Equinix Metal api backed by httptest.Server
+type Server struct {
+	*httptest.Server
+
+	// Token if set must match the X-Auth-Token header of every request
+	Token string
+
+	mu           sync.Mutex
+	counter      int
+	devices      map[string]*packngo.Device
+	held         map[string]bool
+	reservations map[string]*packngo.IPAddressReservation
+	ports        map[string]string
+	sshKeys      map[string]*packngo.SSHKey
+	vlans        map[string]*packngo.VirtualNetwork
+	batches      map[string][]*packngo.VLANAssignmentBatch
+	holdBatches  bool
+	queued       map[string]*queuedBatch
+	noCapacity   map[string]bool
+	faults       []*Fault
+}
+
+// NewServer starts a new fake api server. Callers must Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		devices:      make(map[string]*packngo.Device),
+		held:         make(map[string]bool),
+		reservations: make(map[string]*packngo.IPAddressReservation),
+		ports:        make(map[string]string),
+		sshKeys:      make(map[string]*packngo.SSHKey),
+		vlans:        make(map[string]*packngo.VirtualNetwork),
+		batches:      make(map[string][]*packngo.VLANAssignmentBatch),
+		queued:       make(map[string]*queuedBatch),
+		noCapacity:   make(map[string]bool),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// BaseURL returns the url to hand to packngo / metal.NewClientWithBaseURL
+func (s *Server) BaseURL() string {
+	return s.URL + "/"
+}
+
+// Device returns a copy of the device with id, if present
+func (s *Server) Device(id string) (*packngo.Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[id]
+	if !ok {
+		return nil, false
+	}
+	c := copyDevice(d)
+	return c, true
+}
+
+// SetDeviceState forces the state of a device. Devices forced into a state
+// other than queued or provisioning no longer progress on their own.
+func (s *Server) SetDeviceState(id string, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.devices[id]; ok {
+		d.State = state
+	}
+}
+
+// queuedBatch is a vlan assignment batch held back by HoldVLANBatches
+type queuedBatch struct {
+	port    *packngo.Port
+	batch   *packngo.VLANAssignmentBatch
+	request *packngo.VLANAssignmentBatchCreateRequest
+}
+
+// HoldVLANBatches keeps vlan assignment batches submitted from now on queued,
+// as the api does while it applies them, until ReleaseVLANBatches
+func (s *Server) HoldVLANBatches() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holdBatches = true
+}
+
+// ReleaseVLANBatches applies the queued vlan assignment batches and stops
+// holding new ones
+func (s *Server) ReleaseVLANBatches() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holdBatches = false
+	for id, q := range s.queued {
+		s.applyVLANBatch(q.port, q.batch, q.request)
+		delete(s.queued, id)
+	}
+}
+
+// SetTerminationTime schedules the termination of a device, like Equinix
+// Metal does before reclaiming a spot device
+func (s *Server) SetTerminationTime(id string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.devices[id]; ok {
+		d.TerminationTime = &packngo.Timestamp{Time: t}
+	}
+}
+
+// HoldDevice stops a device from progressing past its current state
+func (s *Server) HoldDevice(id string, hold bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held[id] = hold
+}
+
+// Reservation returns a copy of the ip reservation with id, if present
+func (s *Server) Reservation(id string) (*packngo.IPAddressReservation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reservations[id]
+	if !ok {
+		return nil, false
+	}
+	c := *r
+	return &c, true
+}
+
+// VirtualNetwork returns a copy of the vlan with id, if present
+func (s *Server) VirtualNetwork(id string) (*packngo.VirtualNetwork, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.vlans[id]
+	if !ok {
+		return nil, false
+	}
+	c := *v
+	return &c, true
+}
+
+// SSHKey returns a copy of the ssh key with id, if present
+func (s *Server) SSHKey(id string) (*packngo.SSHKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.sshKeys[id]
+	if !ok {
+		return nil, false
+	}
+	c := *k
+	return &c, true
+}
+
+// SetCapacity controls what the capacity api reports for a metro or facility.
+// Every location has capacity until told otherwise.
+func (s *Server) SetCapacity(location string, available bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noCapacity[location] = !available
+}
+
+// AddFault registers a fault for subsequent requests
+func (s *Server) AddFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all registered faults
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// fault returns the first fault matching r and consumes one of its uses
+func (s *Server) fault(r *http.Request) *Fault {
+	for i, f := range s.faults {
+		if f.Method != "" && f.Method != r.Method {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, f.Path) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+func (s *Server) newID(kind string) string {
+	s.counter++
+	return fmt.Sprintf("%s-%08d", kind, s.counter)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("X-Auth-Token") != s.Token {
+		writeError(w, http.StatusUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f := s.fault(r); f != nil {
+		for k, v := range f.Header {
+			w.Header()[k] = v
+		}
+		writeError(w, f.Status, f.Message)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "projects":
+		s.project(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "projects" && parts[2] == "devices":
+		s.projectDevices(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "projects" && parts[2] == "ips":
+		s.projectIPs(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "projects" && parts[2] == "ssh-keys":
+		s.projectSSHKeys(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "projects" && parts[2] == "virtual-networks":
+		s.projectVirtualNetworks(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "virtual-networks":
+		s.virtualNetwork(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "devices":
+		s.device(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "devices" && parts[2] == "ips":
+		s.deviceIPs(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "ips":
+		s.ip(w, r, parts[1])
+	case len(parts) >= 2 && parts[0] == "ports":
+		s.port(w, r, parts[1], strings.Join(parts[2:], "/"))
+	case len(parts) == 2 && parts[0] == "ssh-keys":
+		s.sshKey(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "facilities":
+		s.facilities(w, r)
+	case parts[0] == "capacity":
+		s.capacity(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// project serves any project id, the fake does not track projects
+func (s *Server) project(w http.ResponseWriter, r *http.Request, projectID string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, packngo.Project{ID: projectID, Name: projectID, URL: "/projects/" + projectID})
+}
+
+func (s *Server) projectDevices(w http.ResponseWriter, r *http.Request, projectID string) {
+	switch r.Method {
+	case http.MethodGet:
+		tag := r.URL.Query().Get("tag")
+		devices := []packngo.Device{}
+		for _, d := range s.devices {
+			if d.Project.URL != "/projects/"+projectID {
+				continue
+			}
+			if tag != "" && !contains(d.Tags, tag) {
+				continue
+			}
+			devices = append(devices, *renderDevice(r, d))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"devices": devices, "meta": map[string]interface{}{}})
+	case http.MethodPost:
+		req := &packngo.DeviceCreateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if req.Plan == "" || req.OS == "" {
+			writeError(w, http.StatusUnprocessableEntity, "plan and operating_system are required")
+			return
+		}
+		if len(req.Facility) == 0 && req.Metro == "" {
+			writeError(w, http.StatusUnprocessableEntity, "facility or metro is required")
+			return
+		}
+		if location, ok := s.outOfCapacity(req); ok {
+			writeError(w, http.StatusUnprocessableEntity,
+				fmt.Sprintf("The location %s has no provisionable %s servers matching your criteria", location, req.Plan))
+			return
+		}
+		d := s.newDevice(projectID, req)
+		writeJSON(w, http.StatusCreated, d)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// outOfCapacity is true when none of the requested locations have capacity
+func (s *Server) outOfCapacity(req *packngo.DeviceCreateRequest) (string, bool) {
+	if req.Metro != "" {
+		return req.Metro, s.noCapacity[req.Metro]
+	}
+	for _, facility := range req.Facility {
+		if !s.noCapacity[facility] {
+			return "", false
+		}
+	}
+	return strings.Join(req.Facility, ", "), true
+}
+
+func (s *Server) newDevice(projectID string, req *packngo.DeviceCreateRequest) *packngo.Device {
+	metro := req.Metro
+	facility := metro + "1"
+	if len(req.Facility) > 0 && req.Facility[0] != "any" {
+		facility = req.Facility[0]
+	}
+	if metro == "" {
+		metro = facilities[facility]
+	}
+
+	description := req.Description
+	d := &packngo.Device{
+		ID:            s.newID("device"),
+		Hostname:      req.Hostname,
+		Description:   &description,
+		State:         StateQueued,
+		Created:       time.Now().UTC().Format(time.RFC3339),
+		BillingCycle:  req.BillingCycle,
+		Tags:          req.Tags,
+		OS:            &packngo.OS{Slug: req.OS},
+		Plan:          &packngo.Plan{Slug: req.Plan},
+		Facility:      &packngo.Facility{Code: facility},
+		Metro:         &packngo.Metro{Code: metro},
+		Project:       &packngo.Project{URL: "/projects/" + projectID},
+		UserData:      req.UserData,
+		IPXEScriptURL: req.IPXEScriptURL,
+		AlwaysPXE:     req.AlwaysPXE,
+		SpotInstance:  req.SpotInstance,
+		SpotPriceMax:  req.SpotPriceMax,
+		CustomData:    customData(req.CustomData),
+	}
+	d.Href = "/devices/" + d.ID
+	d.Network = managementIPs(s.counter)
+
+	bond := packngo.Port{ID: s.newID("port"), Type: "NetworkBondPort", Name: "bond0", Data: packngo.PortData{Bonded: true}}
+	d.NetworkPorts = append(d.NetworkPorts, bond)
+	for _, name := range []string{"eth0", "eth1"} {
+		d.NetworkPorts = append(d.NetworkPorts, packngo.Port{
+			ID:                        s.newID("port"),
+			Type:                      "NetworkPort",
+			Name:                      name,
+			Data:                      packngo.PortData{Bonded: true, MAC: fmt.Sprintf("0c:c4:7a:00:00:%02x", s.counter%256)},
+			DisbondOperationSupported: true,
+			Bond:                      &packngo.BondData{ID: bond.ID, Name: bond.Name},
+		})
+	}
+	for _, p := range d.NetworkPorts {
+		s.ports[p.ID] = d.ID
+	}
+	refreshNetworkType(d)
+
+	s.devices[d.ID] = d
+	return d
+}
+
+func managementIPs(n int) []*packngo.IPAddressAssignment {
+	ip := func(family int, public bool, address string) *packngo.IPAddressAssignment {
+		return &packngo.IPAddressAssignment{IpAddressCommon: packngo.IpAddressCommon{
+			Address:       address,
+			AddressFamily: family,
+			Public:        public,
+			Management:    true,
+		}}
+	}
+	return []*packngo.IPAddressAssignment{
+		ip(4, true, fmt.Sprintf("198.51.100.%d", n%254+1)),
+		ip(4, false, fmt.Sprintf("10.0.0.%d", n%254+1)),
+		ip(6, true, fmt.Sprintf("2001:db8::%x", n)),
+	}
+}
+
+func (s *Server) device(w http.ResponseWriter, r *http.Request, id string) {
+	d, ok := s.devices[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// each poll moves a provisioning device one step closer to active
+		if !s.held[id] {
+			switch d.State {
+			case StateQueued:
+				d.State = StateProvisioning
+			case StateProvisioning:
+				d.State = StateActive
+			}
+		}
+		writeJSON(w, http.StatusOK, renderDevice(r, d))
+	case http.MethodPut:
+		req := &packngo.DeviceUpdateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if req.Hostname != nil {
+			d.Hostname = *req.Hostname
+		}
+		if req.Description != nil {
+			d.Description = req.Description
+		}
+		if req.UserData != nil {
+			d.UserData = *req.UserData
+		}
+		if req.Tags != nil {
+			d.Tags = *req.Tags
+		}
+		if req.AlwaysPXE != nil {
+			d.AlwaysPXE = *req.AlwaysPXE
+		}
+		if req.IPXEScriptURL != nil {
+			d.IPXEScriptURL = *req.IPXEScriptURL
+		}
+		if req.Locked != nil {
+			d.Locked = *req.Locked
+		}
+		if req.CustomData != nil {
+			d.CustomData = customData(*req.CustomData)
+		}
+		writeJSON(w, http.StatusOK, d)
+	case http.MethodDelete:
+		for _, p := range d.NetworkPorts {
+			delete(s.ports, p.ID)
+		}
+		for _, res := range s.reservations {
+			res.Assignments = removeAssignments(res.Assignments, d.ID)
+		}
+		delete(s.devices, id)
+		delete(s.held, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *Server) deviceIPs(w http.ResponseWriter, r *http.Request, id string) {
+	d, ok := s.devices[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ips := []packngo.IPAddressAssignment{}
+		for _, ip := range d.Network {
+			ips = append(ips, *ip)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ip_addresses": ips})
+	case http.MethodPost:
+		req := &packngo.AddressStruct{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		address := strings.Split(req.Address, "/")[0]
+		var reservation *packngo.IPAddressReservation
+		for _, res := range s.reservations {
+			if res.Address == address {
+				reservation = res
+			}
+		}
+		if reservation == nil {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("address %s is not reserved in this project", req.Address))
+			return
+		}
+		if reservation.Metro != nil && d.Metro.Code != "" && reservation.Metro.Code != d.Metro.Code {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("address %s is reserved in metro %s, device is in %s",
+				req.Address, reservation.Metro.Code, d.Metro.Code))
+			return
+		}
+		assignment := &packngo.IPAddressAssignment{
+			IpAddressCommon: reservation.IpAddressCommon,
+			AssignedTo:      packngo.Href{Href: d.Href},
+		}
+		assignment.ID = s.newID("assignment")
+		assignment.Management = false
+		assignment.Href = "/ips/" + assignment.ID
+		d.Network = append(d.Network, assignment)
+		reservation.Assignments = append(reservation.Assignments, assignment)
+		writeJSON(w, http.StatusCreated, assignment)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *Server) projectIPs(w http.ResponseWriter, r *http.Request, projectID string) {
+	switch r.Method {
+	case http.MethodGet:
+		tag := r.URL.Query().Get("tag")
+		reservations := []packngo.IPAddressReservation{}
+		for _, res := range s.reservations {
+			if res.Project.Href != "/projects/"+projectID {
+				continue
+			}
+			if tag != "" && !contains(res.Tags, tag) {
+				continue
+			}
+			reservations = append(reservations, *res)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ip_addresses": reservations})
+	case http.MethodPost:
+		req := &packngo.IPReservationRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if req.Quantity < 1 {
+			writeError(w, http.StatusUnprocessableEntity, "quantity must be at least 1")
+			return
+		}
+		res := &packngo.IPAddressReservation{}
+		res.ID = s.newID("reservation")
+		res.Href = "/ips/" + res.ID
+		res.Project = packngo.Href{Href: "/projects/" + projectID}
+		res.Tags = req.Tags
+		res.Public = true
+		res.AddressFamily = 4
+		res.CIDR = 32
+		res.Address = fmt.Sprintf("203.0.113.%d", s.counter%254+1)
+		switch req.Type {
+		case packngo.GlobalIPv4:
+			res.Global = true
+		case packngo.PublicIPv6:
+			res.AddressFamily = 6
+			res.CIDR = 128
+			res.Address = fmt.Sprintf("2001:db8:1::%x", s.counter)
+		case packngo.PublicIPv4:
+		default:
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("unsupported ip type %s", req.Type))
+			return
+		}
+		if res.AddressFamily == 4 {
+			for size := 1; size < req.Quantity; size *= 2 {
+				res.CIDR--
+			}
+			if 1<<(32-res.CIDR) != req.Quantity {
+				writeError(w, http.StatusUnprocessableEntity, "quantity must be a power of 2")
+				return
+			}
+		}
+		if req.Metro != nil {
+			res.Metro = &packngo.Metro{Code: *req.Metro}
+		}
+		if req.Description != "" {
+			res.Description = &req.Description
+		}
+		s.reservations[res.ID] = res
+		writeJSON(w, http.StatusCreated, res)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *Server) projectVirtualNetworks(w http.ResponseWriter, r *http.Request, projectID string) {
+	switch r.Method {
+	case http.MethodGet:
+		vlans := []packngo.VirtualNetwork{}
+		for _, v := range s.vlans {
+			if v.Project.ID == projectID {
+				vlans = append(vlans, *v)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"virtual_networks": vlans})
+	case http.MethodPost:
+		req := &packngo.VirtualNetworkCreateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if req.Metro == "" && req.Facility == "" {
+			writeError(w, http.StatusUnprocessableEntity, "metro or facility is required")
+			return
+		}
+		vxlan := req.VXLAN
+		if vxlan == 0 {
+			vxlan = 1000 + s.counter
+		}
+		for _, v := range s.vlans {
+			if v.Project.ID == projectID && v.MetroCode == req.Metro && v.VXLAN == vxlan {
+				writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("vxlan %d is already in use in %s", vxlan, req.Metro))
+				return
+			}
+		}
+		v := &packngo.VirtualNetwork{
+			ID:           s.newID("vlan"),
+			Description:  req.Description,
+			VXLAN:        vxlan,
+			MetroCode:    req.Metro,
+			FacilityCode: req.Facility,
+			Project:      &packngo.Project{ID: projectID},
+		}
+		v.Href = "/virtual-networks/" + v.ID
+		s.vlans[v.ID] = v
+		writeJSON(w, http.StatusCreated, v)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *Server) virtualNetwork(w http.ResponseWriter, r *http.Request, id string) {
+	v, ok := s.vlans[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	// instances are derived from the ports the vlan is assigned to
+	var instances []*packngo.Device
+	for _, d := range s.devices {
+		for i := range d.NetworkPorts {
+			if hasVLAN(&d.NetworkPorts[i], id) {
+				instances = append(instances, &packngo.Device{ID: d.ID, Href: d.Href})
+				break
+			}
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		c := *v
+		c.Instances = instances
+		writeJSON(w, http.StatusOK, &c)
+	case http.MethodDelete:
+		if len(instances) > 0 {
+			writeError(w, http.StatusUnprocessableEntity, "Cannot delete a vlan assigned to devices")
+			return
+		}
+		delete(s.vlans, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// ip serves /ips/{id} which is shared between reservations and assignments
+func (s *Server) ip(w http.ResponseWriter, r *http.Request, id string) {
+	if res, ok := s.reservations[id]; ok {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, res)
+		case http.MethodPatch:
+			req := struct {
+				Tags *[]string `json:"tags"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			if req.Tags != nil {
+				res.Tags = *req.Tags
+			}
+			writeJSON(w, http.StatusOK, res)
+		case http.MethodDelete:
+			if len(res.Assignments) > 0 {
+				writeError(w, http.StatusUnprocessableEntity, "Cannot remove a reservation with active assignments")
+				return
+			}
+			delete(s.reservations, id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+		return
+	}
+
+	for _, d := range s.devices {
+		for i, a := range d.Network {
+			if a.ID != id {
+				continue
+			}
+			switch r.Method {
+			case http.MethodGet:
+				writeJSON(w, http.StatusOK, a)
+			case http.MethodDelete:
+				d.Network = append(d.Network[:i], d.Network[i+1:]...)
+				for _, res := range s.reservations {
+					res.Assignments = removeAssignment(res.Assignments, id)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			}
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, "Not found")
+}
+
+func (s *Server) port(w http.ResponseWriter, r *http.Request, id string, action string) {
+	deviceID, ok := s.ports[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	d := s.devices[deviceID]
+	var p *packngo.Port
+	for i := range d.NetworkPorts {
+		if d.NetworkPorts[i].ID == id {
+			p = &d.NetworkPorts[i]
+		}
+	}
+
+	if action == "" && r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, p)
+		return
+	}
+	if strings.HasPrefix(action, "vlan-assignments/batches") {
+		s.vlanBatches(w, r, p, strings.TrimPrefix(strings.TrimPrefix(action, "vlan-assignments/batches"), "/"))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	switch action {
+	case "bond", "disbond":
+		bonded := action == "bond"
+		bulk := false
+		if bonded {
+			req := &packngo.BondRequest{}
+			_ = json.NewDecoder(r.Body).Decode(req)
+			bulk = req.BulkEnable
+		} else {
+			if p.Type == "NetworkPort" && !p.DisbondOperationSupported {
+				writeError(w, http.StatusUnprocessableEntity, "Disbond is not supported on this port")
+				return
+			}
+			req := &packngo.DisbondRequest{}
+			_ = json.NewDecoder(r.Body).Decode(req)
+			bulk = req.BulkDisable
+		}
+		setBonded(d, p, bonded, bulk)
+	case "assign", "unassign":
+		req := &packngo.PortAssignRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if action == "assign" {
+			if !hasVLAN(p, req.VirtualNetworkID) {
+				p.AttachedVirtualNetworks = append(p.AttachedVirtualNetworks, s.lookupVLAN(req.VirtualNetworkID))
+			}
+		} else {
+			if !hasVLAN(p, req.VirtualNetworkID) {
+				writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("vlan %s is not assigned to port %s", req.VirtualNetworkID, p.Name))
+				return
+			}
+			p.AttachedVirtualNetworks = removeVLAN(p.AttachedVirtualNetworks, req.VirtualNetworkID)
+		}
+	case "convert/layer-2":
+		// layer2 ports lose their management addresses
+		var network []*packngo.IPAddressAssignment
+		for _, ip := range d.Network {
+			if !ip.Management {
+				network = append(network, ip)
+			}
+		}
+		d.Network = network
+	case "convert/layer-3":
+		if len(p.AttachedVirtualNetworks) > 0 {
+			writeError(w, http.StatusUnprocessableEntity, "Port has vlans assigned, unassign them before converting to layer3")
+			return
+		}
+		if !d.HasManagementIPs() {
+			d.Network = append(managementIPs(s.counter), d.Network...)
+		}
+		setBonded(d, p, true, true)
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	refreshNetworkType(d)
+	writeJSON(w, http.StatusOK, p)
+}
+
+// vlanBatches serves /ports/{id}/vlan-assignments/batches. Batches are
+// applied right away and either complete or fail as a whole.
+func (s *Server) vlanBatches(w http.ResponseWriter, r *http.Request, p *packngo.Port, batchID string) {
+	switch {
+	case r.Method == http.MethodGet && batchID == "":
+		batches := []packngo.VLANAssignmentBatch{}
+		for _, b := range s.batches[p.ID] {
+			batches = append(batches, *b)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"batches": batches})
+	case r.Method == http.MethodGet:
+		for _, b := range s.batches[p.ID] {
+			if b.ID == batchID {
+				writeJSON(w, http.StatusOK, b)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "Not found")
+	case r.Method == http.MethodPost && batchID == "":
+		req := &packngo.VLANAssignmentBatchCreateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		batch := &packngo.VLANAssignmentBatch{
+			ID:       s.newID("batch"),
+			Quantity: len(req.VLANAssignments),
+			State:    packngo.VLANAssignmentBatchQueued,
+		}
+		s.batches[p.ID] = append(s.batches[p.ID], batch)
+		if s.holdBatches {
+			s.queued[batch.ID] = &queuedBatch{port: p, batch: batch, request: req}
+		} else {
+			s.applyVLANBatch(p, batch, req)
+		}
+		writeJSON(w, http.StatusCreated, batch)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// applyVLANBatch completes a batch, it fails as a whole when unassigning a
+// vlan the port does not have
+func (s *Server) applyVLANBatch(p *packngo.Port, batch *packngo.VLANAssignmentBatch, req *packngo.VLANAssignmentBatchCreateRequest) {
+	for _, a := range req.VLANAssignments {
+		if a.State == packngo.VLANAssignmentUnassigned && !hasVLAN(p, s.lookupVLAN(a.VLAN).ID) {
+			batch.ErrorMessages = append(batch.ErrorMessages, fmt.Sprintf("vlan %s is not assigned to port %s", a.VLAN, p.Name))
+		}
+	}
+	if len(batch.ErrorMessages) > 0 {
+		batch.State = packngo.VLANAssignmentBatchFailed
+		return
+	}
+	for _, a := range req.VLANAssignments {
+		s.applyVLANAssignment(p, a)
+	}
+	batch.State = packngo.VLANAssignmentBatchCompleted
+}
+
+func (s *Server) applyVLANAssignment(p *packngo.Port, a packngo.VLANAssignmentCreateRequest) {
+	vlan := s.lookupVLAN(a.VLAN)
+	isNative := p.NativeVirtualNetwork != nil && p.NativeVirtualNetwork.ID == vlan.ID
+	if a.State == packngo.VLANAssignmentUnassigned {
+		p.AttachedVirtualNetworks = removeVLAN(p.AttachedVirtualNetworks, vlan.ID)
+		if isNative {
+			p.NativeVirtualNetwork = nil
+		}
+		return
+	}
+	if !hasVLAN(p, vlan.ID) {
+		p.AttachedVirtualNetworks = append(p.AttachedVirtualNetworks, vlan)
+	}
+	switch {
+	case a.Native == nil:
+	case *a.Native:
+		p.NativeVirtualNetwork = &vlan
+	case isNative:
+		p.NativeVirtualNetwork = nil
+	}
+}
+
+// lookupVLAN finds a vlan of the server by uuid or vxlan number. Other values
+// are taken as the id of a vlan the server does not track.
+func (s *Server) lookupVLAN(id string) packngo.VirtualNetwork {
+	if v, ok := s.vlans[id]; ok {
+		return packngo.VirtualNetwork{ID: v.ID, VXLAN: v.VXLAN}
+	}
+	vxlan, _ := strconv.Atoi(id)
+	for _, v := range s.vlans {
+		if vxlan != 0 && v.VXLAN == vxlan {
+			return packngo.VirtualNetwork{ID: v.ID, VXLAN: v.VXLAN}
+		}
+	}
+	return packngo.VirtualNetwork{ID: id, VXLAN: vxlan}
+}
+
+func (s *Server) facilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	list := []packngo.Facility{}
+	for code, metro := range facilities {
+		list = append(list, packngo.Facility{ID: code, Code: code, Metro: &packngo.Metro{Code: metro}})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"facilities": list})
+}
+
+func (s *Server) capacity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	input := &packngo.CapacityInput{}
+	if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	for i, server := range input.Servers {
+		location := server.Facility
+		if location == "" {
+			location = server.Metro
+		}
+		input.Servers[i].Available = !s.noCapacity[location]
+	}
+	writeJSON(w, http.StatusOK, input)
+}
+
+func (s *Server) projectSSHKeys(w http.ResponseWriter, r *http.Request, projectID string) {
+	switch r.Method {
+	case http.MethodGet:
+		keys := []packngo.SSHKey{}
+		for _, k := range s.sshKeys {
+			keys = append(keys, *k)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ssh_keys": keys})
+	case http.MethodPost:
+		req := &packngo.SSHKeyCreateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if !strings.HasPrefix(req.Key, "ssh-") && !strings.HasPrefix(req.Key, "ecdsa-") {
+			writeError(w, http.StatusUnprocessableEntity, "Key is invalid")
+			return
+		}
+		k := &packngo.SSHKey{ID: s.newID("sshkey"), Label: req.Label, Key: req.Key}
+		k.URL = "/ssh-keys/" + k.ID
+		s.sshKeys[k.ID] = k
+		writeJSON(w, http.StatusCreated, k)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *Server) sshKey(w http.ResponseWriter, r *http.Request, id string) {
+	k, ok := s.sshKeys[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, k)
+	case http.MethodPatch:
+		req := &packngo.SSHKeyUpdateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if req.Label != nil {
+			k.Label = *req.Label
+		}
+		if req.Key != nil {
+			k.Key = *req.Key
+		}
+		writeJSON(w, http.StatusOK, k)
+	case http.MethodDelete:
+		delete(s.sshKeys, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// setBonded changes the bonding state of a port. Acting on the bond port or
+// using bulk applies the change to every member of the bond. The bond port
+// itself is active while at least one member is bonded.
+func setBonded(d *packngo.Device, p *packngo.Port, bonded bool, bulk bool) {
+	bondName := p.Name
+	if p.Bond != nil {
+		bondName = p.Bond.Name
+	}
+
+	for i := range d.NetworkPorts {
+		port := &d.NetworkPorts[i]
+		if port.Type != "NetworkPort" || port.Bond == nil || port.Bond.Name != bondName {
+			continue
+		}
+		if port.ID == p.ID || bulk || p.Type == "NetworkBondPort" {
+			port.Data.Bonded = bonded
+		}
+	}
+
+	for i := range d.NetworkPorts {
+		port := &d.NetworkPorts[i]
+		if port.Type != "NetworkBondPort" || port.Name != bondName {
+			continue
+		}
+		port.Data.Bonded = false
+		for _, member := range d.GetPortsInBond(bondName) {
+			if member.Data.Bonded {
+				port.Data.Bonded = true
+			}
+		}
+	}
+}
+
+// refreshNetworkType updates the network_type reported on every port of the
+// device to match its bonding and management ip state
+func refreshNetworkType(d *packngo.Device) {
+	networkType := deviceNetworkType(d)
+	for i := range d.NetworkPorts {
+		d.NetworkPorts[i].NetworkType = networkType
+	}
+}
+
+func deviceNetworkType(d *packngo.Device) string {
+	c := *d
+	c.Plan = nil
+	return c.GetNetworkType()
+}
+
+// customData decodes the json customdata of a request into the object
+// returned for devices
+func customData(data string) map[string]interface{} {
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &decoded); err != nil || len(decoded) == 0 {
+		return nil
+	}
+	return decoded
+}
+
+// renderDevice returns the device as the api sends it, the project is only a
+// reference unless the request includes it
+func renderDevice(r *http.Request, d *packngo.Device) *packngo.Device {
+	if !contains(strings.Split(r.URL.Query().Get("include"), ","), "project") {
+		return d
+	}
+	c := *d
+	c.Project = &packngo.Project{ID: path.Base(d.Project.URL), URL: d.Project.URL}
+	return &c
+}
+
+func copyDevice(d *packngo.Device) *packngo.Device {
+	b, _ := json.Marshal(d)
+	c := &packngo.Device{}
+	_ = json.Unmarshal(b, c)
+	return c
+}
+
+func hasVLAN(p *packngo.Port, vlan string) bool {
+	for _, v := range p.AttachedVirtualNetworks {
+		if v.ID == vlan {
+			return true
+		}
+	}
+	return false
+}
+
+func removeVLAN(vlans []packngo.VirtualNetwork, vlan string) []packngo.VirtualNetwork {
+	var result []packngo.VirtualNetwork
+	for _, v := range vlans {
+		if v.ID != vlan {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func removeAssignment(assignments []*packngo.IPAddressAssignment, id string) []*packngo.IPAddressAssignment {
+	var result []*packngo.IPAddressAssignment
+	for _, a := range assignments {
+		if a.ID != id {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+func removeAssignments(assignments []*packngo.IPAddressAssignment, deviceID string) []*packngo.IPAddressAssignment {
+	var result []*packngo.IPAddressAssignment
+	for _, a := range assignments {
+		if a.AssignedTo.Href != "/devices/"+deviceID {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{"errors": []string{message}})
+}
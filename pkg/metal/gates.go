@@ -0,0 +1,68 @@
+package metal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+// SetElasticIPStatus records the reservation in status.elasticIP. When the
+// address changes, for example after moving to another metro, the gate
+// conditions are cleared so the patchers act on the new address.
+func SetElasticIPStatus(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, elasticIP equinixv1alpha1.InstanceElasticIP) {
+	if status.ElasticIP != nil && status.ElasticIP.Address != elasticIP.Address {
+		for _, gate := range instance.Spec.ProvisioningGates {
+			meta.RemoveStatusCondition(&status.Conditions, gate)
+		}
+	}
+	status.ElasticIP = &elasticIP
+
+	if len(instance.Spec.ProvisioningGates) > 0 {
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionProvisioningGatesReady, false, "WaitingForGates",
+			fmt.Sprintf("waiting for provisioning gates %s", strings.Join(instance.Spec.ProvisioningGates, ", ")))
+	}
+}
+
+// CheckProvisioningGates moves an instance on to device creation once the
+// condition for every provisioning gate is True. Instances still waiting are
+// failed when spec.provisioningGateTimeout has passed, otherwise requeueAfter
+// is the time left before the timeout.
+func CheckProvisioningGates(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, requeueAfter time.Duration) {
+	status = instance.Status.DeepCopy()
+
+	var pending []string
+	for _, gate := range instance.Spec.ProvisioningGates {
+		if !meta.IsStatusConditionTrue(status.Conditions, gate) {
+			pending = append(pending, gate)
+		}
+	}
+
+	if len(pending) == 0 {
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionProvisioningGatesReady, true, "GatesSatisfied",
+			"all provisioning gates are satisfied")
+		status.Status = "patched"
+		return status, 0
+	}
+
+	message := fmt.Sprintf("waiting for provisioning gates %s", strings.Join(pending, ", "))
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionProvisioningGatesReady, false, "WaitingForGates", message)
+	if instance.Spec.ProvisioningGateTimeout == nil {
+		return status, 0
+	}
+
+	condition := meta.FindStatusCondition(status.Conditions, equinixv1alpha1.ConditionProvisioningGatesReady)
+	requeueAfter = time.Until(condition.LastTransitionTime.Add(instance.Spec.ProvisioningGateTimeout.Duration))
+	if requeueAfter > 0 {
+		return status, requeueAfter
+	}
+
+	status.Status = equinixv1alpha1.InstanceFailed
+	status.FailureReason = "ProvisioningGateTimeout"
+	status.FailureMessage = fmt.Sprintf("provisioning gates %s not satisfied within %s", strings.Join(pending, ", "),
+		instance.Spec.ProvisioningGateTimeout.Duration)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, status.FailureReason, status.FailureMessage)
+	return status, 0
+}
@@ -0,0 +1,57 @@
+package metal
+
+import (
+	"testing"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProvisioningGates(t *testing.T) {
+	instance := newTestInstance()
+	instance.Spec.ProvisioningGates = []string{"UserDataPatched", "DNSReady"}
+	instance.Spec.ProvisioningGateTimeout = &metav1.Duration{Duration: time.Hour}
+	instance.Status.Status = "elasticipcreated"
+	SetElasticIPStatus(instance, &instance.Status, equinixv1alpha1.InstanceElasticIP{ReservationID: "reservation-1", Address: "192.0.2.1"})
+
+	status, requeueAfter := CheckProvisioningGates(instance)
+	if status.Status != "elasticipcreated" || requeueAfter <= 0 || requeueAfter > time.Hour {
+		t.Fatalf("expected to wait for gates, got status %q requeue %s", status.Status, requeueAfter)
+	}
+
+	SetCondition(&instance.Status, instance.Generation, "UserDataPatched", true, "Patched", "")
+	SetCondition(&instance.Status, instance.Generation, "DNSReady", true, "Ready", "")
+	status, _ = CheckProvisioningGates(instance)
+	if status.Status != "patched" {
+		t.Fatalf("expected patched once all gates are satisfied, got %q", status.Status)
+	}
+	if !meta.IsStatusConditionTrue(status.Conditions, equinixv1alpha1.ConditionProvisioningGatesReady) {
+		t.Fatalf("expected %s to be true", equinixv1alpha1.ConditionProvisioningGatesReady)
+	}
+
+	// a new address needs patching again
+	SetElasticIPStatus(instance, &instance.Status, equinixv1alpha1.InstanceElasticIP{ReservationID: "reservation-2", Address: "192.0.2.2"})
+	if meta.FindStatusCondition(instance.Status.Conditions, "UserDataPatched") != nil {
+		t.Fatalf("expected gate conditions to be cleared when the address changes")
+	}
+}
+
+func TestProvisioningGatesTimeout(t *testing.T) {
+	instance := newTestInstance()
+	instance.Spec.ProvisioningGates = []string{"UserDataPatched"}
+	instance.Spec.ProvisioningGateTimeout = &metav1.Duration{Duration: time.Minute}
+	instance.Status.Status = "elasticipcreated"
+	instance.Status.Conditions = []metav1.Condition{{
+		Type:               equinixv1alpha1.ConditionProvisioningGatesReady,
+		Status:             metav1.ConditionFalse,
+		Reason:             "WaitingForGates",
+		LastTransitionTime: metav1.NewTime(time.Now().Add(-2 * time.Minute)),
+	}}
+
+	status, _ := CheckProvisioningGates(instance)
+	if status.Status != equinixv1alpha1.InstanceFailed || status.FailureReason != "ProvisioningGateTimeout" {
+		t.Fatalf("expected gate timeout, got status %q reason %q", status.Status, status.FailureReason)
+	}
+}
@@ -0,0 +1,85 @@
+package metal
+
+import (
+	"fmt"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// uidTagPrefix starts the tag carrying the uid of the instance a device was created for
+const uidTagPrefix = "metal-operator-uid:"
+
+// uidTag marks devices with the uid of their instance. Unlike the name a uid
+// is never reused, so a recreated instance does not pick up the old device.
+func uidTag(instance *equinixv1alpha1.Instance) string {
+	return uidTagPrefix + string(instance.UID)
+}
+
+func deviceHostname(instance *equinixv1alpha1.Instance) string {
+	return fmt.Sprintf("%s-%s", instance.Name, instance.Namespace)
+}
+
+// existingDevice returns a device created for the instance by an earlier
+// attempt whose result never made it into the status, for example because the
+// status write conflicted or the operator stopped. Devices are matched by the
+// uid tag of the instance, devices of earlier provisioning attempts and
+// devices which failed or are being removed are skipped.
+func (m *MetalClient) existingDevice(instance *equinixv1alpha1.Instance, projectID string) (*packngo.Device, error) {
+	if instance.UID == "" {
+		return nil, nil
+	}
+	devices, _, err := m.Devices.List(projectID, &packngo.ListOptions{
+		QueryParams: map[string]string{"tag": OwnerTag("Instance", instance.Namespace, instance.Name)},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error looking up existing devices")
+	}
+
+	attempted := make(map[string]bool)
+	for _, attempt := range instance.Status.ProvisioningAttempts {
+		attempted[attempt.DeviceID] = true
+	}
+
+	for i := range devices {
+		device := &devices[i]
+		if attempted[device.ID] || hasTag(device.Tags, ReleasedTag) {
+			continue
+		}
+		switch device.State {
+		case "failed", "deprovisioning", "deleted":
+			continue
+		}
+		if hasTag(device.Tags, uidTag(instance)) {
+			return device, nil
+		}
+	}
+	return nil, nil
+}
+
+// deviceCreated records a new or recovered device in the status. Active devices
+// are checked once more so their addresses are filled in and the elastic ip attached.
+func deviceCreated(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, device *packngo.Device,
+	reason string, message string) {
+	start := metav1.Now()
+	if created, err := time.Parse(time.RFC3339, device.Created); err == nil {
+		start = metav1.NewTime(created)
+	}
+
+	status.InstanceID = device.ID
+	status.Status = device.State
+	if device.State == "active" {
+		status.Status = "provisioning"
+	}
+	status.Facility = ""
+	if device.Facility != nil {
+		status.Facility = device.Facility.Code
+	}
+	status.ProvisioningStartTime = &start
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionDeviceCreated, true, reason, message)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, "Provisioning",
+		fmt.Sprintf("device is %s", device.State))
+}
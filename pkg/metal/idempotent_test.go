@@ -0,0 +1,130 @@
+package metal
+
+import (
+	"testing"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+// createDeviceTwice creates a device for the instance and then loses the
+// result, as when the status write conflicts, before creating it again
+func createDeviceTwice(t *testing.T, m *MetalClient, instance *equinixv1alpha1.Instance) (first *equinixv1alpha1.InstanceStatus, second *equinixv1alpha1.InstanceStatus) {
+	t.Helper()
+	status, err := m.CreateElasticInterface(instance)
+	if err != nil {
+		t.Fatalf("error creating elastic interface: %v", err)
+	}
+	instance.Status = *status
+
+	first, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	second, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device again: %v", err)
+	}
+	return first, second
+}
+
+func projectDevices(t *testing.T, m *MetalClient) []packngo.Device {
+	t.Helper()
+	devices, _, err := m.Devices.List(testProject, nil)
+	if err != nil {
+		t.Fatalf("error listing devices: %v", err)
+	}
+	return devices
+}
+
+func TestCreateNewDeviceExisting(t *testing.T) {
+	m, _ := newTestClient(t)
+	instance := newTestInstance()
+	instance.UID = "6f1c2a9e-uid"
+
+	first, second := createDeviceTwice(t, m, instance)
+	if second.InstanceID != first.InstanceID {
+		t.Errorf("expected device %s to be found again, got %s", first.InstanceID, second.InstanceID)
+	}
+	if devices := projectDevices(t, m); len(devices) != 1 {
+		t.Errorf("expected a single device, got %d", len(devices))
+	}
+	condition := meta.FindStatusCondition(second.Conditions, equinixv1alpha1.ConditionDeviceCreated)
+	if condition == nil || condition.Reason != "Found" {
+		t.Errorf("expected DeviceCreated reason Found, got %v", condition)
+	}
+}
+
+func TestCreateNewDevicePostProvisioning(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.UID = "6f1c2a9e-uid"
+
+	status, err := m.CreateElasticInterface(instance)
+	if err != nil {
+		t.Fatalf("error creating elastic interface: %v", err)
+	}
+	instance.Status = *status
+	first, err := m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+
+	// devices between provisioning and active are found as well
+	server.SetDeviceState(first.InstanceID, "post_provisioning")
+	second, err := m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device again: %v", err)
+	}
+	if second.InstanceID != first.InstanceID {
+		t.Errorf("expected device %s to be found again, got %s", first.InstanceID, second.InstanceID)
+	}
+
+	// failed devices are not
+	server.SetDeviceState(first.InstanceID, "failed")
+	third, err := m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device again: %v", err)
+	}
+	if third.InstanceID == first.InstanceID {
+		t.Errorf("expected a new device, got failed device %s", first.InstanceID)
+	}
+}
+
+func TestCreateNewDeviceRecreatedInstance(t *testing.T) {
+	m, _ := newTestClient(t)
+	instance := newTestInstance()
+	instance.UID = "6f1c2a9e-uid"
+	provision(t, m, instance)
+
+	// an instance recreated with the same name never takes over the old device
+	recreated := newTestInstance()
+	recreated.UID = "0b7d4e13-uid"
+	first, second := createDeviceTwice(t, m, recreated)
+	if first.InstanceID == instance.Status.InstanceID {
+		t.Errorf("expected a new device, got %s of the previous instance", first.InstanceID)
+	}
+	if second.InstanceID != first.InstanceID {
+		t.Errorf("expected device %s to be found again, got %s", first.InstanceID, second.InstanceID)
+	}
+	if devices := projectDevices(t, m); len(devices) != 2 {
+		t.Errorf("expected two devices, got %d", len(devices))
+	}
+}
+
+func TestCreateNewDeviceForeignHostname(t *testing.T) {
+	m, _ := newTestClient(t)
+	// a device named like the instance which the operator never created
+	device := createDevice(t, m, testProject, "instance-sample-default")
+	instance := newTestInstance()
+	instance.UID = "6f1c2a9e-uid"
+
+	first, _ := createDeviceTwice(t, m, instance)
+	if first.InstanceID == device.ID {
+		t.Errorf("expected a new device, got untagged device %s", device.ID)
+	}
+	if devices := projectDevices(t, m); len(devices) != 2 {
+		t.Errorf("expected two devices, got %d", len(devices))
+	}
+}
@@ -1,9 +1,6 @@
 package metal
 
 import (
-	"fmt"
-	"strings"
-
 	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
 	"github.com/packethost/packngo"
 )
@@ -20,6 +17,13 @@ func (m *MetalClient) createKeyPair(sshCreateRequest *packngo.SSHKeyCreateReques
 }
 
 func (m *MetalClient) DeleteKeyPair(importKeyPair *equinixv1alpha1.ImportKeyPair) (err error) {
+	switch importKeyPair.Spec.DeletionPolicy {
+	case equinixv1alpha1.DeletionPolicyRetain:
+		return m.releaseKeyPair(importKeyPair)
+	case equinixv1alpha1.DeletionPolicyOrphan:
+		return nil
+	}
+
 	ok, err := m.importKeyPairExists(importKeyPair.Status.KeyPairID)
 	if err != nil {
 		return err
@@ -51,11 +55,10 @@ func (m *MetalClient) CreateImportKeyPair(importKeyPair *equinixv1alpha1.ImportK
 func (m *MetalClient) importKeyPairExists(keyPairID string) (ok bool, err error) {
 	sshKey, _, err := m.SSHKeys.Get(keyPairID, nil)
 	if err != nil {
-		if strings.Contains(err.Error(), "404 Not found") {
+		if IsNotFound(err) {
 			return ok, nil
-		} else {
-			return ok, err
 		}
+		return ok, err
 	}
 
 	if sshKey.ID == keyPairID {
@@ -68,7 +71,8 @@ func (m *MetalClient) generateSSHKeyRequest(importKeyPair *equinixv1alpha1.Impor
 	sshReq = &packngo.SSHKeyCreateRequest{}
 	sshReq.ProjectID = m.ProjectID
 	sshReq.Key = importKeyPair.Spec.Key
-	sshReq.Label = fmt.Sprintf("%s-%s", importKeyPair.Name, importKeyPair.Namespace)
+	// keys have no tags, the label carries the owner tag instead
+	sshReq.Label = OwnerTag("ImportKeyPair", importKeyPair.Namespace, importKeyPair.Name)
 
 	return sshReq
 }
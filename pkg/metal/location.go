@@ -0,0 +1,185 @@
+package metal
+
+import (
+	"fmt"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// isMetro reports if location is a metro code like "da" rather than a facility like "da11"
+func isMetro(location string) bool {
+	return len(location) == 2
+}
+
+// deviceLocation returns the metro and facilities the next device is created in.
+// Once the instance moved to a fallback location it replaces the spec values.
+func deviceLocation(instance *equinixv1alpha1.Instance) (metro string, facilities []string) {
+	location := instance.Status.Location
+	switch {
+	case location == "":
+		return instance.Spec.Metro, untriedFacilities(instance)
+	case isMetro(location):
+		return location, nil
+	default:
+		return "", []string{location}
+	}
+}
+
+// nextLocation returns the fallback location following the one in use
+func nextLocation(instance *equinixv1alpha1.Instance) (string, bool) {
+	next := 0
+	if instance.Status.Location != "" {
+		for i, location := range instance.Spec.FallbackLocations {
+			if location == instance.Status.Location {
+				next = i + 1
+			}
+		}
+	}
+
+	if next >= len(instance.Spec.FallbackLocations) {
+		return "", false
+	}
+	return instance.Spec.FallbackLocations[next], true
+}
+
+// reservationMetro returns the metro the elastic ip of the instance belongs in
+func (m *MetalClient) reservationMetro(instance *equinixv1alpha1.Instance) (string, error) {
+	location := instance.Status.Location
+	if location == "" {
+		return instance.Spec.Metro, nil
+	}
+	if isMetro(location) {
+		return location, nil
+	}
+
+	facilities, _, err := m.Facilities.List(&packngo.ListOptions{Includes: []string{"metro"}})
+	if err != nil {
+		return "", errors.Wrap(err, "error looking up facilities")
+	}
+	for _, facility := range facilities {
+		if facility.Code == location && facility.Metro != nil {
+			return facility.Metro.Code, nil
+		}
+	}
+	return "", fmt.Errorf("unable to find metro for facility %s", location)
+}
+
+// reservationMoved checks the elastic ip reservation is in the metro of the
+// current fallback location. A reservation in another metro can not be attached
+// to the device so it is released and the annotations are cleared, ready for
+// CreateElasticInterface to reserve a new one. Reservations of an ElasticIP
+// resource are checked by checkElasticIPMetro instead.
+func (m *MetalClient) reservationMoved(instance *equinixv1alpha1.Instance) (bool, error) {
+	reservationID, ok := instance.Annotations[ReservationAnnotation]
+	if !ok || instance.Status.Location == "" || instance.Spec.ElasticIP != "" {
+		return false, nil
+	}
+
+	metro, err := m.reservationMetro(instance)
+	if err != nil {
+		return false, err
+	}
+
+	reservation, _, err := m.ProjectIPs.Get(reservationID, nil)
+	if err != nil && !IsNotFound(err) {
+		return false, errors.Wrap(err, "error looking up elastic ip reservation")
+	}
+	if err == nil {
+		if reservation.Global || (reservation.Metro != nil && reservation.Metro.Code == metro) {
+			return false, nil
+		}
+		_, err = m.ProjectIPs.Remove(reservationID)
+		if err != nil && !IsNotFound(err) {
+			return false, errors.Wrap(err, "error releasing elastic ip reservation")
+		}
+	}
+
+	delete(instance.Annotations, ReservationAnnotation)
+	delete(instance.Annotations, AddressAnnotation)
+	return true, nil
+}
+
+// checkElasticIPMetro fails the instance when the reservation of its ElasticIP
+// resource is in another metro than the fallback location in use. The
+// reservation belongs to the ElasticIP, so it is never replaced.
+func (m *MetalClient) checkElasticIPMetro(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus) (bool, error) {
+	reservationID, ok := instance.Annotations[ReservationAnnotation]
+	if !ok || instance.Status.Location == "" {
+		return false, nil
+	}
+
+	metro, err := m.reservationMetro(instance)
+	if err != nil {
+		return false, err
+	}
+
+	reservation, _, err := m.ProjectIPs.Get(reservationID, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "error looking up elastic ip reservation")
+	}
+	if reservation.Global || reservation.Metro == nil || reservation.Metro.Code == metro {
+		return false, nil
+	}
+	elasticIPMetroMismatch(instance, status, reservation.Metro.Code, metro)
+	return true, nil
+}
+
+// provisioningTimedOut is true once the device has been provisioning for
+// longer than the instance ProvisioningTimeout
+func provisioningTimedOut(instance *equinixv1alpha1.Instance) bool {
+	timeout := instance.Spec.ProvisioningTimeout
+	start := instance.Status.ProvisioningStartTime
+	if timeout == nil || timeout.Duration <= 0 || start == nil {
+		return false
+	}
+	return time.Since(start.Time) > timeout.Duration
+}
+
+// handleProvisioningTimeout removes a device which took too long to provision
+// and moves the instance to the next fallback location. Without one left the
+// instance is marked failed.
+func (m *MetalClient) handleProvisioningTimeout(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, state string) (*equinixv1alpha1.InstanceStatus, error) {
+	_, err := m.Devices.Delete(status.InstanceID, true)
+	if err != nil && !IsNotFound(err) {
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, err)
+		return status, errors.Wrap(err, "error removing timed out device")
+	}
+
+	status.ProvisioningAttempts = append(status.ProvisioningAttempts, equinixv1alpha1.ProvisioningAttempt{
+		DeviceID: status.InstanceID,
+		Facility: status.Facility,
+		State:    "timeout",
+		Time:     metav1.Now(),
+	})
+	message := fmt.Sprintf("device %s still %s after %s", status.InstanceID, state, instance.Spec.ProvisioningTimeout.Duration)
+
+	next, ok := nextLocation(instance)
+	if !ok {
+		status.InstanceID = ""
+		status.ProvisioningStartTime = nil
+		status.Status = equinixv1alpha1.InstanceFailed
+		status.FailureReason = "ProvisioningTimeout"
+		status.FailureMessage = fmt.Sprintf("%s, no fallback locations left", message)
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, status.FailureReason, status.FailureMessage)
+		return status, nil
+	}
+
+	moveToLocation(instance, status, next, "ProvisioningTimeout", message)
+	return status, nil
+}
+
+// moveToLocation sends the instance back to device creation in location
+func moveToLocation(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, location string, reason string, message string) {
+	message = fmt.Sprintf("%s, retrying in %s", message, location)
+	status.Location = location
+	status.InstanceID = ""
+	status.Facility = ""
+	status.ProvisioningStartTime = nil
+	status.Status = "patched"
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionDeviceCreated, false, reason, message)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, reason, message)
+}
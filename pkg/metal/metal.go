@@ -3,12 +3,13 @@ package metal
 import (
 	"context"
 	"fmt"
-	"strings"
+	"net/http"
 
 	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
 	"github.com/packethost/packngo"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -24,7 +25,6 @@ const (
 )
 
 func NewClient(ctx context.Context, client client.Client, secret string, namespace string) (m *MetalClient, err error) {
-	m = &MetalClient{}
 	credSecret := &corev1.Secret{}
 
 	err = client.Get(ctx, types.NamespacedName{Name: secret, Namespace: namespace}, credSecret)
@@ -33,22 +33,66 @@ func NewClient(ctx context.Context, client client.Client, secret string, namespa
 		return nil, errors.Wrap(err, "error during credential secret lookup")
 	}
 
+	return clientFromSecret(credSecret, "")
+}
+
+// clientFromSecret builds a MetalClient from the keys of a credential secret.
+// A non empty projectID replaces PROJECT_ID from the secret.
+func clientFromSecret(credSecret *corev1.Secret, projectID string) (m *MetalClient, err error) {
 	key, ok := credSecret.Data["PACKET_AUTH_TOKEN"]
 	if !ok {
-		return nil, fmt.Errorf("no key PACKET_AUTH_TOKEN found in secret %s", secret)
+		return nil, fmt.Errorf("no key PACKET_AUTH_TOKEN found in secret %s", credSecret.Name)
 	}
 
-	m.Client = packngo.NewClientWithAuth("packngo lib", string(key), nil)
+	if projectID == "" {
+		secretProjectID, ok := credSecret.Data["PROJECT_ID"]
+		if !ok {
+			return nil, fmt.Errorf("no key PROJECT_ID specified in secret %s", credSecret.Name)
+		}
+		projectID = string(secretProjectID)
+	}
 
-	projectID, ok := credSecret.Data["PROJECT_ID"]
-	if !ok {
-		return nil, fmt.Errorf("no key PROJECT_ID specified in secret %s", secret)
+	// all clients for the same secret share one limiter so a burst of
+	// reconciles can not exceed the api rate limit of the credential
+	limiter := limiterFor(credSecret.Namespace + "/" + credSecret.Name)
+	// PACKET_API_URL is optional and allows pointing the operator at a different
+	// endpoint, such as the fakeapi server used in tests
+	return newClient(string(key), projectID, string(credSecret.Data["PACKET_API_URL"]), limiter)
+}
+
+// NewClientWithBaseURL returns a MetalClient talking to the api at baseURL.
+// An empty baseURL uses the default Equinix Metal endpoint
+func NewClientWithBaseURL(token string, projectID string, baseURL string) (m *MetalClient, err error) {
+	return newClient(token, projectID, baseURL, newLimiter())
+}
+
+func newClient(token string, projectID string, baseURL string, limiter *credentialLimiter) (m *MetalClient, err error) {
+	m = &MetalClient{ProjectID: projectID}
+	httpClient := &http.Client{Transport: &rateLimitedTransport{
+		base:    http.DefaultTransport,
+		limiter: limiter,
+	}}
+	if baseURL == "" {
+		m.Client = packngo.NewClientWithAuth("packngo lib", token, httpClient)
+		return m, nil
 	}
 
-	m.ProjectID = string(projectID)
+	m.Client, err = packngo.NewClientWithBaseURL("packngo lib", token, httpClient, baseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating metal client")
+	}
 	return m, nil
 }
 
+// ValidateCredentials checks the token is accepted and can access the project
+func (m *MetalClient) ValidateCredentials() error {
+	_, _, err := m.Projects.Get(m.ProjectID, nil)
+	if IsUnauthorized(err) || IsNotFound(err) {
+		return &CredentialsError{Err: err}
+	}
+	return err
+}
+
 // CreateElasticInterface creates and attaches ElasticInterface to instance
 func (m *MetalClient) CreateElasticInterface(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
 	status = instance.Status.DeepCopy()
@@ -56,6 +100,7 @@ func (m *MetalClient) CreateElasticInterface(instance *equinixv1alpha1.Instance)
 	var found bool
 	var reservationID string
 	var elasticIP string
+	var cidr int
 	project := m.ProjectID
 	if instance.Spec.ProjectID != "" {
 		project = instance.Spec.ProjectID
@@ -67,18 +112,22 @@ func (m *MetalClient) CreateElasticInterface(instance *equinixv1alpha1.Instance)
 		QueryParams: queryParam,
 	})
 
-	if err != nil && !strings.Contains(err.Error(), "404") {
+	if err != nil && !IsNotFound(err) {
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, err)
 		return status, err
 	}
 
 	if len(reservationList) > 1 {
-		return status, fmt.Errorf("multiple elastic interfaces found with the same tag")
+		err = fmt.Errorf("multiple elastic interfaces found with the same tag")
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, false, "DuplicateReservation", err.Error())
+		return status, err
 	}
 
 	if len(reservationList) == 1 {
 		found = true
 		reservationID = reservationList[0].ID
 		elasticIP = reservationList[0].Address
+		cidr = reservationList[0].CIDR
 	}
 
 	// prepare for updates
@@ -92,62 +141,140 @@ func (m *MetalClient) CreateElasticInterface(instance *equinixv1alpha1.Instance)
 
 	} else {
 
+		metro, err := m.reservationMetro(instance)
+		if err != nil {
+			setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, err)
+			return status, err
+		}
+
 		ipReq := &packngo.IPReservationRequest{
 			Type:     "public_ipv4",
 			Quantity: 1,
-			Tags:     []string{tag},
-			Metro:    &instance.Spec.Metro,
+			Tags:     []string{tag, OwnerTag("Instance", instance.Namespace, instance.Name)},
+			Metro:    &metro,
 		}
 
 		reservation, _, err := m.Client.ProjectIPs.Request(project, ipReq)
 		if err != nil {
+			setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, err)
 			return status, err
 		}
 		instance.Annotations[ReservationAnnotation] = reservation.ID
 		instance.Annotations[AddressAnnotation] = reservation.Address
+		cidr = reservation.CIDR
+	}
+
+	ElasticIPReserved(instance, status, equinixv1alpha1.InstanceElasticIP{
+		ReservationID: instance.Annotations[ReservationAnnotation],
+		Address:       instance.Annotations[AddressAnnotation],
+		CIDR:          cidr,
+	})
+	return status, nil
+}
+
+// ElasticIPReserved records the reservation used by the instance and moves it
+// on to device creation, or to waiting for its provisioning gates
+func ElasticIPReserved(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, elasticIP equinixv1alpha1.InstanceElasticIP) {
+	if instance.Annotations == nil {
+		instance.Annotations = make(map[string]string)
 	}
+	instance.Annotations[ReservationAnnotation] = elasticIP.ReservationID
+	instance.Annotations[AddressAnnotation] = elasticIP.Address
 
-	// instances need to be patched by hf-shim-operator.
-	// to make testing easier, we should be able to check if object contains annotation
-	// "waitforpatching". This is injected by objects created by hf-shim-operator.
-	// if not present then the object can go to patched state and complete provisionining
-	if _, ok := instance.Annotations["waitforpatching"]; ok {
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, false, "Reserved",
+		fmt.Sprintf("elastic ip %s reserved, waiting for device", elasticIP.Address))
+	SetElasticIPStatus(instance, status, elasticIP)
+
+	// instances using the legacy "waitforpatching" annotation wait for
+	// hf-shim-operator to move them to patched
+	if _, ok := instance.Annotations["waitforpatching"]; ok || len(instance.Spec.ProvisioningGates) > 0 {
 		status.Status = "elasticipcreated"
 	} else {
 		status.Status = "patched"
 	}
-
-	return status, nil
 }
 
 func (m *MetalClient) CreateNewDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
 	status = instance.Status.DeepCopy()
+
+	// an ElasticIP can not follow the instance to another metro
+	if instance.Spec.ElasticIP != "" {
+		failed, err := m.checkElasticIPMetro(instance, status)
+		if err != nil {
+			setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, err)
+			return status, err
+		}
+		if failed {
+			return status, nil
+		}
+	}
+
+	// after moving to another metro the elastic ip has to be reserved again
+	moved, err := m.reservationMoved(instance)
+	if err != nil {
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, err)
+		return status, err
+	}
+	if moved {
+		status.Status = ""
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, false, "Moving",
+			fmt.Sprintf("elastic ip released, reserving a new one for %s", instance.Status.Location))
+		return status, nil
+	}
+
+	project := instance.Spec.ProjectID
+	if project == "" {
+		project = m.ProjectID
+	}
+	existing, err := m.existingDevice(instance, project)
+	if err != nil {
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionDeviceCreated, err)
+		return status, err
+	}
+	if existing != nil {
+		deviceCreated(instance, status, existing, "Found", fmt.Sprintf("device %s was already created", existing.ID))
+		return status, nil
+	}
+
+	available, location := m.capacityAvailable(instance)
+	if !available {
+		waitForCapacity(instance, status, location)
+		return status, nil
+	}
+	if location != "" {
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionCapacityAvailable, true, "Available",
+			fmt.Sprintf("capacity for %s available in %s", instance.Spec.Plan, location))
+	}
+
 	dsr := m.generateDeviceCreationRequest(instance)
 	device, _, err := m.Devices.Create(dsr)
 	if err != nil {
+		if next, ok := nextLocation(instance); ok && IsCapacityUnavailable(err) {
+			moveToLocation(instance, status, next, ErrorReason(err), err.Error())
+			return status, nil
+		}
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionDeviceCreated, err)
 		return status, errors.Wrap(err, "error during device creation")
 	}
 
-	status.InstanceID = device.ID
-	status.Status = device.State
-	status.Facility = device.Facility.Code
-	return status, err
+	deviceCreated(instance, status, device, "Created", fmt.Sprintf("device %s created in %s", device.ID, device.Facility.Code))
+	return status, nil
 }
 
 func (m *MetalClient) generateDeviceCreationRequest(instance *equinixv1alpha1.Instance) (dsr *packngo.DeviceCreateRequest) {
+	metro, facilities := deviceLocation(instance)
 	dsr = &packngo.DeviceCreateRequest{
-		Hostname:              fmt.Sprintf("%s-%s", instance.Name, instance.Namespace),
+		Hostname:              deviceHostname(instance),
 		Plan:                  instance.Spec.Plan,
-		Facility:              instance.Spec.Facility,
-		Metro:                 instance.Spec.Metro,
+		Facility:              facilities,
+		Metro:                 metro,
 		ProjectID:             instance.Spec.ProjectID,
 		AlwaysPXE:             instance.Spec.AlwaysPXE,
-		Tags:                  instance.Spec.Tags,
+		Tags:                  append([]string{OwnerTag("Instance", instance.Namespace, instance.Name), uidTag(instance)}, instance.Spec.Tags...),
 		Description:           instance.Spec.Description,
 		PublicIPv4SubnetSize:  instance.Spec.PublicIPv4SubnetSize,
 		HardwareReservationID: instance.Spec.HardwareReservationID,
-		SpotInstance:          instance.Spec.SpotInstance,
-		SpotPriceMax:          instance.Spec.SpotPriceMax.AsApproximateFloat64(),
+		SpotInstance:          IsSpot(instance),
 		CustomData:            instance.Spec.CustomData,
 		UserSSHKeys:           instance.Spec.UserSSHKeys,
 		ProjectSSHKeys:        instance.Spec.ProjectSSHKeys,
@@ -159,6 +286,9 @@ func (m *MetalClient) generateDeviceCreationRequest(instance *equinixv1alpha1.In
 		UserData:              instance.Spec.UserData,
 	}
 
+	if dsr.SpotInstance {
+		dsr.SpotPriceMax = instance.Spec.SpotPriceMax.AsApproximateFloat64()
+	}
 	if dsr.ProjectID == "" {
 		dsr.ProjectID = m.ProjectID
 	}
@@ -167,34 +297,152 @@ func (m *MetalClient) generateDeviceCreationRequest(instance *equinixv1alpha1.In
 
 func (m *MetalClient) CheckDeviceStatus(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
 	status = instance.Status.DeepCopy()
-	deviceStatus, _, err := m.Devices.Get(instance.Status.InstanceID, nil)
+	deviceStatus, _, err := m.Devices.Get(instance.Status.InstanceID, portIncludes)
 	if err != nil {
+		if IsNotFound(err) {
+			// device was removed outside of the operator
+			return m.handleFailedDevice(instance, status, "deleted")
+		}
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, err)
 		return status, err
 	}
 
-	if deviceStatus.State == "active" {
-
-		// check and attach EIP if needed
-		err = m.checkAndAttachElasticIP(instance, deviceStatus)
-		if err != nil {
-			return status, err
+	switch deviceStatus.State {
+	case "active":
+	case "queued", "provisioning", "post_provisioning", "reinstalling", "powering_on":
+		if provisioningTimedOut(instance) {
+			return m.handleProvisioningTimeout(instance, status, deviceStatus.State)
 		}
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, "Provisioning",
+			fmt.Sprintf("device is %s", deviceStatus.State))
+		return status, nil
+	case "inactive", "powering_off":
+		// device was powered off, nothing to configure until it comes back
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, "DeviceInactive",
+			fmt.Sprintf("device is %s", deviceStatus.State))
+		return status, nil
+	case "failed", "deprovisioning", "deleted":
+		return m.handleFailedDevice(instance, status, deviceStatus.State)
+	default:
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, "UnknownState",
+			fmt.Sprintf("device is in unexpected state %s", deviceStatus.State))
+		return status, nil
+	}
 
-		// perform network conversion
-		err = m.UpdateNetworkConfig(instance, deviceStatus)
-		if err != nil {
-			return status, err
-		}
+	// check and attach EIP if needed
+	err = m.checkAndAttachElasticIP(instance, deviceStatus)
+	if err != nil {
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, err)
+		return status, err
+	}
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, true, "Attached",
+		fmt.Sprintf("elastic ip %s attached to device", instance.Annotations[AddressAnnotation]))
 
-		status.Status = "active"
-		status.PrivateIP = deviceStatus.GetNetworkInfo().PublicIPv4
-		status.PublicIP = instance.Annotations[AddressAnnotation]
+	// perform network conversion
+	err = m.recordNetwork(status, deviceStatus.ID, m.UpdateNetworkConfig(instance, deviceStatus))
+	if err != nil {
+		setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionNetworkConfigured, err)
+		return status, err
 	}
+	networkType := instance.Spec.NetworkType
+	if networkType == "" {
+		networkType = deviceStatus.GetNetworkType()
+	}
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionNetworkConfigured, true, "Configured",
+		fmt.Sprintf("network type is %s", networkType))
+
+	status.Status = "active"
+	status.ProvisioningStartTime = nil
+	deviceAddresses(instance, status, deviceStatus)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, true, "DeviceActive", "device is active")
+	spotReplaced(instance, status)
 
 	return status, nil
 }
 
+// deviceAddresses records the addresses of an active device. The management
+// address is dropped in layer2 and a new one assigned when going back to
+// layer3, devices adopted without an elastic ip report it as public ip.
+func deviceAddresses(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, device *packngo.Device) {
+	status.PrivateIP = device.GetNetworkInfo().PublicIPv4
+	status.PublicIP = instance.Annotations[AddressAnnotation]
+	if status.PublicIP == "" {
+		status.PublicIP = status.PrivateIP
+	}
+}
+
+// handleFailedDevice applies the instance DeviceFailurePolicy to a device which
+// will never become active. The attempt is recorded and the instance is either
+// marked failed or sent back to device creation after removing the device.
+func (m *MetalClient) handleFailedDevice(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, state string) (*equinixv1alpha1.InstanceStatus, error) {
+	status.ProvisioningAttempts = append(status.ProvisioningAttempts, equinixv1alpha1.ProvisioningAttempt{
+		DeviceID: status.InstanceID,
+		Facility: status.Facility,
+		State:    state,
+		Time:     metav1.Now(),
+	})
+
+	maxAttempts := instance.Spec.MaxProvisioningAttempts
+	if maxAttempts == 0 {
+		maxAttempts = equinixv1alpha1.DefaultMaxProvisioningAttempts
+	}
+	attempts := failedAttempts(status)
+	message := fmt.Sprintf("device %s is %s", status.InstanceID, state)
+
+	if instance.Spec.DeviceFailurePolicy != equinixv1alpha1.DeviceFailurePolicyReprovision || attempts >= maxAttempts {
+		// the failed device is left in place for inspection, it is removed along with the instance
+		status.Status = equinixv1alpha1.InstanceFailed
+		status.FailureReason = "DeviceFailed"
+		status.FailureMessage = fmt.Sprintf("%s after %d attempt(s)", message, attempts)
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, status.FailureReason, status.FailureMessage)
+		return status, nil
+	}
+
+	if state != "deleted" {
+		_, err := m.Devices.Delete(status.InstanceID, true)
+		if err != nil && !IsNotFound(err) {
+			setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, err)
+			return status, errors.Wrap(err, "error removing failed device")
+		}
+	}
+
+	message = fmt.Sprintf("%s, reprovisioning attempt %d of %d", message, attempts+1, maxAttempts)
+	status.InstanceID = ""
+	status.Facility = ""
+	status.Status = "patched"
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionDeviceCreated, false, "Reprovisioning", message)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, "Reprovisioning", message)
+	return status, nil
+}
+
+// untriedFacilities drops facilities which already had a failed device from
+// the requested list. When all of them failed the full list is tried again.
+func untriedFacilities(instance *equinixv1alpha1.Instance) []string {
+	failed := make(map[string]bool)
+	for _, attempt := range instance.Status.ProvisioningAttempts {
+		failed[attempt.Facility] = true
+	}
+
+	var facilities []string
+	for _, facility := range instance.Spec.Facility {
+		if !failed[facility] {
+			facilities = append(facilities, facility)
+		}
+	}
+
+	if len(facilities) == 0 {
+		return instance.Spec.Facility
+	}
+	return facilities
+}
+
 func (m *MetalClient) DeleteDevice(instance *equinixv1alpha1.Instance) (err error) {
+	switch instance.Spec.DeletionPolicy {
+	case equinixv1alpha1.DeletionPolicyRetain:
+		return m.releaseDevice(instance)
+	case equinixv1alpha1.DeletionPolicyOrphan:
+		return nil
+	}
 
 	ok, err := m.deviceExists(instance.Status.InstanceID)
 	if err != nil {
@@ -203,19 +451,25 @@ func (m *MetalClient) DeleteDevice(instance *equinixv1alpha1.Instance) (err erro
 
 	// device exists. terminate the same.
 	if ok {
+		// vlans stay assigned while the device is deprovisioning, which
+		// would keep them from being deleted
+		err = m.DetachDeviceVLANs(instance.Status.InstanceID)
+		if err != nil {
+			return err
+		}
 		_, err = m.Devices.Delete(instance.Status.InstanceID, true)
 		if err != nil {
 			return err
 		}
 	}
 
-	// delete elastic interface //
+	// delete elastic interface, reservations of an ElasticIP resource outlive the instance //
 	elasticReservationID, ok := instance.Annotations[ReservationAnnotation]
 
-	if ok {
+	if ok && instance.Spec.ElasticIP == "" {
 		_, err = m.ProjectIPs.Remove(elasticReservationID)
 		// ignore if IP has already been deleted
-		if err != nil && strings.Contains(err.Error(), "404") {
+		if IsNotFound(err) {
 			return nil
 		}
 		return err
@@ -248,125 +502,27 @@ func (m *MetalClient) UpdateNetworkConfig(instance *equinixv1alpha1.Instance, de
 		return nil
 	}
 
-	err := m.ConvertDevice(device, instance.Spec.NetworkType)
+	// batches submitted by an earlier reconcile have to complete first
+	err := m.checkVLANBatches(instance, device)
 	if err != nil {
 		return err
 	}
 
-	// apply VLANS
-	for netInterface, VlanIDS := range instance.Spec.VLANAttachments {
-		port, err := device.GetPortByName(netInterface)
-		if err != nil {
-			return err
-		}
-
-		for _, vlan := range VlanIDS {
-			_, _, err = m.Client.Ports.Assign(port.ID, vlan)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
-
-// ConvertDevice is fork from Packngo ConvertDevice. Changed to use non deprecated port service
-// methods
-func (m *MetalClient) ConvertDevice(d *packngo.Device, targetType string) error {
-	bondPorts := d.GetBondPorts()
-	allEthPorts := d.GetPhysicalPorts()
-
-	bond0Port := bondPorts["bond0"]
-	var oddEthPorts []packngo.Port
-	for _, portName := range []string{"eth1", "eth3", "eth5", "eth7", "eth9"} {
-		if ethPort, ok := allEthPorts[portName]; ok {
-			oddEthPorts = append(oddEthPorts, *ethPort)
-		}
-
-	}
-
-	if targetType == "layer3" {
-		// TODO: remove vlans from all the ports
-		for _, p := range bondPorts {
-			_, _, err := m.Client.Ports.Bond(p.ID, false)
-			if err != nil {
-				return err
-			}
-		}
-
-		_, _, err := m.Client.Ports.ConvertToLayerThree(bond0Port.ID, []packngo.AddressRequest{
-			{AddressFamily: 4, Public: true},
-			{AddressFamily: 4, Public: false},
-			{AddressFamily: 6, Public: true},
-		})
-
-		if err != nil {
-			return err
-		}
-
-		for _, p := range allEthPorts {
-			_, _, err := m.Client.Ports.Bond(p.ID, false)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	}
-
-	if targetType == "hybrid" {
-		// ports need to be refreshed before bonding/disbonding
-		for _, p := range oddEthPorts {
-			if p.DisbondOperationSupported {
-				_, _, err := m.Client.Ports.Disbond(p.ID, false)
-				if err != nil {
-					return err
-				}
-			}
-		}
-		return nil
-	}
-
-	if targetType == "layer2-individual" {
-		_, _, err := m.Client.Ports.ConvertToLayerTwo(bond0Port.ID)
-		if err != nil {
-			return err
-		}
-		for _, p := range allEthPorts {
-			if p.DisbondOperationSupported {
-				_, _, err = m.Client.Ports.Disbond(p.ID, true)
-				if err != nil {
-					return err
-				}
-			}
-		}
-		return nil
-	}
-
-	if targetType == "layer2-bonded" {
-
-		for _, p := range bondPorts {
-			_, _, err := m.Client.Ports.ConvertToLayerTwo(p.ID)
-			if err != nil {
-				return err
-			}
-		}
-		for _, p := range allEthPorts {
-			_, _, err := m.Client.Ports.Bond(p.ID, false)
-			if err != nil {
-				return err
-			}
-		}
-
-		return nil
+	// vlans no longer wanted are removed before converting, ports with vlans
+	// can not go back to layer3
+	desired := desiredVLANs(instance)
+	err = m.detachVLANs(device, desired)
+	if err != nil {
+		return err
 	}
 
-	if targetType == "hybrid-bonded" {
-		// nothing needs to be done. VLANS are just applied to bond0 interface
-		return nil
+	err = m.ConvertDevice(device, instance.Spec.NetworkType)
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("invalid network type %s in instance", targetType)
+	// apply VLANS
+	return m.attachVLANs(device, desired, desiredNativeVLANs(instance))
 }
 
 func (m *MetalClient) checkAndAttachElasticIP(instance *equinixv1alpha1.Instance, device *packngo.Device) error {
@@ -378,14 +534,18 @@ func (m *MetalClient) checkAndAttachElasticIP(instance *equinixv1alpha1.Instance
 		}
 	}
 
-	if additionalAttachment {
-		// nothing else to do.. device already has an EIP
+	if additionalAttachment || instance.Annotations[AddressAnnotation] == "" {
+		// nothing else to do.. device already has an EIP, or was adopted without one
 		return nil
 	}
 
-	// perform EIP attachment
+	// perform EIP attachment, blocks are assigned as a whole
+	address := instance.Annotations[AddressAnnotation]
+	if elasticIP := instance.Status.ElasticIP; elasticIP != nil && elasticIP.CIDR > 0 && elasticIP.Address == address {
+		address = fmt.Sprintf("%s/%d", address, elasticIP.CIDR)
+	}
 	_, _, err := m.Client.DeviceIPs.Assign(instance.Status.InstanceID, &packngo.AddressStruct{
-		Address: instance.Annotations[AddressAnnotation],
+		Address: address,
 	})
 
 	return err
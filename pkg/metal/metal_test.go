@@ -0,0 +1,573 @@
+package metal
+
+import (
+	"testing"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/metal-operator/pkg/metal/fakeapi"
+	"github.com/packethost/packngo"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testProject = "project-test"
+
+func newTestClient(t *testing.T) (*MetalClient, *fakeapi.Server) {
+	t.Helper()
+	server := fakeapi.NewServer()
+	t.Cleanup(server.Close)
+
+	m, err := NewClientWithBaseURL("token", testProject, server.BaseURL())
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	return m, server
+}
+
+func newTestInstance() *equinixv1alpha1.Instance {
+	return &equinixv1alpha1.Instance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "instance-sample",
+			Namespace: "default",
+		},
+		Spec: equinixv1alpha1.InstanceSpec{
+			Plan:            "c3.small.x86",
+			Metro:           "sg",
+			OperatingSystem: "ubuntu_20_04",
+			BillingCycle:    "hourly",
+		},
+	}
+}
+
+// provision walks the instance through the same steps as the reconciler
+func provision(t *testing.T, m *MetalClient, instance *equinixv1alpha1.Instance) {
+	t.Helper()
+	status, err := m.CreateElasticInterface(instance)
+	if err != nil {
+		t.Fatalf("error creating elastic interface: %v", err)
+	}
+	instance.Status = *status
+
+	status, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	instance.Status = *status
+
+	for i := 0; i < 5 && instance.Status.Status != "active"; i++ {
+		status, err = m.CheckDeviceStatus(instance)
+		if err != nil {
+			t.Fatalf("error checking device status: %v", err)
+		}
+		instance.Status = *status
+	}
+}
+
+func TestCheckDeviceStatus(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+
+	provision(t, m, instance)
+	if instance.Status.Status != "active" {
+		t.Fatalf("expected device to be active, got %s", instance.Status.Status)
+	}
+	if instance.Status.PublicIP != instance.Annotations[AddressAnnotation] {
+		t.Errorf("expected public ip %s, got %s", instance.Annotations[AddressAnnotation], instance.Status.PublicIP)
+	}
+	for _, condition := range []string{
+		equinixv1alpha1.ConditionElasticIPReady,
+		equinixv1alpha1.ConditionDeviceCreated,
+		equinixv1alpha1.ConditionNetworkConfigured,
+		equinixv1alpha1.ConditionReady,
+	} {
+		if !meta.IsStatusConditionTrue(instance.Status.Conditions, condition) {
+			t.Errorf("expected condition %s to be true", condition)
+		}
+	}
+
+	device, ok := server.Device(instance.Status.InstanceID)
+	if !ok {
+		t.Fatalf("device %s not found", instance.Status.InstanceID)
+	}
+	var attached bool
+	for _, ip := range device.Network {
+		if !ip.Management && ip.Address == instance.Annotations[AddressAnnotation] {
+			attached = true
+		}
+	}
+	if !attached {
+		t.Errorf("elastic ip was not attached to device")
+	}
+}
+
+func TestCheckDeviceStatusNotReady(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+
+	status, err := m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	instance.Status = *status
+	server.HoldDevice(instance.Status.InstanceID, true)
+
+	status, err = m.CheckDeviceStatus(instance)
+	if err != nil {
+		t.Fatalf("error checking device status: %v", err)
+	}
+	if status.Status != "queued" {
+		t.Errorf("expected status queued, got %s", status.Status)
+	}
+}
+
+func TestCreateNewDeviceInvalidPlan(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	server.AddFault(fakeapi.Fault{Method: "POST", Path: "/projects/", Status: 422, Message: "Plan is not valid"})
+
+	status, err := m.CreateNewDevice(instance)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !IsTerminal(err) {
+		t.Errorf("expected terminal error, got %v", err)
+	}
+	condition := meta.FindStatusCondition(status.Conditions, equinixv1alpha1.ConditionDeviceCreated)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "InvalidRequest" {
+		t.Errorf("unexpected DeviceCreated condition %v", condition)
+	}
+}
+
+func TestConvertDevice(t *testing.T) {
+	tests := []struct {
+		networkType string
+		expected    string
+	}{
+		{networkType: "hybrid", expected: packngo.NetworkTypeHybrid},
+		{networkType: "layer2-individual", expected: packngo.NetworkTypeL2Individual},
+		{networkType: "layer2-bonded", expected: packngo.NetworkTypeL2Bonded},
+		{networkType: "layer3", expected: packngo.NetworkTypeL3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.networkType, func(t *testing.T) {
+			m, server := newTestClient(t)
+			instance := newTestInstance()
+			provision(t, m, instance)
+
+			device, _ := server.Device(instance.Status.InstanceID)
+			if err := m.ConvertDevice(device, tt.networkType); err != nil {
+				t.Fatalf("error converting device: %v", err)
+			}
+
+			device, _ = server.Device(instance.Status.InstanceID)
+			if got := device.NetworkPorts[0].NetworkType; got != tt.expected {
+				t.Errorf("expected network type %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestUpdateNetworkConfig(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.NetworkType = "hybrid"
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {"1000"}}
+	provision(t, m, instance)
+
+	device, _ := server.Device(instance.Status.InstanceID)
+	port, err := device.GetPortByName("eth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(port.AttachedVirtualNetworks) != 1 || port.AttachedVirtualNetworks[0].ID != "1000" {
+		t.Errorf("expected vlan 1000 on eth1, got %v", port.AttachedVirtualNetworks)
+	}
+}
+
+func TestDeleteDevice(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	provision(t, m, instance)
+
+	if err := m.DeleteDevice(instance); err != nil {
+		t.Fatalf("error deleting device: %v", err)
+	}
+	if _, ok := server.Device(instance.Status.InstanceID); ok {
+		t.Errorf("device %s still exists", instance.Status.InstanceID)
+	}
+	if _, ok := server.Reservation(instance.Annotations[ReservationAnnotation]); ok {
+		t.Errorf("reservation %s still exists", instance.Annotations[ReservationAnnotation])
+	}
+
+	// deleting again is a no-op
+	if err := m.DeleteDevice(instance); err != nil {
+		t.Errorf("expected second delete to succeed, got %v", err)
+	}
+}
+
+func TestDeleteDeviceRetain(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.DeletionPolicy = equinixv1alpha1.DeletionPolicyRetain
+	provision(t, m, instance)
+
+	// retaining twice only tags once
+	for i := 0; i < 2; i++ {
+		if err := m.DeleteDevice(instance); err != nil {
+			t.Fatalf("error releasing device: %v", err)
+		}
+	}
+
+	device, ok := server.Device(instance.Status.InstanceID)
+	if !ok {
+		t.Fatalf("device %s was removed", instance.Status.InstanceID)
+	}
+	if device.Tags[len(device.Tags)-1] != ReleasedTag || hasTag(device.Tags[:len(device.Tags)-1], ReleasedTag) {
+		t.Errorf("expected device to be tagged %s once, got %v", ReleasedTag, device.Tags)
+	}
+	reservation, ok := server.Reservation(instance.Annotations[ReservationAnnotation])
+	if !ok {
+		t.Fatalf("reservation %s was removed", instance.Annotations[ReservationAnnotation])
+	}
+	if !hasTag(reservation.Tags, ReleasedTag) {
+		t.Errorf("expected reservation to be tagged %s, got %v", ReleasedTag, reservation.Tags)
+	}
+}
+
+func TestDeleteDeviceOrphan(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.DeletionPolicy = equinixv1alpha1.DeletionPolicyOrphan
+	provision(t, m, instance)
+
+	if err := m.DeleteDevice(instance); err != nil {
+		t.Fatalf("error orphaning device: %v", err)
+	}
+	device, ok := server.Device(instance.Status.InstanceID)
+	if !ok {
+		t.Fatalf("device %s was removed", instance.Status.InstanceID)
+	}
+	if hasTag(device.Tags, ReleasedTag) {
+		t.Errorf("orphaned device should not be tagged, got %v", device.Tags)
+	}
+}
+
+func TestImportKeyPair(t *testing.T) {
+	m, server := newTestClient(t)
+	keyPair := &equinixv1alpha1.ImportKeyPair{
+		ObjectMeta: metav1.ObjectMeta{Name: "key", Namespace: "default"},
+		Spec:       equinixv1alpha1.ImportKeyPairSpec{Key: "ssh-rsa AAAAB3NzaC1yc2E"},
+	}
+
+	status, err := m.CreateImportKeyPair(keyPair)
+	if err != nil {
+		t.Fatalf("error importing key pair: %v", err)
+	}
+	keyPair.Status = *status
+	if _, ok := server.SSHKey(status.KeyPairID); !ok {
+		t.Fatalf("key pair %s not found", status.KeyPairID)
+	}
+
+	if err := m.DeleteKeyPair(keyPair); err != nil {
+		t.Fatalf("error deleting key pair: %v", err)
+	}
+	if _, ok := server.SSHKey(status.KeyPairID); ok {
+		t.Errorf("key pair %s still exists", status.KeyPairID)
+	}
+	if err := m.DeleteKeyPair(keyPair); err != nil {
+		t.Errorf("expected second delete to succeed, got %v", err)
+	}
+}
+
+func TestCheckDeviceStatusFailed(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+
+	status, err := m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	instance.Status = *status
+	server.SetDeviceState(instance.Status.InstanceID, "failed")
+
+	status, err = m.CheckDeviceStatus(instance)
+	if err != nil {
+		t.Fatalf("error checking device status: %v", err)
+	}
+	if status.Status != equinixv1alpha1.InstanceFailed || status.FailureReason != "DeviceFailed" {
+		t.Errorf("expected instance to be failed, got %s %s", status.Status, status.FailureReason)
+	}
+	if len(status.ProvisioningAttempts) != 1 {
+		t.Errorf("expected 1 provisioning attempt, got %d", len(status.ProvisioningAttempts))
+	}
+	// failed devices are kept around for inspection
+	if _, ok := server.Device(instance.Status.InstanceID); !ok {
+		t.Errorf("failed device should not have been removed")
+	}
+}
+
+func TestCheckDeviceStatusReprovision(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.Metro = ""
+	instance.Spec.Facility = []string{"sg1", "sg2"}
+	instance.Spec.DeviceFailurePolicy = equinixv1alpha1.DeviceFailurePolicyReprovision
+	instance.Spec.MaxProvisioningAttempts = 2
+
+	status, err := m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	instance.Status = *status
+	firstDevice := instance.Status.InstanceID
+	server.SetDeviceState(firstDevice, "failed")
+
+	status, err = m.CheckDeviceStatus(instance)
+	if err != nil {
+		t.Fatalf("error checking device status: %v", err)
+	}
+	instance.Status = *status
+	if instance.Status.Status != "patched" || instance.Status.InstanceID != "" {
+		t.Fatalf("expected instance to go back to device creation, got %s %s", instance.Status.Status, instance.Status.InstanceID)
+	}
+	if _, ok := server.Device(firstDevice); ok {
+		t.Errorf("failed device %s should have been removed", firstDevice)
+	}
+
+	status, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	instance.Status = *status
+	if instance.Status.Facility != "sg2" {
+		t.Errorf("expected second attempt in sg2, got %s", instance.Status.Facility)
+	}
+
+	// second failure exhausts the attempts
+	server.SetDeviceState(instance.Status.InstanceID, "failed")
+	status, err = m.CheckDeviceStatus(instance)
+	if err != nil {
+		t.Fatalf("error checking device status: %v", err)
+	}
+	if status.Status != equinixv1alpha1.InstanceFailed {
+		t.Errorf("expected instance to be failed, got %s", status.Status)
+	}
+	if len(status.ProvisioningAttempts) != 2 {
+		t.Errorf("expected 2 provisioning attempts, got %d", len(status.ProvisioningAttempts))
+	}
+}
+
+func TestCheckDeviceStatusDeviceRemoved(t *testing.T) {
+	m, _ := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.DeviceFailurePolicy = equinixv1alpha1.DeviceFailurePolicyReprovision
+	instance.Status.InstanceID = "device-missing"
+	instance.Status.Status = "queued"
+
+	status, err := m.CheckDeviceStatus(instance)
+	if err != nil {
+		t.Fatalf("error checking device status: %v", err)
+	}
+	if status.Status != "patched" || status.ProvisioningAttempts[0].State != "deleted" {
+		t.Errorf("expected removed device to be reprovisioned, got %s", status.Status)
+	}
+}
+
+func TestCreateNewDeviceCapacityFallback(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.FallbackLocations = []string{"sg2", "da"}
+	server.AddFault(fakeapi.Fault{Method: "POST", Path: "/projects/" + testProject + "/devices", Status: 422, Times: 1,
+		Message: "The metro sg has no provisionable c3.small.x86 servers matching your criteria"})
+
+	status, err := m.CreateElasticInterface(instance)
+	if err != nil {
+		t.Fatalf("error creating elastic interface: %v", err)
+	}
+	instance.Status = *status
+	reservationID := instance.Annotations[ReservationAnnotation]
+
+	status, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("expected capacity error to move to the next location, got %v", err)
+	}
+	instance.Status = *status
+	if instance.Status.Location != "sg2" || instance.Status.Status != "patched" {
+		t.Fatalf("expected instance to move to sg2, got %q %s", instance.Status.Location, instance.Status.Status)
+	}
+	condition := meta.FindStatusCondition(instance.Status.Conditions, equinixv1alpha1.ConditionDeviceCreated)
+	if condition == nil || condition.Reason != "CapacityUnavailable" {
+		t.Errorf("unexpected DeviceCreated condition %v", condition)
+	}
+
+	// sg2 is in the same metro so the reservation is kept
+	provision(t, m, instance)
+	if instance.Status.Status != "active" || instance.Status.Facility != "sg2" {
+		t.Fatalf("expected device to be active in sg2, got %s in %s", instance.Status.Status, instance.Status.Facility)
+	}
+	if instance.Annotations[ReservationAnnotation] != reservationID {
+		t.Errorf("expected reservation %s to be kept, got %s", reservationID, instance.Annotations[ReservationAnnotation])
+	}
+}
+
+func TestCheckDeviceStatusTimeout(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.ProvisioningTimeout = &metav1.Duration{Duration: 30 * time.Minute}
+	instance.Spec.FallbackLocations = []string{"da"}
+
+	status, err := m.CreateElasticInterface(instance)
+	if err != nil {
+		t.Fatalf("error creating elastic interface: %v", err)
+	}
+	instance.Status = *status
+	oldReservation := instance.Annotations[ReservationAnnotation]
+
+	status, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	instance.Status = *status
+	firstDevice := instance.Status.InstanceID
+	server.HoldDevice(firstDevice, true)
+
+	// not timed out yet
+	status, err = m.CheckDeviceStatus(instance)
+	if err != nil {
+		t.Fatalf("error checking device status: %v", err)
+	}
+	if status.Status != "queued" {
+		t.Fatalf("expected device to still be queued, got %s", status.Status)
+	}
+
+	started := metav1.NewTime(time.Now().Add(-time.Hour))
+	instance.Status.ProvisioningStartTime = &started
+	status, err = m.CheckDeviceStatus(instance)
+	if err != nil {
+		t.Fatalf("error checking device status: %v", err)
+	}
+	instance.Status = *status
+	if instance.Status.Location != "da" || instance.Status.Status != "patched" {
+		t.Fatalf("expected instance to move to da, got %q %s", instance.Status.Location, instance.Status.Status)
+	}
+	if _, ok := server.Device(firstDevice); ok {
+		t.Errorf("timed out device %s should have been removed", firstDevice)
+	}
+	if len(instance.Status.ProvisioningAttempts) != 1 || instance.Status.ProvisioningAttempts[0].State != "timeout" {
+		t.Errorf("expected a timeout attempt, got %v", instance.Status.ProvisioningAttempts)
+	}
+
+	// the metro changed so the elastic ip is released and reserved again
+	status, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	instance.Status = *status
+	if instance.Status.Status != "" {
+		t.Fatalf("expected instance to go back to elastic ip creation, got %s", instance.Status.Status)
+	}
+	if _, ok := server.Reservation(oldReservation); ok {
+		t.Errorf("reservation %s in the old metro should have been released", oldReservation)
+	}
+
+	provision(t, m, instance)
+	if instance.Status.Status != "active" {
+		t.Fatalf("expected device to be active, got %s", instance.Status.Status)
+	}
+	reservation, ok := server.Reservation(instance.Annotations[ReservationAnnotation])
+	if !ok || reservation.Metro == nil || reservation.Metro.Code != "da" {
+		t.Errorf("expected elastic ip to be reserved in da, got %v", reservation)
+	}
+}
+
+func TestCheckDeviceStatusTimeoutNoFallback(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.ProvisioningTimeout = &metav1.Duration{Duration: time.Minute}
+
+	status, err := m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	instance.Status = *status
+	server.HoldDevice(instance.Status.InstanceID, true)
+	started := metav1.NewTime(time.Now().Add(-time.Hour))
+	instance.Status.ProvisioningStartTime = &started
+
+	status, err = m.CheckDeviceStatus(instance)
+	if err != nil {
+		t.Fatalf("error checking device status: %v", err)
+	}
+	if status.Status != equinixv1alpha1.InstanceFailed || status.FailureReason != "ProvisioningTimeout" {
+		t.Errorf("expected instance to fail with ProvisioningTimeout, got %s %s", status.Status, status.FailureReason)
+	}
+}
+
+func TestCreateNewDeviceWaitingForCapacity(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	server.SetCapacity("sg", false)
+
+	status, err := m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	instance.Status = *status
+	if instance.Status.Status != equinixv1alpha1.InstanceWaitingForCapacity || instance.Status.InstanceID != "" {
+		t.Fatalf("expected instance to wait for capacity, got %s %s", instance.Status.Status, instance.Status.InstanceID)
+	}
+	if !meta.IsStatusConditionFalse(instance.Status.Conditions, equinixv1alpha1.ConditionCapacityAvailable) {
+		t.Errorf("expected CapacityAvailable to be false")
+	}
+	if interval := CapacityRetryInterval(&instance.Status); interval != minCapacityRetryInterval {
+		t.Errorf("expected first retry after %s, got %s", minCapacityRetryInterval, interval)
+	}
+
+	// the wait grows with the time spent waiting
+	condition := meta.FindStatusCondition(instance.Status.Conditions, equinixv1alpha1.ConditionCapacityAvailable)
+	condition.LastTransitionTime = metav1.NewTime(time.Now().Add(-4 * time.Minute))
+	if interval := CapacityRetryInterval(&instance.Status); interval < 4*time.Minute || interval > 5*time.Minute {
+		t.Errorf("expected retry interval of about 4m, got %s", interval)
+	}
+	condition.LastTransitionTime = metav1.NewTime(time.Now().Add(-time.Hour))
+	if interval := CapacityRetryInterval(&instance.Status); interval != maxCapacityRetryInterval {
+		t.Errorf("expected retry interval to be capped at %s, got %s", maxCapacityRetryInterval, interval)
+	}
+
+	server.SetCapacity("sg", true)
+	status, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	if status.InstanceID == "" || !meta.IsStatusConditionTrue(status.Conditions, equinixv1alpha1.ConditionCapacityAvailable) {
+		t.Errorf("expected device to be created once capacity is available")
+	}
+}
+
+func TestCreateNewDeviceCapacityCheckFallback(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.Metro = ""
+	instance.Spec.Facility = []string{"sg1"}
+	instance.Spec.FallbackLocations = []string{"sg2"}
+	server.SetCapacity("sg1", false)
+
+	status, err := m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	instance.Status = *status
+	if instance.Status.Location != "sg2" || instance.Status.Status != "patched" {
+		t.Fatalf("expected instance to move to sg2, got %q %s", instance.Status.Location, instance.Status.Status)
+	}
+
+	status, err = m.CreateNewDevice(instance)
+	if err != nil {
+		t.Fatalf("error creating device: %v", err)
+	}
+	if status.Facility != "sg2" {
+		t.Errorf("expected device in sg2, got %s", status.Facility)
+	}
+}
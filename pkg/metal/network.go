@@ -0,0 +1,241 @@
+package metal
+
+import (
+	"fmt"
+	"sort"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+const (
+	// NetworkTypeHybridBonded keeps the ports bonded in layer3 with vlans on bond0
+	NetworkTypeHybridBonded = "hybrid-bonded"
+
+	// maxNetworkSteps bounds the calls made converting a device, every
+	// conversion finishes in a few steps unless the api ignores them
+	maxNetworkSteps = 16
+)
+
+// oddPorts are disbonded in hybrid mode to carry vlans
+var oddPorts = []string{"eth1", "eth3", "eth5", "eth7", "eth9"}
+
+// networkStep is a single call moving the ports of a device towards a
+// network type
+type networkStep struct {
+	description string
+	run         func() error
+}
+
+// ConvertDevice moves the ports of the device to the network type. The
+// current bonding and layer of the ports is read first and only the missing
+// transitions are made, one at a time, reading the device again after each.
+// A conversion interrupted by an error picks up where it stopped when run
+// again. The device is updated to the state reached.
+func (m *MetalClient) ConvertDevice(d *packngo.Device, targetType string) error {
+	switch targetType {
+	case packngo.NetworkTypeL3, packngo.NetworkTypeHybrid, NetworkTypeHybridBonded,
+		packngo.NetworkTypeL2Bonded, packngo.NetworkTypeL2Individual:
+	default:
+		return fmt.Errorf("invalid network type %s in instance", targetType)
+	}
+
+	for i := 0; i < maxNetworkSteps; i++ {
+		step := m.nextNetworkStep(d, targetType)
+		if step == nil {
+			return nil
+		}
+		if err := step.run(); err != nil {
+			return errors.Wrapf(err, "error converting device to %s, %s", targetType, step.description)
+		}
+		refreshed, _, err := m.Devices.Get(d.ID, portIncludes)
+		if err != nil {
+			return errors.Wrap(err, "error reading device ports")
+		}
+		*d = *refreshed
+	}
+	return fmt.Errorf("device %s did not reach network type %s after %d steps", d.ID, targetType, maxNetworkSteps)
+}
+
+// nextNetworkStep returns the next call needed to reach the network type or
+// nil once the ports are there. Ports move to layer3 before bonding and to
+// layer2 after it, so the management addresses are only dropped as the last
+// step of a conversion to layer2.
+func (m *MetalClient) nextNetworkStep(d *packngo.Device, targetType string) *networkStep {
+	bond0 := devicePort(d, "bond0")
+	if bond0 == nil {
+		return nil
+	}
+	layer3 := d.HasManagementIPs()
+	wantLayer3 := targetType != packngo.NetworkTypeL2Bonded && targetType != packngo.NetworkTypeL2Individual
+
+	// layer3 ports carry no vlans, and bond0 can not go back to layer3 with
+	// vlans assigned
+	if targetType == packngo.NetworkTypeL3 || (wantLayer3 && !layer3) {
+		for i := range d.NetworkPorts {
+			port := &d.NetworkPorts[i]
+			if len(port.AttachedVirtualNetworks) > 0 {
+				return &networkStep{
+					description: fmt.Sprintf("unassigning vlans from %s", port.Name),
+					run:         func() error { return m.detachPortVLANs(port, nil) },
+				}
+			}
+		}
+	}
+
+	if wantLayer3 && !layer3 {
+		return &networkStep{
+			description: "converting bond0 to layer3",
+			run: func() error {
+				_, _, err := m.Ports.ConvertToLayerThree(bond0.ID, []packngo.AddressRequest{
+					{AddressFamily: 4, Public: true},
+					{AddressFamily: 4, Public: false},
+					{AddressFamily: 6, Public: true},
+				})
+				return err
+			},
+		}
+	}
+
+	for i := range d.NetworkPorts {
+		port := &d.NetworkPorts[i]
+		if port.Type != "NetworkPort" || port.Data.Bonded || !bondedIn(port.Name, targetType) {
+			continue
+		}
+		// vlans have to go before the port joins the bond
+		if len(port.AttachedVirtualNetworks) > 0 {
+			return &networkStep{
+				description: fmt.Sprintf("unassigning vlans from %s", port.Name),
+				run:         func() error { return m.detachPortVLANs(port, nil) },
+			}
+		}
+		return &networkStep{
+			description: fmt.Sprintf("bonding %s", port.Name),
+			run: func() error {
+				_, _, err := m.Ports.Bond(port.ID, false)
+				return err
+			},
+		}
+	}
+
+	if !wantLayer3 && layer3 {
+		return &networkStep{
+			description: "converting bond0 to layer2",
+			run: func() error {
+				_, _, err := m.Ports.ConvertToLayerTwo(bond0.ID)
+				return err
+			},
+		}
+	}
+
+	for i := range d.NetworkPorts {
+		port := &d.NetworkPorts[i]
+		if port.Type != "NetworkPort" || !port.Data.Bonded || bondedIn(port.Name, targetType) || !port.DisbondOperationSupported {
+			continue
+		}
+		return &networkStep{
+			description: fmt.Sprintf("disbonding %s", port.Name),
+			run: func() error {
+				_, _, err := m.Ports.Disbond(port.ID, false)
+				return err
+			},
+		}
+	}
+	return nil
+}
+
+// StartNetworkChange marks the network of an active instance as converting
+// when its network type differs from the one recorded for the device, and
+// reports if it did. Conversions take several calls, the condition shows the
+// change is under way until it completes or fails.
+func StartNetworkChange(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus) bool {
+	network := instance.Status.Network
+	if instance.Spec.NetworkType == "" || network == nil || network.Type == portsNetworkType(instance.Spec.NetworkType) {
+		return false
+	}
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionNetworkConfigured, false, "Converting",
+		fmt.Sprintf("converting network from %s to %s", network.Type, instance.Spec.NetworkType))
+	return true
+}
+
+// bondedIn reports if a physical port is part of its bond in the network type
+func bondedIn(portName string, targetType string) bool {
+	switch targetType {
+	case packngo.NetworkTypeL2Individual:
+		return false
+	case packngo.NetworkTypeHybrid:
+		for _, odd := range oddPorts {
+			if portName == odd {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// portsNetworkType returns the network type the ports of a device are in for
+// a network type, hybrid bonded only differs from layer3 by its vlans
+func portsNetworkType(networkType string) string {
+	if networkType == NetworkTypeHybridBonded {
+		return packngo.NetworkTypeL3
+	}
+	return networkType
+}
+
+// networkStatus reads the network type of the device along with the mode and
+// vlans of its ports
+func (m *MetalClient) networkStatus(deviceID string) (*equinixv1alpha1.InstanceNetwork, error) {
+	device, _, err := m.Devices.Get(deviceID, portIncludes)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading device ports")
+	}
+
+	network := &equinixv1alpha1.InstanceNetwork{Type: device.GetNetworkType()}
+	for _, port := range device.NetworkPorts {
+		status := equinixv1alpha1.InstancePort{Name: port.Name, Bonded: port.Data.Bonded}
+		switch {
+		case !port.Data.Bonded:
+			status.Mode = packngo.NetworkTypeL2Individual
+		case device.HasManagementIPs():
+			status.Mode = packngo.NetworkTypeL3
+		default:
+			status.Mode = packngo.NetworkTypeL2Bonded
+		}
+		for _, vlan := range port.AttachedVirtualNetworks {
+			status.VLANs = append(status.VLANs, vlan.VXLAN)
+		}
+		sort.Ints(status.VLANs)
+		if port.NativeVirtualNetwork != nil {
+			status.NativeVLAN = port.NativeVirtualNetwork.VXLAN
+		}
+		network.Ports = append(network.Ports, status)
+	}
+	sort.Slice(network.Ports, func(i, j int) bool {
+		return network.Ports[i].Name < network.Ports[j].Name
+	})
+	return network, nil
+}
+
+// recordNetwork stores the network read back from the device in the status.
+// It is read after failed changes as well, so the status shows how far a
+// conversion got, along with the vlan assignment batch still running. The
+// error of the change takes precedence.
+func (m *MetalClient) recordNetwork(status *equinixv1alpha1.InstanceStatus, deviceID string, err error) error {
+	network, readErr := m.networkStatus(deviceID)
+	if readErr == nil {
+		var pending *VLANBatchPendingError
+		if errors.As(err, &pending) {
+			for i := range network.Ports {
+				if network.Ports[i].Name == pending.Port {
+					network.Ports[i].PendingBatch = pending.BatchID
+				}
+			}
+		}
+		status.Network = network
+	}
+	if err != nil {
+		return err
+	}
+	return readErr
+}
@@ -0,0 +1,84 @@
+package metal
+
+import (
+	"testing"
+
+	"github.com/hobbyfarm/metal-operator/pkg/metal/fakeapi"
+	"github.com/packethost/packngo"
+)
+
+var networkTypes = []string{
+	packngo.NetworkTypeL3,
+	packngo.NetworkTypeHybrid,
+	NetworkTypeHybridBonded,
+	packngo.NetworkTypeL2Bonded,
+	packngo.NetworkTypeL2Individual,
+}
+
+func TestConvertDeviceTransitions(t *testing.T) {
+	for _, from := range networkTypes {
+		for _, to := range networkTypes {
+			t.Run(from+" to "+to, func(t *testing.T) {
+				m, server := newTestClient(t)
+				instance := newTestInstance()
+				provision(t, m, instance)
+
+				device, _ := server.Device(instance.Status.InstanceID)
+				if err := m.ConvertDevice(device, from); err != nil {
+					t.Fatalf("error converting device to %s: %v", from, err)
+				}
+				if err := m.ConvertDevice(device, to); err != nil {
+					t.Fatalf("error converting device to %s: %v", to, err)
+				}
+
+				device, _ = server.Device(instance.Status.InstanceID)
+				if got := device.GetNetworkType(); got != portsNetworkType(to) {
+					t.Fatalf("expected network type %s, got %s", portsNetworkType(to), got)
+				}
+				if to != packngo.NetworkTypeL2Bonded && to != packngo.NetworkTypeL2Individual && !device.HasManagementIPs() {
+					t.Fatalf("expected management addresses in %s", to)
+				}
+			})
+		}
+	}
+}
+
+func TestConvertDeviceResumes(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	provision(t, m, instance)
+
+	device, _ := server.Device(instance.Status.InstanceID)
+	eth1, _ := device.GetPortByName("eth1")
+	server.AddFault(fakeapi.Fault{Method: "POST", Path: "/ports/" + eth1.ID + "/disbond", Status: 422, Message: "Port is busy", Times: 1})
+
+	if err := m.ConvertDevice(device, packngo.NetworkTypeL2Individual); err == nil {
+		t.Fatal("expected the conversion to stop at eth1")
+	}
+	network, err := m.networkStatus(instance.Status.InstanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]string{}
+	for _, port := range network.Ports {
+		modes[port.Name] = port.Mode
+	}
+	if modes["eth0"] != packngo.NetworkTypeL2Individual || modes["eth1"] != packngo.NetworkTypeL2Bonded {
+		t.Fatalf("expected eth0 disbonded and eth1 still bonded in layer2, got %v", modes)
+	}
+
+	device, _ = server.Device(instance.Status.InstanceID)
+	if err := m.ConvertDevice(device, packngo.NetworkTypeL2Individual); err != nil {
+		t.Fatalf("error resuming the conversion: %v", err)
+	}
+	device, _ = server.Device(instance.Status.InstanceID)
+	if got := device.GetNetworkType(); got != packngo.NetworkTypeL2Individual {
+		t.Fatalf("expected network type %s, got %s", packngo.NetworkTypeL2Individual, got)
+	}
+
+	// converted ports are left alone
+	server.AddFault(fakeapi.Fault{Method: "POST", Path: "/ports/", Status: 422, Message: "unexpected port change"})
+	if err := m.ConvertDevice(device, packngo.NetworkTypeL2Individual); err != nil {
+		t.Fatalf("expected no port changes, got %v", err)
+	}
+}
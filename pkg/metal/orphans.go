@@ -0,0 +1,147 @@
+package metal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ownerTagPrefix starts the tag naming the object a resource was created for
+const ownerTagPrefix = "metal-operator:"
+
+// Kinds of resources found through their owner tag
+const (
+	ResourceDevice        = "device"
+	ResourceIPReservation = "ip"
+	ResourceSSHKey        = "sshkey"
+)
+
+// Owner is the object an Equinix Metal resource was created for
+type Owner struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("%s %s/%s", o.Kind, o.Namespace, o.Name)
+}
+
+// OwnedResource is a device, ip reservation or ssh key carrying an owner tag
+type OwnedResource struct {
+	Kind string
+	ID   string
+	// Description is the hostname, address or label to report the resource by
+	Description string
+	Owner       Owner
+}
+
+// OwnerTag returns the tag marking resources created for the object. ssh keys
+// have no tags and carry it as their label instead.
+func OwnerTag(kind string, namespace string, name string) string {
+	return fmt.Sprintf("%s%s:%s/%s", ownerTagPrefix, strings.ToLower(kind), namespace, name)
+}
+
+// ParseOwnerTag returns the owner named by an owner tag
+func ParseOwnerTag(tag string) (Owner, bool) {
+	if !strings.HasPrefix(tag, ownerTagPrefix) {
+		return Owner{}, false
+	}
+	kind, namespacedName, ok := cut(strings.TrimPrefix(tag, ownerTagPrefix), ":")
+	if !ok {
+		return Owner{}, false
+	}
+	namespace, name, ok := cut(namespacedName, "/")
+	if !ok || kind == "" || namespace == "" || name == "" {
+		return Owner{}, false
+	}
+	return Owner{Kind: kind, Namespace: namespace, Name: name}, true
+}
+
+// IsOwnerTag reports if tag was added by the operator to find a resource owner
+func IsOwnerTag(tag string) bool {
+	_, ok := ParseOwnerTag(tag)
+	return ok
+}
+
+func cut(s string, sep string) (before string, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// ownerOf returns the owner named by the first owner tag. Resources released
+// with the Retain deletion policy are no longer owned.
+func ownerOf(tags []string) (Owner, bool) {
+	if hasTag(tags, ReleasedTag) {
+		return Owner{}, false
+	}
+	for _, tag := range tags {
+		if owner, ok := ParseOwnerTag(tag); ok {
+			return owner, true
+		}
+	}
+	return Owner{}, false
+}
+
+// OwnedResources lists the devices, ip reservations and ssh keys of the
+// project carrying an owner tag, devices first so they can be removed before
+// the reservations attached to them. An empty projectID uses the client project.
+func (m *MetalClient) OwnedResources(projectID string) (resources []OwnedResource, err error) {
+	if projectID == "" {
+		projectID = m.ProjectID
+	}
+
+	devices, _, err := m.Devices.List(projectID, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing devices")
+	}
+	for _, device := range devices {
+		if owner, ok := ownerOf(device.Tags); ok {
+			resources = append(resources, OwnedResource{Kind: ResourceDevice, ID: device.ID, Description: device.Hostname, Owner: owner})
+		}
+	}
+
+	reservations, _, err := m.ProjectIPs.List(projectID, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing ip reservations")
+	}
+	for _, reservation := range reservations {
+		if owner, ok := ownerOf(reservation.Tags); ok {
+			resources = append(resources, OwnedResource{Kind: ResourceIPReservation, ID: reservation.ID,
+				Description: fmt.Sprintf("%s/%d", reservation.Address, reservation.CIDR), Owner: owner})
+		}
+	}
+
+	keys, _, err := m.SSHKeys.ProjectList(projectID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing ssh keys")
+	}
+	for _, key := range keys {
+		if owner, ok := ParseOwnerTag(key.Label); ok {
+			resources = append(resources, OwnedResource{Kind: ResourceSSHKey, ID: key.ID, Description: key.Label, Owner: owner})
+		}
+	}
+	return resources, nil
+}
+
+// DeleteOwnedResource removes a resource returned by OwnedResources. Resources
+// already gone are not an error.
+func (m *MetalClient) DeleteOwnedResource(resource OwnedResource) (err error) {
+	switch resource.Kind {
+	case ResourceDevice:
+		_, err = m.Devices.Delete(resource.ID, true)
+	case ResourceIPReservation:
+		_, err = m.ProjectIPs.Remove(resource.ID)
+	case ResourceSSHKey:
+		_, err = m.SSHKeys.Delete(resource.ID)
+	default:
+		return fmt.Errorf("unknown resource kind %s", resource.Kind)
+	}
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package metal
+
+import (
+	"testing"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseOwnerTag(t *testing.T) {
+	tests := []struct {
+		tag   string
+		owner Owner
+		ok    bool
+	}{
+		{tag: OwnerTag("Instance", "default", "node-1"), owner: Owner{Kind: "instance", Namespace: "default", Name: "node-1"}, ok: true},
+		{tag: "metal-operator:elasticip:lab/ingress", owner: Owner{Kind: "elasticip", Namespace: "lab", Name: "ingress"}, ok: true},
+		{tag: "node-1-default"},
+		{tag: ReleasedTag},
+		{tag: "metal-operator:instance:default"},
+		{tag: "metal-operator:instance:/node-1"},
+	}
+	for _, tt := range tests {
+		owner, ok := ParseOwnerTag(tt.tag)
+		if ok != tt.ok || owner != tt.owner {
+			t.Errorf("%s: expected %v %v, got %v %v", tt.tag, tt.owner, tt.ok, owner, ok)
+		}
+	}
+}
+
+func TestOwnedResources(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	provision(t, m, instance)
+
+	keyPair := &equinixv1alpha1.ImportKeyPair{
+		ObjectMeta: metav1.ObjectMeta{Name: "key", Namespace: "default"},
+		Spec:       equinixv1alpha1.ImportKeyPairSpec{Key: "ssh-rsa AAAAB3NzaC1yc2E"},
+	}
+	keyStatus, err := m.CreateImportKeyPair(keyPair)
+	if err != nil {
+		t.Fatalf("error creating key pair: %v", err)
+	}
+	// devices created outside the operator are never reported
+	createDevice(t, m, testProject, "unmanaged", "lab")
+
+	resources, err := m.OwnedResources("")
+	if err != nil {
+		t.Fatalf("error listing owned resources: %v", err)
+	}
+	instanceOwner := Owner{Kind: "instance", Namespace: "default", Name: "instance-sample"}
+	expected := map[string]OwnedResource{
+		instance.Status.InstanceID:                  {Kind: ResourceDevice, Owner: instanceOwner},
+		instance.Annotations[ReservationAnnotation]: {Kind: ResourceIPReservation, Owner: instanceOwner},
+		keyStatus.KeyPairID:                         {Kind: ResourceSSHKey, Owner: Owner{Kind: "importkeypair", Namespace: "default", Name: "key"}},
+	}
+	if len(resources) != len(expected) {
+		t.Fatalf("expected %d owned resources, got %v", len(expected), resources)
+	}
+	for _, resource := range resources {
+		want, ok := expected[resource.ID]
+		if !ok || want.Kind != resource.Kind || want.Owner != resource.Owner {
+			t.Errorf("unexpected owned resource %v", resource)
+		}
+	}
+	if resources[0].Kind != ResourceDevice {
+		t.Errorf("expected devices to be listed first, got %v", resources)
+	}
+
+	for _, resource := range resources {
+		if err := m.DeleteOwnedResource(resource); err != nil {
+			t.Fatalf("error removing %s %s: %v", resource.Kind, resource.ID, err)
+		}
+	}
+	if _, ok := server.Device(instance.Status.InstanceID); ok {
+		t.Errorf("expected device to be removed")
+	}
+	if _, ok := server.SSHKey(keyStatus.KeyPairID); ok {
+		t.Errorf("expected key pair to be removed")
+	}
+	if err := m.DeleteOwnedResource(resources[0]); err != nil {
+		t.Errorf("removing a missing resource should not fail, got %v", err)
+	}
+}
+
+func TestOwnedResourcesSkipsReleased(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.DeletionPolicy = equinixv1alpha1.DeletionPolicyRetain
+	provision(t, m, instance)
+	if err := m.DeleteDevice(instance); err != nil {
+		t.Fatalf("error deleting device: %v", err)
+	}
+
+	keyPair := &equinixv1alpha1.ImportKeyPair{
+		ObjectMeta: metav1.ObjectMeta{Name: "key", Namespace: "default"},
+		Spec: equinixv1alpha1.ImportKeyPairSpec{Key: "ssh-rsa AAAAB3NzaC1yc2E",
+			DeletionPolicy: equinixv1alpha1.DeletionPolicyRetain},
+	}
+	keyStatus, err := m.CreateImportKeyPair(keyPair)
+	if err != nil {
+		t.Fatalf("error creating key pair: %v", err)
+	}
+	keyPair.Status = *keyStatus
+	if err := m.DeleteKeyPair(keyPair); err != nil {
+		t.Fatalf("error deleting key pair: %v", err)
+	}
+	key, ok := server.SSHKey(keyStatus.KeyPairID)
+	if !ok || key.Label != "key-default" {
+		t.Errorf("expected retained key pair to be relabeled, got %v", key)
+	}
+
+	resources, err := m.OwnedResources("")
+	if err != nil {
+		t.Fatalf("error listing owned resources: %v", err)
+	}
+	if len(resources) != 0 {
+		t.Errorf("expected released resources to be skipped, got %v", resources)
+	}
+}
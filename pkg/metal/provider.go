@@ -0,0 +1,52 @@
+package metal
+
+import (
+	"context"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Provider is the set of Equinix Metal operations the controllers rely on.
+// MetalClient is the real implementation, tests can swap in a fake.
+type Provider interface {
+	CreateElasticInterface(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error)
+	UseElasticIP(instance *equinixv1alpha1.Instance, eip *equinixv1alpha1.ElasticIP) (status *equinixv1alpha1.InstanceStatus, err error)
+	CreateNewDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error)
+	CheckDeviceStatus(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error)
+	UpdateDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error)
+	CheckSpotDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error)
+	DeleteDevice(instance *equinixv1alpha1.Instance) (err error)
+	AdoptDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error)
+	CreateImportKeyPair(importKeyPair *equinixv1alpha1.ImportKeyPair) (status *equinixv1alpha1.ImportKeyPairStatus, err error)
+	DeleteKeyPair(importKeyPair *equinixv1alpha1.ImportKeyPair) (err error)
+	CreateElasticIP(eip *equinixv1alpha1.ElasticIP) (status *equinixv1alpha1.ElasticIPStatus, err error)
+	DeleteElasticIP(eip *equinixv1alpha1.ElasticIP) (err error)
+	CreateVirtualNetwork(vn *equinixv1alpha1.VirtualNetwork) (status *equinixv1alpha1.VirtualNetworkStatus, err error)
+	DeleteVirtualNetwork(vn *equinixv1alpha1.VirtualNetwork) (err error)
+	OwnedResources(projectID string) (resources []OwnedResource, err error)
+	DeleteOwnedResource(resource OwnedResource) (err error)
+}
+
+// ClientFactory builds a Provider using the credentials stored in a secret.
+type ClientFactory func(ctx context.Context, client client.Client, creds Credentials) (Provider, error)
+
+var _ Provider = &MetalClient{}
+
+// NewProvider is the default ClientFactory and returns a MetalClient backed by packngo
+func NewProvider(ctx context.Context, client client.Client, creds Credentials) (Provider, error) {
+	credSecret := &corev1.Secret{}
+	err := client.Get(ctx, types.NamespacedName{Name: creds.Secret, Namespace: creds.Namespace}, credSecret)
+	if err != nil {
+		return nil, errors.Wrap(err, "error during credential secret lookup")
+	}
+
+	m, err := clientFromSecret(credSecret, creds.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
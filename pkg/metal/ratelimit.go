@@ -0,0 +1,164 @@
+package metal
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultRateLimit is the number of api calls per second allowed per credential
+	DefaultRateLimit = 5
+	// DefaultRateBurst is the number of api calls a credential may make at once
+	DefaultRateBurst = 10
+
+	defaultRetryAfter = 10 * time.Second
+	minPollInterval   = 10 * time.Second
+	maxPollInterval   = 2 * time.Minute
+)
+
+var (
+	limitersMu sync.Mutex
+	// limiters are keyed by the namespace and name of the credential secret,
+	// so a rotated token keeps the limiter and no token is held on to
+	limiters  = make(map[string]*credentialLimiter)
+	rateLimit = rate.Limit(DefaultRateLimit)
+	rateBurst = DefaultRateBurst
+)
+
+// credentialLimiter throttles all api calls made with one credential, no
+// matter how many MetalClients are created for it
+type credentialLimiter struct {
+	*rate.Limiter
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+// SetRateLimit changes the token bucket used for every credential
+func SetRateLimit(limit float64, burst int) {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	rateLimit = rate.Limit(limit)
+	rateBurst = burst
+	for _, l := range limiters {
+		l.SetLimit(rateLimit)
+		l.SetBurst(rateBurst)
+	}
+}
+
+// limiterFor returns the limiter shared by the clients of a credential secret
+func limiterFor(credential string) *credentialLimiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := limiters[credential]
+	if !ok {
+		l = newLimiter()
+		limiters[credential] = l
+	}
+	return l
+}
+
+func newLimiter() *credentialLimiter {
+	return &credentialLimiter{Limiter: rate.NewLimiter(rateLimit, rateBurst)}
+}
+
+// wait blocks until the api accepts calls again and a token is available
+func (l *credentialLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	delay := time.Until(l.blockedUntil)
+	l.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return l.Wait(ctx)
+}
+
+// block stops calls with this credential for d
+func (l *credentialLimiter) block(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.blockedUntil) {
+		l.blockedUntil = until
+	}
+}
+
+// rateLimitedTransport makes every request wait for the credential limiter and
+// pauses the credential when the api answers with 429
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	limiter *credentialLimiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.wait(req.Context()); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		t.limiter.block(retryAfter(resp.Header))
+	}
+	return resp, err
+}
+
+// retryAfter parses the Retry-After header which is either a number of seconds or a date
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return defaultRetryAfter
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+// RetryAfter returns how long the api asked us to wait before retrying a rate limited call
+func RetryAfter(err error) time.Duration {
+	errResp, ok := APIError(err)
+	if !ok || !IsRateLimited(err) {
+		return 0
+	}
+	return retryAfter(errResp.Response.Header)
+}
+
+// growingInterval returns the time passed since start, kept between min and
+// max. Requeueing after it doubles the interval on every check.
+func growingInterval(start time.Time, min time.Duration, max time.Duration) time.Duration {
+	interval := time.Since(start)
+	if interval < min {
+		return min
+	}
+	if interval > max {
+		return max
+	}
+	return interval
+}
+
+// PollInterval returns how long to wait before checking a provisioning device
+// again. Devices usually take minutes so the interval grows from 10s up to 2m.
+func PollInterval(status *equinixv1alpha1.InstanceStatus) time.Duration {
+	if status.ProvisioningStartTime == nil {
+		return minPollInterval
+	}
+	return growingInterval(status.ProvisioningStartTime.Time, minPollInterval, maxPollInterval)
+}
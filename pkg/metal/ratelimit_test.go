@@ -0,0 +1,82 @@
+package metal
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hobbyfarm/metal-operator/pkg/metal/fakeapi"
+)
+
+func TestMain(m *testing.M) {
+	// the fake api is not rate limited, keep the default limiter from slowing tests down
+	SetRateLimit(1000, 1000)
+	os.Exit(m.Run())
+}
+
+func TestRetryAfter(t *testing.T) {
+	m, server := newTestClient(t)
+	server.AddFault(fakeapi.Fault{Status: http.StatusTooManyRequests, Message: "Too many requests", Times: 1,
+		Header: http.Header{"Retry-After": []string{"1"}}})
+
+	_, _, err := m.Devices.Get("device", nil)
+	if !IsRateLimited(err) {
+		t.Fatalf("expected rate limited error, got %v", err)
+	}
+	if d := RetryAfter(err); d != time.Second {
+		t.Errorf("expected retry after 1s, got %s", d)
+	}
+
+	// the next call with the same credential waits for Retry-After
+	start := time.Now()
+	_, _, err = m.Devices.Get("device", nil)
+	if !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("expected call to wait for Retry-After, returned after %s", elapsed)
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "", expected: defaultRetryAfter},
+		{value: "30", expected: 30 * time.Second},
+		{value: "soon", expected: defaultRetryAfter},
+		{value: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), expected: 0},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.value != "" {
+			header.Set("Retry-After", tt.value)
+		}
+		if got := retryAfter(header); got != tt.expected {
+			t.Errorf("Retry-After %q: expected %s, got %s", tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestCredentialLimiter(t *testing.T) {
+	limiter := limiterFor("limiter-test")
+	limiter.SetLimit(20)
+	limiter.SetBurst(1)
+	if limiterFor("limiter-test") != limiter {
+		t.Fatal("expected clients with the same credential to share a limiter")
+	}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first call uses the burst, the other four wait 50ms each
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected calls to be throttled, took %s", elapsed)
+	}
+}
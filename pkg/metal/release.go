@@ -0,0 +1,83 @@
+package metal
+
+import (
+	"fmt"
+	"net/http"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+// ReleasedTag marks devices and ip reservations the operator stopped managing
+// because their object was deleted with the Retain deletion policy
+const ReleasedTag = "metal-operator-released"
+
+// releaseDevice tags the device and elastic ip of an instance as released
+// instead of removing them. Reservations of an ElasticIP resource are left to it.
+func (m *MetalClient) releaseDevice(instance *equinixv1alpha1.Instance) error {
+	if instance.Status.InstanceID != "" {
+		device, _, err := m.Devices.Get(instance.Status.InstanceID, nil)
+		if err != nil && !IsNotFound(err) {
+			return errors.Wrap(err, "error looking up device")
+		}
+		if err == nil && !hasTag(device.Tags, ReleasedTag) {
+			tags := append(device.Tags, ReleasedTag)
+			_, _, err = m.Devices.Update(device.ID, &packngo.DeviceUpdateRequest{Tags: &tags})
+			if err != nil {
+				return errors.Wrap(err, "error tagging device as released")
+			}
+		}
+	}
+
+	reservationID, ok := instance.Annotations[ReservationAnnotation]
+	if !ok || instance.Spec.ElasticIP != "" {
+		return nil
+	}
+	return m.releaseReservation(reservationID)
+}
+
+// releaseReservation tags an ip reservation as released. packngo has no call
+// to update reservations so the request is made directly.
+func (m *MetalClient) releaseReservation(reservationID string) error {
+	reservation, _, err := m.ProjectIPs.Get(reservationID, nil)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrap(err, "error looking up elastic ip reservation")
+	}
+	if hasTag(reservation.Tags, ReleasedTag) {
+		return nil
+	}
+
+	tags := append(reservation.Tags, ReleasedTag)
+	_, err = m.Client.DoRequest(http.MethodPatch, "/ips/"+reservationID, map[string][]string{"tags": tags}, nil)
+	if err != nil {
+		return errors.Wrap(err, "error tagging elastic ip reservation as released")
+	}
+	return nil
+}
+
+// releaseKeyPair drops the owner tag from the label of a key pair, keys have
+// no tags to mark them released
+func (m *MetalClient) releaseKeyPair(importKeyPair *equinixv1alpha1.ImportKeyPair) error {
+	if importKeyPair.Status.KeyPairID == "" {
+		return nil
+	}
+	label := fmt.Sprintf("%s-%s", importKeyPair.Name, importKeyPair.Namespace)
+	_, _, err := m.SSHKeys.Update(importKeyPair.Status.KeyPairID, &packngo.SSHKeyUpdateRequest{Label: &label})
+	if err != nil && !IsNotFound(err) {
+		return errors.Wrap(err, "error releasing key pair")
+	}
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package metal
+
+import (
+	"fmt"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SpotPollInterval is how often the device of an active spot instance is
+// checked. Equinix Metal sets the termination time of a spot device about two
+// minutes before reclaiming it.
+const SpotPollInterval = time.Minute
+
+// IsSpot reports if the current device of the instance is a spot device
+func IsSpot(instance *equinixv1alpha1.Instance) bool {
+	return instance.Spec.SpotInstance && !instance.Status.OnDemand
+}
+
+// CheckSpotDevice looks for the reclaim of the spot device of an active
+// instance, announced by a termination time or the device disappearing
+func (m *MetalClient) CheckSpotDevice(instance *equinixv1alpha1.Instance) (status *equinixv1alpha1.InstanceStatus, err error) {
+	status = instance.Status.DeepCopy()
+	device, _, err := m.Devices.Get(instance.Status.InstanceID, nil)
+	switch {
+	case IsNotFound(err):
+		return m.spotReclaimed(instance, status, fmt.Sprintf("spot device %s was reclaimed", status.InstanceID), true)
+	case err != nil:
+		return status, err
+	case device.State == "deprovisioning" || device.State == "deleted":
+		return m.spotReclaimed(instance, status, fmt.Sprintf("spot device %s is %s", status.InstanceID, device.State), true)
+	case device.TerminationTime != nil:
+		return m.spotReclaimed(instance, status, fmt.Sprintf("spot device %s is reclaimed at %s",
+			status.InstanceID, device.TerminationTime.UTC().Format(time.RFC3339)), false)
+	}
+	return status, nil
+}
+
+// spotReclaimed removes a spot device scheduled for termination before it is
+// replaced, so the elastic ip is free to move to the replacement
+func (m *MetalClient) spotReclaimed(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, message string,
+	gone bool) (*equinixv1alpha1.InstanceStatus, error) {
+	if !gone && spotRecovery(instance) {
+		_, err := m.Devices.Delete(status.InstanceID, true)
+		if err != nil && !IsNotFound(err) {
+			setErrorCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, err)
+			return status, errors.Wrap(err, "error removing reclaimed spot device")
+		}
+		gone = true
+	}
+	SpotReclaimed(instance, status, message, gone)
+	return status, nil
+}
+
+func spotRecovery(instance *equinixv1alpha1.Instance) bool {
+	return instance.Spec.SpotRecovery == equinixv1alpha1.SpotRecoverySpot || instance.Spec.SpotRecovery == equinixv1alpha1.SpotRecoveryOnDemand
+}
+
+// SpotReclaimed records the reclaim of the spot device of the instance. Until
+// the device is gone only the SpotReclaimed condition is set. Without a
+// SpotRecovery policy the instance then fails, otherwise it is sent back to
+// device creation keeping its elastic ip.
+func SpotReclaimed(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus, message string, gone bool) {
+	if !gone {
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionSpotReclaimed, true, "TerminationScheduled", message)
+		return
+	}
+
+	status.SpotReclaims++
+	if !spotRecovery(instance) {
+		status.Status = equinixv1alpha1.InstanceFailed
+		status.FailureReason = "SpotReclaimed"
+		status.FailureMessage = message
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionSpotReclaimed, true, "Reclaimed", message)
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, status.FailureReason, message)
+		return
+	}
+
+	// the attempt keeps existingDevice from picking the reclaimed device up again
+	status.ProvisioningAttempts = append(status.ProvisioningAttempts, equinixv1alpha1.ProvisioningAttempt{
+		DeviceID: status.InstanceID,
+		Facility: status.Facility,
+		State:    equinixv1alpha1.ProvisioningAttemptReclaimed,
+		Time:     metav1.Now(),
+	})
+	status.OnDemand = instance.Spec.SpotRecovery == equinixv1alpha1.SpotRecoveryOnDemand
+	if status.OnDemand {
+		message += ", replacing it with an on demand device"
+	} else {
+		message += ", replacing it with a new spot device"
+	}
+
+	status.InstanceID = ""
+	status.Facility = ""
+	status.PrivateIP = ""
+	status.ProvisioningStartTime = nil
+	status.Status = "patched"
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionSpotReclaimed, true, "Replacing", message)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionDeviceCreated, false, "SpotReclaimed", message)
+	SetCondition(status, instance.Generation, equinixv1alpha1.ConditionReady, false, "SpotReclaimed", message)
+	if address := instance.Annotations[AddressAnnotation]; address != "" {
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionElasticIPReady, false, "Reattaching",
+			fmt.Sprintf("elastic ip %s is attached to the replacement device once it is active", address))
+	}
+}
+
+// spotReplaced clears the SpotReclaimed condition once the replacement device is active
+func spotReplaced(instance *equinixv1alpha1.Instance, status *equinixv1alpha1.InstanceStatus) {
+	if meta.IsStatusConditionTrue(status.Conditions, equinixv1alpha1.ConditionSpotReclaimed) {
+		SetCondition(status, instance.Generation, equinixv1alpha1.ConditionSpotReclaimed, false, "Replaced",
+			fmt.Sprintf("reclaimed spot device replaced by %s", status.InstanceID))
+	}
+}
+
+// failedAttempts counts the provisioning attempts which count towards
+// MaxProvisioningAttempts, reclaimed spot devices did provision fine
+func failedAttempts(status *equinixv1alpha1.InstanceStatus) int {
+	attempts := 0
+	for _, attempt := range status.ProvisioningAttempts {
+		if attempt.State != equinixv1alpha1.ProvisioningAttemptReclaimed {
+			attempts++
+		}
+	}
+	return attempts
+}
@@ -0,0 +1,117 @@
+package metal
+
+import (
+	"testing"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+func newSpotInstance(recovery equinixv1alpha1.SpotRecoveryPolicy) *equinixv1alpha1.Instance {
+	instance := newTestInstance()
+	instance.Spec.SpotInstance = true
+	instance.Spec.SpotRecovery = recovery
+	return instance
+}
+
+func TestCheckSpotDeviceReclaimed(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newSpotInstance("")
+	provision(t, m, instance)
+
+	status, err := m.CheckSpotDevice(instance)
+	if err != nil {
+		t.Fatalf("error checking spot device: %v", err)
+	}
+	if meta.FindStatusCondition(status.Conditions, equinixv1alpha1.ConditionSpotReclaimed) != nil {
+		t.Errorf("expected no SpotReclaimed condition while the device is running")
+	}
+
+	server.SetTerminationTime(instance.Status.InstanceID, time.Now().Add(2*time.Minute))
+	status, err = m.CheckSpotDevice(instance)
+	if err != nil {
+		t.Fatalf("error checking spot device: %v", err)
+	}
+	instance.Status = *status
+	condition := meta.FindStatusCondition(status.Conditions, equinixv1alpha1.ConditionSpotReclaimed)
+	if condition == nil || condition.Reason != "TerminationScheduled" || status.Status != "active" {
+		t.Fatalf("expected termination to be reported on the active instance, got %s %v", status.Status, condition)
+	}
+	if _, ok := server.Device(instance.Status.InstanceID); !ok {
+		t.Errorf("device should be left to Equinix Metal without a spot recovery policy")
+	}
+
+	if _, err := m.Devices.Delete(instance.Status.InstanceID, true); err != nil {
+		t.Fatalf("error removing device: %v", err)
+	}
+	status, err = m.CheckSpotDevice(instance)
+	if err != nil {
+		t.Fatalf("error checking spot device: %v", err)
+	}
+	if status.Status != equinixv1alpha1.InstanceFailed || status.FailureReason != "SpotReclaimed" {
+		t.Errorf("expected instance to fail once reclaimed, got %s %s", status.Status, status.FailureReason)
+	}
+	if status.SpotReclaims != 1 {
+		t.Errorf("expected 1 spot reclaim, got %d", status.SpotReclaims)
+	}
+}
+
+func TestCheckSpotDeviceRecovery(t *testing.T) {
+	for _, recovery := range []equinixv1alpha1.SpotRecoveryPolicy{equinixv1alpha1.SpotRecoverySpot, equinixv1alpha1.SpotRecoveryOnDemand} {
+		t.Run(string(recovery), func(t *testing.T) {
+			m, server := newTestClient(t)
+			instance := newSpotInstance(recovery)
+			provision(t, m, instance)
+			reclaimed := instance.Status.InstanceID
+			address := instance.Annotations[AddressAnnotation]
+
+			server.SetTerminationTime(reclaimed, time.Now().Add(2*time.Minute))
+			status, err := m.CheckSpotDevice(instance)
+			if err != nil {
+				t.Fatalf("error checking spot device: %v", err)
+			}
+			instance.Status = *status
+			if status.Status != "patched" || status.InstanceID != "" || status.SpotReclaims != 1 {
+				t.Fatalf("expected instance to go back to device creation, got %s %s", status.Status, status.InstanceID)
+			}
+			if _, ok := server.Device(reclaimed); ok {
+				t.Errorf("reclaimed device %s should have been removed", reclaimed)
+			}
+
+			status, err = m.CreateNewDevice(instance)
+			if err != nil {
+				t.Fatalf("error creating device: %v", err)
+			}
+			instance.Status = *status
+			for i := 0; i < 5 && instance.Status.Status != "active"; i++ {
+				status, err = m.CheckDeviceStatus(instance)
+				if err != nil {
+					t.Fatalf("error checking device status: %v", err)
+				}
+				instance.Status = *status
+			}
+			if instance.Status.Status != "active" || instance.Status.PublicIP != address {
+				t.Fatalf("expected replacement to be active with elastic ip %s, got %s %s", address,
+					instance.Status.Status, instance.Status.PublicIP)
+			}
+			if meta.IsStatusConditionTrue(instance.Status.Conditions, equinixv1alpha1.ConditionSpotReclaimed) {
+				t.Errorf("expected SpotReclaimed to be cleared once replaced")
+			}
+
+			device, _ := server.Device(instance.Status.InstanceID)
+			if device.SpotInstance != (recovery == equinixv1alpha1.SpotRecoverySpot) {
+				t.Errorf("expected replacement spot instance %v, got %v", recovery == equinixv1alpha1.SpotRecoverySpot, device.SpotInstance)
+			}
+			var attached bool
+			for _, ip := range device.Network {
+				if !ip.Management && ip.Address == address {
+					attached = true
+				}
+			}
+			if !attached {
+				t.Errorf("elastic ip was not attached to the replacement device")
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package metal
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+// virtualNetworkDescription returns the description the vlan of a
+// VirtualNetwork is created with
+func virtualNetworkDescription(vn *equinixv1alpha1.VirtualNetwork) string {
+	if vn.Spec.Description != "" {
+		return vn.Spec.Description
+	}
+	return fmt.Sprintf("%s/%s", vn.Namespace, vn.Name)
+}
+
+// CreateVirtualNetwork creates the vlan requested by a VirtualNetwork. Vlans
+// have no tags, a vlan in the metro with the same description and vxlan is
+// taken to be the one created by an earlier attempt and reused. The failure
+// of an earlier spec is cleared, so errors of the retry are retried again.
+func (m *MetalClient) CreateVirtualNetwork(vn *equinixv1alpha1.VirtualNetwork) (status *equinixv1alpha1.VirtualNetworkStatus, err error) {
+	status = vn.Status.DeepCopy()
+	status.Status = ""
+	status.FailureReason = ""
+	status.FailureMessage = ""
+	if vn.Spec.Metro == "" {
+		status.Status = equinixv1alpha1.VirtualNetworkFailed
+		status.FailureReason = "InvalidSpec"
+		status.FailureMessage = "a metro is required"
+		setCondition(&status.Conditions, vn.Generation, equinixv1alpha1.ConditionReady, false, status.FailureReason, status.FailureMessage)
+		return status, nil
+	}
+
+	vlans, err := m.matchingVLANs(vn)
+	if err != nil {
+		setCondition(&status.Conditions, vn.Generation, equinixv1alpha1.ConditionReady, false, ErrorReason(err), err.Error())
+		return status, err
+	}
+
+	var vlan *packngo.VirtualNetwork
+	switch len(vlans) {
+	case 0:
+		vlan, _, err = m.ProjectVirtualNetworks.Create(&packngo.VirtualNetworkCreateRequest{
+			ProjectID:   m.virtualNetworkProject(vn),
+			Description: virtualNetworkDescription(vn),
+			Metro:       vn.Spec.Metro,
+			VXLAN:       vn.Spec.VXLAN,
+		})
+		if err != nil {
+			setCondition(&status.Conditions, vn.Generation, equinixv1alpha1.ConditionReady, false, ErrorReason(err), err.Error())
+			return status, errors.Wrap(err, "error creating vlan")
+		}
+	case 1:
+		vlan = &vlans[0]
+	default:
+		err = fmt.Errorf("multiple vlans with description %q found in metro %s", virtualNetworkDescription(vn), vn.Spec.Metro)
+		setCondition(&status.Conditions, vn.Generation, equinixv1alpha1.ConditionReady, false, "DuplicateVirtualNetwork", err.Error())
+		return status, err
+	}
+
+	status.Status = equinixv1alpha1.VirtualNetworkCreated
+	status.VLANID = vlan.ID
+	status.VXLAN = vlan.VXLAN
+	status.Metro = vlanMetro(vlan)
+	setCondition(&status.Conditions, vn.Generation, equinixv1alpha1.ConditionReady, true, "Created",
+		fmt.Sprintf("vlan %d created in %s", status.VXLAN, status.Metro))
+	return status, nil
+}
+
+// DeleteVirtualNetwork removes the vlan unless the deletion policy keeps it.
+// Vlans still attached to device ports can not be removed.
+func (m *MetalClient) DeleteVirtualNetwork(vn *equinixv1alpha1.VirtualNetwork) (err error) {
+	switch vn.Spec.DeletionPolicy {
+	case equinixv1alpha1.DeletionPolicyRetain, equinixv1alpha1.DeletionPolicyOrphan:
+		return nil
+	}
+
+	vlanID := vn.Status.VLANID
+	if vlanID == "" {
+		// the vlan may have been created without its status being stored, it
+		// is found by its metro and description
+		vlans, err := m.matchingVLANs(vn)
+		if err != nil {
+			return err
+		}
+		switch len(vlans) {
+		case 0:
+			return nil
+		case 1:
+			vlanID = vlans[0].ID
+		default:
+			return fmt.Errorf("multiple vlans with description %q found in metro %s", virtualNetworkDescription(vn), vn.Spec.Metro)
+		}
+	}
+
+	vlan, _, err := m.ProjectVirtualNetworks.Get(vlanID, &packngo.GetOptions{Includes: []string{"instances"}})
+	if err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if len(vlan.Instances) > 0 {
+		return fmt.Errorf("vlan %d is still attached to %d device(s)", vlan.VXLAN, len(vlan.Instances))
+	}
+
+	_, err = m.ProjectVirtualNetworks.Delete(vlanID)
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// matchingVLANs lists the vlans of the project taken to be the one of a
+// VirtualNetwork, the ones in its metro with its description and vxlan
+func (m *MetalClient) matchingVLANs(vn *equinixv1alpha1.VirtualNetwork) ([]packngo.VirtualNetwork, error) {
+	vlans, _, err := m.ProjectVirtualNetworks.List(m.virtualNetworkProject(vn), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing vlans")
+	}
+
+	description := virtualNetworkDescription(vn)
+	var matching []packngo.VirtualNetwork
+	for _, vlan := range vlans.VirtualNetworks {
+		if vlanMetro(&vlan) != vn.Spec.Metro || vlan.Description != description {
+			continue
+		}
+		if vn.Spec.VXLAN != 0 && vlan.VXLAN != vn.Spec.VXLAN {
+			continue
+		}
+		matching = append(matching, vlan)
+	}
+	return matching, nil
+}
+
+func (m *MetalClient) virtualNetworkProject(vn *equinixv1alpha1.VirtualNetwork) string {
+	if vn.Spec.ProjectID != "" {
+		return vn.Spec.ProjectID
+	}
+	return m.ProjectID
+}
+
+func vlanMetro(vlan *packngo.VirtualNetwork) string {
+	if vlan.MetroCode != "" {
+		return vlan.MetroCode
+	}
+	if vlan.Metro != nil {
+		return vlan.Metro.Code
+	}
+	return ""
+}
+
+var vlanUUID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// IsVLANID reports if an entry of vlanAttachments or nativeVLAN can be passed
+// to the api as is, which takes the vxlan number or the uuid of a vlan
+func IsVLANID(entry string) bool {
+	if vxlan, err := strconv.Atoi(entry); err == nil && vxlan > 0 {
+		return true
+	}
+	return vlanUUID.MatchString(entry)
+}
+
+// VirtualNetworkNames returns the entries of vlanAttachments and nativeVLAN
+// of the instance, any of them may name a VirtualNetwork
+func VirtualNetworkNames(instance *equinixv1alpha1.Instance) []string {
+	var names []string
+	for _, vlans := range instance.Spec.VLANAttachments {
+		names = append(names, vlans...)
+	}
+	for _, vlan := range instance.Spec.NativeVLAN {
+		if vlan != "" {
+			names = append(names, vlan)
+		}
+	}
+	sort.Strings(names)
+
+	var unique []string
+	for i, name := range names {
+		if i == 0 || names[i-1] != name {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// ResolveVLAN returns the vlan to attach for an entry of vlanAttachments,
+// entries naming a VirtualNetwork resolve to its vlan id, others are used as is
+func ResolveVLAN(instance *equinixv1alpha1.Instance, entry string) string {
+	for _, vn := range instance.Status.VirtualNetworks {
+		if vn.Name == entry {
+			return vn.VLANID
+		}
+	}
+	return entry
+}
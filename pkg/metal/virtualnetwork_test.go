@@ -0,0 +1,153 @@
+package metal
+
+import (
+	"testing"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestVirtualNetwork(spec equinixv1alpha1.VirtualNetworkSpec) *equinixv1alpha1.VirtualNetwork {
+	return &equinixv1alpha1.VirtualNetwork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "lab-net",
+			Namespace: "default",
+		},
+		Spec: spec,
+	}
+}
+
+func TestCreateVirtualNetwork(t *testing.T) {
+	m, server := newTestClient(t)
+	vn := newTestVirtualNetwork(equinixv1alpha1.VirtualNetworkSpec{Metro: "sg", VXLAN: 1234})
+
+	status, err := m.CreateVirtualNetwork(vn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Status != equinixv1alpha1.VirtualNetworkCreated || status.VXLAN != 1234 || status.Metro != "sg" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	vlan, ok := server.VirtualNetwork(status.VLANID)
+	if !ok {
+		t.Fatalf("vlan %s not found", status.VLANID)
+	}
+	if vlan.Description != "default/lab-net" {
+		t.Fatalf("expected the namespaced name as description, got %q", vlan.Description)
+	}
+
+	// a retry after losing the status finds the existing vlan
+	again, err := m.CreateVirtualNetwork(vn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again.VLANID != status.VLANID {
+		t.Fatalf("expected vlan %s to be reused, got %s", status.VLANID, again.VLANID)
+	}
+
+	vn.Status = *status
+	if err := m.DeleteVirtualNetwork(vn); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := server.VirtualNetwork(status.VLANID); ok {
+		t.Fatalf("expected vlan %s to be deleted", status.VLANID)
+	}
+}
+
+func TestCreateVirtualNetworkAfterFailure(t *testing.T) {
+	m, _ := newTestClient(t)
+	vn := newTestVirtualNetwork(equinixv1alpha1.VirtualNetworkSpec{VXLAN: 1234})
+	vn.Generation = 1
+
+	status, err := m.CreateVirtualNetwork(vn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Status != equinixv1alpha1.VirtualNetworkFailed || status.FailureReason != "InvalidSpec" {
+		t.Fatalf("expected the missing metro to fail the virtual network, got %+v", status)
+	}
+
+	// the fixed spec is created and the failure cleared
+	vn.Status = *status
+	vn.Generation = 2
+	vn.Spec.Metro = "sg"
+	status, err = m.CreateVirtualNetwork(vn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Status != equinixv1alpha1.VirtualNetworkCreated || status.FailureReason != "" || status.FailureMessage != "" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestDeleteVirtualNetworkWithoutStatus(t *testing.T) {
+	m, server := newTestClient(t)
+	vn := newTestVirtualNetwork(equinixv1alpha1.VirtualNetworkSpec{Metro: "sg"})
+
+	status, err := m.CreateVirtualNetwork(vn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// deleted before the status naming the vlan was stored
+	if err := m.DeleteVirtualNetwork(vn); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := server.VirtualNetwork(status.VLANID); ok {
+		t.Fatalf("expected vlan %s to be deleted", status.VLANID)
+	}
+}
+
+func TestDeleteVirtualNetworkAttached(t *testing.T) {
+	m, server := newTestClient(t)
+	vn := newTestVirtualNetwork(equinixv1alpha1.VirtualNetworkSpec{Metro: "sg"})
+	status, err := m.CreateVirtualNetwork(vn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	vn.Status = *status
+
+	instance := newTestInstance()
+	instance.Spec.NetworkType = "hybrid"
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {vn.Name}}
+	instance.Status.VirtualNetworks = []equinixv1alpha1.InstanceVirtualNetwork{
+		{Name: vn.Name, VLANID: status.VLANID, VXLAN: status.VXLAN},
+	}
+	provision(t, m, instance)
+
+	device, _ := server.Device(instance.Status.InstanceID)
+	port, err := device.GetPortByName("eth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(port.AttachedVirtualNetworks) != 1 || port.AttachedVirtualNetworks[0].ID != status.VLANID {
+		t.Fatalf("expected vlan %s on eth1, got %v", status.VLANID, port.AttachedVirtualNetworks)
+	}
+
+	if err := m.DeleteVirtualNetwork(vn); err == nil {
+		t.Fatalf("expected an error deleting an attached vlan")
+	}
+	if _, ok := server.VirtualNetwork(status.VLANID); !ok {
+		t.Fatalf("expected vlan %s to be kept", status.VLANID)
+	}
+}
+
+func TestVirtualNetworkNames(t *testing.T) {
+	instance := newTestInstance()
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {"lab-net", "1000"}, "eth3": {"lab-net"}}
+	instance.Spec.NativeVLAN = map[string]string{"eth1": "mgmt-net"}
+	names := VirtualNetworkNames(instance)
+	if len(names) != 3 || names[0] != "1000" || names[1] != "lab-net" || names[2] != "mgmt-net" {
+		t.Errorf("expected the entries of vlanAttachments and nativeVLAN once each, got %v", names)
+	}
+
+	for entry, id := range map[string]bool{
+		"1000":                                 true,
+		"0f3bd37e-6c2b-4b2a-a5a3-3b6e1f1c7d2a": true,
+		"lab-net":                              false,
+		"0":                                    false,
+	} {
+		if IsVLANID(entry) != id {
+			t.Errorf("expected IsVLANID(%q) to be %v", entry, id)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package metal
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+// VLANBatchPollInterval is how long to wait before checking a running vlan
+// assignment batch again
+const VLANBatchPollInterval = 5 * time.Second
+
+// portIncludes expands the vlans of the device ports, without them the api
+// only returns references
+var portIncludes = &packngo.GetOptions{Includes: []string{"network_ports.virtual_networks", "network_ports.native_virtual_network"}}
+
+// desiredVLANs returns the vlans each port of the instance should have
+// assigned, keyed by port name. Ports without an entry should have none.
+func desiredVLANs(instance *equinixv1alpha1.Instance) map[string][]string {
+	desired := make(map[string][]string, len(instance.Spec.VLANAttachments))
+	for portName, vlans := range instance.Spec.VLANAttachments {
+		for _, vlan := range vlans {
+			desired[portName] = append(desired[portName], ResolveVLAN(instance, vlan))
+		}
+	}
+	// native vlans are assigned to their port even when not listed
+	for portName, vlan := range desiredNativeVLANs(instance) {
+		listed := false
+		for _, entry := range desired[portName] {
+			listed = listed || entry == vlan
+		}
+		if !listed {
+			desired[portName] = append(desired[portName], vlan)
+		}
+	}
+	return desired
+}
+
+// desiredNativeVLANs returns the native vlan of each port, keyed by port name
+func desiredNativeVLANs(instance *equinixv1alpha1.Instance) map[string]string {
+	native := make(map[string]string, len(instance.Spec.NativeVLAN))
+	for portName, vlan := range instance.Spec.NativeVLAN {
+		if vlan != "" {
+			native[portName] = ResolveVLAN(instance, vlan)
+		}
+	}
+	return native
+}
+
+// vlanID returns the uuid of a vlan attached to a port. Without includes the
+// api only returns a reference to the vlan, the uuid is the end of its href.
+func vlanID(vlan packngo.VirtualNetwork) string {
+	if vlan.ID != "" {
+		return vlan.ID
+	}
+	return path.Base(vlan.Href)
+}
+
+// sameVLAN reports if an attached vlan matches an entry of vlanAttachments,
+// which holds either the uuid or the vxlan number of the vlan
+func sameVLAN(vlan packngo.VirtualNetwork, entry string) bool {
+	return entry == vlanID(vlan) || (vlan.VXLAN != 0 && entry == strconv.Itoa(vlan.VXLAN))
+}
+
+// detachVLANs unassigns the vlans attached to the ports of the device which
+// are not desired, a nil desired map unassigns every vlan. The ports of the
+// device are updated along, so later steps see the vlans as gone.
+func (m *MetalClient) detachVLANs(device *packngo.Device, desired map[string][]string) error {
+	for i := range device.NetworkPorts {
+		port := &device.NetworkPorts[i]
+		if err := m.detachPortVLANs(port, desired[port.Name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detachPortVLANs unassigns the vlans of a port which are not kept
+func (m *MetalClient) detachPortVLANs(port *packngo.Port, keep []string) error {
+	request := &packngo.VLANAssignmentBatchCreateRequest{}
+	var kept []packngo.VirtualNetwork
+	var native *packngo.VLANAssignmentCreateRequest
+	for _, vlan := range port.AttachedVirtualNetworks {
+		if containsVLAN(keep, vlan) {
+			kept = append(kept, vlan)
+			continue
+		}
+		assignment := packngo.VLANAssignmentCreateRequest{VLAN: vlanID(vlan), State: packngo.VLANAssignmentUnassigned}
+		if port.NativeVirtualNetwork != nil && vlanID(*port.NativeVirtualNetwork) == vlanID(vlan) {
+			native = &assignment
+			continue
+		}
+		request.VLANAssignments = append(request.VLANAssignments, assignment)
+	}
+	// the native vlan goes last, it can not be removed ahead of the others
+	if native != nil {
+		request.VLANAssignments = append(request.VLANAssignments, *native)
+	}
+
+	if err := m.runVLANBatch(port, request); err != nil {
+		return err
+	}
+	port.AttachedVirtualNetworks = kept
+	if port.NativeVirtualNetwork != nil && !containsVLAN(keep, *port.NativeVirtualNetwork) {
+		port.NativeVirtualNetwork = nil
+	}
+	return nil
+}
+
+// attachVLANs assigns the desired vlans missing from the ports of the device
+// and moves the native vlan of each port where it belongs, every port is
+// changed in one batch
+func (m *MetalClient) attachVLANs(device *packngo.Device, desired map[string][]string, native map[string]string) error {
+	for portName := range desired {
+		if devicePort(device, portName) == nil {
+			return fmt.Errorf("port %s not found in device %s", portName, device.ID)
+		}
+	}
+
+	for i := range device.NetworkPorts {
+		port := &device.NetworkPorts[i]
+		request := &packngo.VLANAssignmentBatchCreateRequest{}
+		for _, vlan := range desired[port.Name] {
+			isNative := vlan == native[port.Name]
+			currentNative := port.NativeVirtualNetwork != nil && sameVLAN(*port.NativeVirtualNetwork, vlan)
+			if portHasVLAN(port, vlan) && isNative == currentNative {
+				continue
+			}
+			assignment := packngo.VLANAssignmentCreateRequest{VLAN: vlan, State: packngo.VLANAssignmentAssigned}
+			if isNative || currentNative {
+				assignment.Native = &isNative
+			}
+			request.VLANAssignments = append(request.VLANAssignments, assignment)
+		}
+
+		if err := m.runVLANBatch(port, request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runVLANBatch submits the vlan assignments of a port as one batch. Batches
+// are applied by the api in the background, one still running, whether just
+// submitted or left by an earlier reconcile, returns a VLANBatchPendingError
+// and the port has to be read again once it completes.
+func (m *MetalClient) runVLANBatch(port *packngo.Port, request *packngo.VLANAssignmentBatchCreateRequest) error {
+	if len(request.VLANAssignments) == 0 {
+		return nil
+	}
+
+	batches, _, err := m.VLANAssignments.ListBatch(port.ID, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error listing vlan assignment batches of %s", port.Name)
+	}
+	for i := range batches {
+		if batchPending(&batches[i]) {
+			return &VLANBatchPendingError{Port: port.Name, BatchID: batches[i].ID}
+		}
+	}
+
+	batch, _, err := m.VLANAssignments.CreateBatch(port.ID, request, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error assigning vlans to %s", port.Name)
+	}
+	return batchResult(port, batch)
+}
+
+// checkVLANBatches looks up the batches recorded as pending in the status of
+// the instance. Batches which failed meanwhile are reported once, the next
+// reconcile submits the changes again.
+func (m *MetalClient) checkVLANBatches(instance *equinixv1alpha1.Instance, device *packngo.Device) error {
+	if instance.Status.Network == nil {
+		return nil
+	}
+	for _, recorded := range instance.Status.Network.Ports {
+		port := devicePort(device, recorded.Name)
+		if recorded.PendingBatch == "" || port == nil {
+			continue
+		}
+		batch, _, err := m.VLANAssignments.GetBatch(port.ID, recorded.PendingBatch, nil)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error checking vlan assignment batch of %s", port.Name)
+		}
+		if err := batchResult(port, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func batchResult(port *packngo.Port, batch *packngo.VLANAssignmentBatch) error {
+	if batchPending(batch) {
+		return &VLANBatchPendingError{Port: port.Name, BatchID: batch.ID}
+	}
+	if batch.State == packngo.VLANAssignmentBatchFailed {
+		return fmt.Errorf("vlan assignment batch %s on %s failed: %s", batch.ID, port.Name, strings.Join(batch.ErrorMessages, "; "))
+	}
+	return nil
+}
+
+func batchPending(batch *packngo.VLANAssignmentBatch) bool {
+	return batch.State == packngo.VLANAssignmentBatchQueued || batch.State == packngo.VLANAssignmentBatchInProgress
+}
+
+// DetachDeviceVLANs unassigns every vlan from the ports of a device, vlans
+// still assigned to a port can not be deleted
+func (m *MetalClient) DetachDeviceVLANs(deviceID string) error {
+	device, _, err := m.Devices.Get(deviceID, portIncludes)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return m.detachVLANs(device, nil)
+}
+
+func devicePort(device *packngo.Device, name string) *packngo.Port {
+	for i := range device.NetworkPorts {
+		if device.NetworkPorts[i].Name == name {
+			return &device.NetworkPorts[i]
+		}
+	}
+	return nil
+}
+
+func containsVLAN(entries []string, vlan packngo.VirtualNetwork) bool {
+	for _, entry := range entries {
+		if sameVLAN(vlan, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+func portHasVLAN(port *packngo.Port, entry string) bool {
+	for _, vlan := range port.AttachedVirtualNetworks {
+		if sameVLAN(vlan, entry) {
+			return true
+		}
+	}
+	return false
+}
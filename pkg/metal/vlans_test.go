@@ -0,0 +1,216 @@
+package metal
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/metal-operator/pkg/metal/fakeapi"
+	"github.com/packethost/packngo"
+)
+
+func portVLANs(t *testing.T, server *fakeapi.Server, deviceID string, portName string) []string {
+	t.Helper()
+	device, ok := server.Device(deviceID)
+	if !ok {
+		t.Fatalf("device %s not found", deviceID)
+	}
+	port, err := device.GetPortByName(portName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vlans []string
+	for _, vlan := range port.AttachedVirtualNetworks {
+		vlans = append(vlans, vlanID(vlan))
+	}
+	sort.Strings(vlans)
+	return vlans
+}
+
+func TestUpdateNetworkConfigVLANs(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.NetworkType = "hybrid"
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {"1000", "1001"}}
+	provision(t, m, instance)
+
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {"1001", "1002"}}
+	device, _ := server.Device(instance.Status.InstanceID)
+	if err := m.UpdateNetworkConfig(instance, device); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := portVLANs(t, server, instance.Status.InstanceID, "eth1"); len(got) != 2 || got[0] != "1001" || got[1] != "1002" {
+		t.Fatalf("expected vlans 1001 and 1002 on eth1, got %v", got)
+	}
+
+	instance.Spec.VLANAttachments = nil
+	device, _ = server.Device(instance.Status.InstanceID)
+	if err := m.UpdateNetworkConfig(instance, device); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := portVLANs(t, server, instance.Status.InstanceID, "eth1"); len(got) != 0 {
+		t.Fatalf("expected no vlans on eth1, got %v", got)
+	}
+}
+
+func TestConvertDeviceLayer3WithVLANs(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.NetworkType = "hybrid"
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {"1000"}}
+	provision(t, m, instance)
+
+	device, _ := server.Device(instance.Status.InstanceID)
+	if err := m.ConvertDevice(device, "layer3"); err != nil {
+		t.Fatalf("error converting device: %v", err)
+	}
+
+	device, _ = server.Device(instance.Status.InstanceID)
+	if got := device.GetNetworkType(); got != packngo.NetworkTypeL3 {
+		t.Fatalf("expected network type %s, got %s", packngo.NetworkTypeL3, got)
+	}
+	if got := portVLANs(t, server, instance.Status.InstanceID, "eth1"); len(got) != 0 {
+		t.Fatalf("expected no vlans on eth1, got %v", got)
+	}
+}
+
+func TestDeleteDeviceDetachesVLANs(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.NetworkType = "hybrid"
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {"1000"}}
+	provision(t, m, instance)
+
+	// the vlans are gone even when the device itself could not be deleted
+	server.AddFault(fakeapi.Fault{Method: "DELETE", Path: "/devices/", Status: 500, Message: "Internal server error"})
+	if err := m.DeleteDevice(instance); err == nil {
+		t.Fatal("expected error deleting the device")
+	}
+	if got := portVLANs(t, server, instance.Status.InstanceID, "eth1"); len(got) != 0 {
+		t.Fatalf("expected no vlans on eth1, got %v", got)
+	}
+}
+
+func TestNativeVLAN(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.NetworkType = "hybrid"
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {"1000", "1001"}}
+	instance.Spec.NativeVLAN = map[string]string{"eth1": "1001"}
+	provision(t, m, instance)
+
+	expected := equinixv1alpha1.InstancePort{Name: "eth1", Mode: packngo.NetworkTypeL2Individual, VLANs: []int{1000, 1001}, NativeVLAN: 1001}
+	if got := statusPort(instance.Status.Network, "eth1"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected port status %+v, got %+v", expected, got)
+	}
+
+	// both vlans went to the port in a single batch
+	device, _ := server.Device(instance.Status.InstanceID)
+	port, _ := device.GetPortByName("eth1")
+	batches, _, err := m.VLANAssignments.ListBatch(port.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 || batches[0].Quantity != 2 {
+		t.Fatalf("expected one batch of two assignments, got %+v", batches)
+	}
+
+	// the native vlan moves and is assigned when not listed
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {"1000"}}
+	instance.Spec.NativeVLAN = map[string]string{"eth1": "1002"}
+	status, err := m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = equinixv1alpha1.InstancePort{Name: "eth1", Mode: packngo.NetworkTypeL2Individual, VLANs: []int{1000, 1002}, NativeVLAN: 1002}
+	if got := statusPort(status.Network, "eth1"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected port status %+v, got %+v", expected, got)
+	}
+
+	instance.Spec.NativeVLAN = nil
+	status, err = m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = equinixv1alpha1.InstancePort{Name: "eth1", Mode: packngo.NetworkTypeL2Individual, VLANs: []int{1000}}
+	if got := statusPort(status.Network, "eth1"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected port status %+v, got %+v", expected, got)
+	}
+}
+
+func TestUpdateNetworkConfigBatchFailed(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.NetworkType = "hybrid"
+	provision(t, m, instance)
+
+	// the port claims a vlan the api does not know about, unassigning it fails
+	device, _ := server.Device(instance.Status.InstanceID)
+	port := devicePort(device, "eth1")
+	port.AttachedVirtualNetworks = []packngo.VirtualNetwork{{ID: "vlan-gone"}}
+
+	err := m.UpdateNetworkConfig(instance, device)
+	if err == nil || !strings.Contains(err.Error(), "vlan vlan-gone is not assigned") {
+		t.Fatalf("expected the batch error, got %v", err)
+	}
+}
+
+func TestUpdateDeviceVLANBatchPending(t *testing.T) {
+	m, server := newTestClient(t)
+	instance := newTestInstance()
+	instance.Spec.NetworkType = "hybrid"
+	provision(t, m, instance)
+
+	// the batch is left running, the update returns instead of waiting for it
+	server.HoldVLANBatches()
+	instance.Spec.VLANAttachments = map[string][]string{"eth1": {"1000"}}
+	status, err := m.UpdateDevice(instance)
+	if !IsVLANBatchPending(err) {
+		t.Fatalf("expected a pending batch, got %v", err)
+	}
+	batchID := statusPort(status.Network, "eth1").PendingBatch
+	if batchID == "" {
+		t.Fatalf("expected the pending batch in the port status, got %+v", status.Network)
+	}
+
+	// the next reconcile checks the recorded batch without submitting another
+	instance.Status = *status
+	status, err = m.UpdateDevice(instance)
+	if !IsVLANBatchPending(err) || !strings.Contains(err.Error(), batchID) {
+		t.Fatalf("expected batch %s to be pending, got %v", batchID, err)
+	}
+
+	server.ReleaseVLANBatches()
+	instance.Status = *status
+	status, err = m.UpdateDevice(instance)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := equinixv1alpha1.InstancePort{Name: "eth1", Mode: packngo.NetworkTypeL2Individual, VLANs: []int{1000}}
+	if got := statusPort(status.Network, "eth1"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected port status %+v, got %+v", expected, got)
+	}
+
+	device, _ := server.Device(instance.Status.InstanceID)
+	batches, _, err := m.VLANAssignments.ListBatch(devicePort(device, "eth1").ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 {
+		t.Fatalf("expected a single batch, got %+v", batches)
+	}
+}
+
+func statusPort(network *equinixv1alpha1.InstanceNetwork, name string) equinixv1alpha1.InstancePort {
+	if network == nil {
+		return equinixv1alpha1.InstancePort{}
+	}
+	for _, port := range network.Ports {
+		if port.Name == name {
+			return port
+		}
+	}
+	return equinixv1alpha1.InstancePort{}
+}